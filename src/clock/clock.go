@@ -2,54 +2,301 @@ package clock
 
 // Pacotes nativos de go e pacote interno
 import (
+	"errors"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"eachare/src/logger"
 )
 
+// Define uma int para o tipo de relógio do peer
+type Mode uint8
+
+// Define uma enum para os tipos de relógio
+// LAMPORT é o relógio escalar original, e VECTOR também conta os eventos vistos de cada peer
+// HYBRID é o relógio lógico híbrido, que segue o horário do sistema sem perder a ordem de Lamport
+const (
+	LAMPORT Mode = iota
+	VECTOR
+	HYBRID
+)
+
+// Quantidade de bits do contador lógico no valor do relógio híbrido
+// O valor é <milissegundos desde 1970> << HYBRID_LOGICAL_BITS | <contador>, e cabe no campo inteiro da mensagem
+const HYBRID_LOGICAL_BITS = 16
+
+// Formato do horário mostrado nos logs do relógio híbrido
+const HYBRID_TIME_FORMAT = "2006-01-02 15:04:05.000"
+
+// Quantos eventos cada checkpoint reserva à frente do relógio, ver SetCheckpoint
+const CHECKPOINT_RESERVE = 100
+
+// Quanto tempo cada checkpoint reserva à frente no modo HYBRID, em que cada milissegundo avança o valor em 1 << HYBRID_LOGICAL_BITS
+const HYBRID_CHECKPOINT_RESERVE = 10 * time.Second
+
+// Retorna o tipo de relógio como string
+func (m Mode) String() string {
+	switch m {
+	case LAMPORT:
+		return "lamport"
+	case VECTOR:
+		return "vector"
+	case HYBRID:
+		return "hybrid"
+	default:
+		return "unknown"
+	}
+}
+
+// Função para verificar se os valores dos dois tipos de relógio estão na mesma escala
+// VECTOR usa o mesmo valor escalar do LAMPORT, e só o HYBRID carrega o horário
+func (m Mode) SameScale(other Mode) bool {
+	return (m == HYBRID) == (other == HYBRID)
+}
+
+// Função para obter o tipo de relógio a partir de uma string, sem diferenciar maiúsculas
+func GetMode(s string) (Mode, error) {
+	for mode := LAMPORT; mode <= HYBRID; mode++ {
+		if strings.EqualFold(mode.String(), s) {
+			return mode, nil
+		}
+	}
+	return LAMPORT, errors.New("tipo de relógio desconhecido: " + s)
+}
+
 // Estrutura com o valor do relógio e um mutex para controle de concorrência
-type SafeClock struct {
-	mutex sync.Mutex
-	clock int
+// Cada peer tem o seu relógio, então vários peers podem rodar no mesmo processo
+// No modo VECTOR o valor escalar continua sendo o de Lamport, para os peers que não entendem o vetor
+// No modo HYBRID o valor escalar carrega o horário, ver HYBRID_LOGICAL_BITS, e now pode ser trocado nos testes
+type Clock struct {
+	mutex  sync.Mutex
+	clock  int
+	mode   Mode
+	self   string
+	vector Vector
+	now    func() time.Time
+
+	// Valor até onde o relógio pode avançar sem gravar um novo checkpoint
+	// saving indica uma gravação em andamento, e saved avisa quando ela termina
+	reserved   int
+	checkpoint func(value int, vector Vector)
+	saving     bool
+	saved      *sync.Cond
 }
 
-// Instância do relógio com mutex
-var safeClock = SafeClock{clock: 0}
+// Função para instanciar um relógio de Lamport começando em 0
+func New() *Clock {
+	return &Clock{clock: 0}
+}
+
+// Função para instanciar um relógio do tipo escolhido, com self sendo o endereço do próprio peer
+func NewWithMode(mode Mode, self string) *Clock {
+	c := &Clock{clock: 0, mode: mode, self: self}
+	if mode == VECTOR {
+		c.vector = Vector{self: 0}
+	}
+	if mode == HYBRID {
+		c.now = time.Now
+	}
+	return c
+}
 
 // Função para incrementar o relógio e imprimir mensagem de atualização
-func UpdateClock() int {
+func (c *Clock) Update() int {
 	// Bloqueia o mutex para garantir acesso exclusivo ao relógio
-	safeClock.mutex.Lock()
-	defer safeClock.mutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
 	// Incrementa o relógio e imprime a mensagem de atualização
-	safeClock.clock++
-	logger.Info("=> Atualizando relogio para " + strconv.Itoa(safeClock.clock))
-	return safeClock.clock
+	c.tick(logger.Info)
+	return c.clock
+}
+
+// Função para incrementar o relógio antes de um envio, retornando também uma cópia do vetor
+// O vetor é nil fora do modo VECTOR
+func (c *Clock) Stamp() (int, Vector) {
+	return c.StampWith(logger.Info)
+}
+
+// Função para o Stamp com a atualização mostrada por log, como logger.Debug nas mensagens do detector de falhas
+func (c *Clock) StampWith(log func(string)) (int, Vector) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.tick(log)
+	return c.clock, c.vector.Copy()
 }
 
 // Função para atualizar o relógio entre o valor local e o recebido
-func UpdateMaxClock(clockRecebido int) int {
+// O vetor recebido, se houver, é juntado ao local antes de contar o evento
+func (c *Clock) UpdateMax(clockRecebido int, vectorRecebido Vector) int {
+	return c.UpdateMaxWith(clockRecebido, vectorRecebido, logger.Info)
+}
+
+// Função para o UpdateMax com a atualização mostrada por log, como logger.Debug nas mensagens do detector de falhas
+func (c *Clock) UpdateMaxWith(clockRecebido int, vectorRecebido Vector, log func(string)) int {
 	// Bloqueia o mutex para garantir acesso exclusivo ao relógio
-	safeClock.mutex.Lock()
-	defer safeClock.mutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
 	// Incrementa o relógio e imprime a mensagem de atualização
-	if safeClock.clock < clockRecebido {
-		safeClock.clock = clockRecebido
+	if c.clock < clockRecebido {
+		c.clock = clockRecebido
+	}
+	if c.mode == VECTOR {
+		c.vector = c.vector.Merge(vectorRecebido)
+	}
+	c.tick(log)
+	return c.clock
+}
+
+// Função para contar um evento local, com o mutex já bloqueado, mostrando a atualização por log
+func (c *Clock) tick(log func(string)) {
+	c.clock = c.awaitReserve()
+	switch c.mode {
+	case VECTOR:
+		c.vector[c.self]++
+		log("=> Atualizando relogio para " + strconv.Itoa(c.clock) + " (" + c.vector.String() + ")")
+	case HYBRID:
+		log("=> Atualizando relogio para " + strconv.Itoa(c.clock) + " (" + FormatHybrid(c.clock) + ")")
+	default:
+		log("=> Atualizando relogio para " + strconv.Itoa(c.clock))
+	}
+	// Passada metade da reserva, o próximo checkpoint já começa a ser gravado em segundo plano
+	if c.checkpoint != nil && !c.saving && c.clock >= c.reserved-c.reserveStep()/2 {
+		c.startSave()
+	}
+}
+
+// Função para o tamanho da reserva de cada checkpoint no valor do relógio
+func (c *Clock) reserveStep() int {
+	if c.mode == HYBRID {
+		return int(HYBRID_CHECKPOINT_RESERVE.Milliseconds()) << HYBRID_LOGICAL_BITS
+	}
+	return CHECKPOINT_RESERVE
+}
+
+// Função para o próximo valor do relógio, sem avançá-lo
+// No modo HYBRID, avança o contador ou pula para o horário do sistema se ele já passou do relógio
+// Como UpdateMax já levou o relógio ao máximo com o recebido, isso segue as regras do relógio híbrido
+func (c *Clock) next() int {
+	if c.mode == HYBRID {
+		return max(c.clock+1, int(c.now().UnixMilli())<<HYBRID_LOGICAL_BITS)
+	}
+	return c.clock + 1
+}
+
+// Função para obter o próximo valor do relógio, com o mutex já bloqueado, esperando até ele estar coberto por um checkpoint gravado
+// Só trava quando a gravação em segundo plano não terminou antes de o relógio gastar a reserva
+func (c *Clock) awaitReserve() int {
+	for {
+		next := c.next()
+		if c.checkpoint == nil || next <= c.reserved {
+			return next
+		}
+		if !c.saving {
+			c.startSave()
+		}
+		c.saved.Wait()
+	}
+}
+
+// Função para começar a gravar um checkpoint uma reserva à frente, com o mutex já bloqueado
+// A gravação roda fora do mutex, e o relógio só passa a contar com ela depois que termina
+// No vetor, a entrada do próprio peer também é reservada, já que ela anda no máximo junto com o relógio
+func (c *Clock) startSave() {
+	value := c.clock + c.reserveStep()
+	if c.mode == HYBRID {
+		value = max(c.clock, int(c.now().UnixMilli())<<HYBRID_LOGICAL_BITS) + c.reserveStep()
+	}
+	vector := c.vector.Copy()
+	if vector != nil {
+		vector[c.self] += CHECKPOINT_RESERVE
+	}
+	c.saving = true
+	go func() {
+		c.checkpoint(value, vector)
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.reserved = max(c.reserved, value)
+		c.saving = false
+		c.saved.Broadcast()
+	}()
+}
+
+// Função para gravar um checkpoint e esperar a gravação terminar, com o mutex já bloqueado
+func (c *Clock) saveNow() {
+	for c.saving {
+		c.saved.Wait()
+	}
+	c.startSave()
+	for c.saving {
+		c.saved.Wait()
+	}
+}
+
+// Função para registrar onde gravar os checkpoints do relógio, já gravando o primeiro
+// O relógio nunca passa do último valor gravado, então restaurar o último checkpoint depois de uma queda
+// nunca volta para um valor já enviado. O checkpoint é chamado fora do mutex, uma gravação por vez
+func (c *Clock) SetCheckpoint(checkpoint func(value int, vector Vector)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.checkpoint = checkpoint
+	c.saved = sync.NewCond(&c.mutex)
+	c.saveNow()
+}
+
+// Função para gravar um checkpoint agora, como antes de encerrar o programa
+func (c *Clock) Checkpoint() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.checkpoint != nil {
+		c.saveNow()
+	}
+}
+
+// Função para continuar de um valor gravado antes de um reinício, sem nunca voltar o relógio
+// O vetor só é restaurado no modo VECTOR
+func (c *Clock) Restore(value int, vector Vector) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clock = max(c.clock, value)
+	if c.mode == VECTOR {
+		c.vector = c.vector.Merge(vector)
 	}
-	safeClock.clock++
-	logger.Info("=> Atualizando relogio para " + strconv.Itoa(safeClock.clock))
-	return safeClock.clock
 }
 
 // Função para obter o valor atual do relógio
-func GetClock() int {
+func (c *Clock) Get() int {
 	// Bloqueia o mutex para garantir acesso exclusivo ao relógio
-	safeClock.mutex.Lock()
-	defer safeClock.mutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
 	// Retorna o valor atual do relógio
-	return safeClock.clock
+	return c.clock
+}
+
+// Função para obter uma cópia do relógio vetorial, nil fora do modo VECTOR
+func (c *Clock) Vector() Vector {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.vector.Copy()
+}
+
+// Função para obter o tipo do relógio
+func (c *Clock) Mode() Mode {
+	return c.mode
+}
+
+// Função para separar o valor do relógio híbrido no horário e no contador lógico
+func SplitHybrid(value int) (time.Time, int) {
+	return time.UnixMilli(int64(value >> HYBRID_LOGICAL_BITS)), value & (1<<HYBRID_LOGICAL_BITS - 1)
+}
+
+// Função para mostrar o valor do relógio híbrido como horário local e contador, ex.: "2025-06-01 14:03:07.250 +2"
+func FormatHybrid(value int) string {
+	physical, logical := SplitHybrid(value)
+	return physical.Format(HYBRID_TIME_FORMAT) + " +" + strconv.Itoa(logical)
 }
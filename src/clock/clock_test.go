@@ -1,29 +1,220 @@
 package clock
 
 import (
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestUpdateClock(t *testing.T) {
-	safeClock.clock = 0
-	UpdateClock()
-	if safeClock.clock != 1 {
-		t.Errorf("Expected clock to be 1, but got %d", safeClock.clock)
+	localClock := New()
+	localClock.Update()
+	if localClock.clock != 1 {
+		t.Errorf("Expected clock to be 1, but got %d", localClock.clock)
 	}
 }
 
 func TestUpdateMaxClock(t *testing.T) {
-	safeClock.clock = 0
-	UpdateMaxClock(10)
-	if safeClock.clock != 11 {
-		t.Errorf("Expected clock to be 11, but got %d", safeClock.clock)
+	localClock := New()
+	localClock.UpdateMax(10, nil)
+	if localClock.clock != 11 {
+		t.Errorf("Expected clock to be 11, but got %d", localClock.clock)
 	}
 }
 
 func TestGetClock(t *testing.T) {
-	safeClock.clock = 10
-	value := GetClock()
+	localClock := &Clock{clock: 10}
+	value := localClock.Get()
 	if value != 10 {
 		t.Errorf("Expected value to be 10, but got %d", value)
 	}
 }
+
+func TestClocksAreIndependent(t *testing.T) {
+	first, second := New(), New()
+	first.Update()
+	first.UpdateMax(5, nil)
+	if second.Get() != 0 {
+		t.Errorf("Expected a fresh clock to stay at 0, but got %d", second.Get())
+	}
+	if first.Get() != 6 {
+		t.Errorf("Expected clock to be 6, but got %d", first.Get())
+	}
+}
+
+func TestVectorCompare(t *testing.T) {
+	cases := []struct {
+		first, second Vector
+		expected      Ordering
+	}{
+		{Vector{"a": 1, "b": 2}, Vector{"a": 1, "b": 2}, EQUAL},
+		{Vector{"a": 1}, Vector{"a": 1, "b": 0}, EQUAL},
+		{Vector{"a": 1}, Vector{"a": 2}, BEFORE},
+		{Vector{"a": 1}, Vector{"a": 1, "b": 1}, BEFORE},
+		{Vector{"a": 3, "b": 1}, Vector{"a": 2}, AFTER},
+		{Vector{"a": 2, "b": 1}, Vector{"a": 1, "b": 2}, CONCURRENT},
+		{Vector{"a": 1}, Vector{"b": 1}, CONCURRENT},
+		{nil, Vector{"a": 1}, BEFORE},
+	}
+	for _, c := range cases {
+		if got := c.first.Compare(c.second); got != c.expected {
+			t.Errorf("%v.Compare(%v): expected %s, got %s", c.first, c.second, c.expected, got)
+		}
+	}
+}
+
+func TestVectorParse(t *testing.T) {
+	vector := Vector{"127.0.0.1:9002": 1, "127.0.0.1:9001": 3}
+	encoded := vector.String()
+	if encoded != "127.0.0.1:9001=3,127.0.0.1:9002=1" {
+		t.Errorf("Expected peers in order, got %q", encoded)
+	}
+	parsed, err := ParseVector(encoded)
+	if err != nil || parsed.Compare(vector) != EQUAL {
+		t.Errorf("ParseVector(%q) = %v, %v", encoded, parsed, err)
+	}
+
+	for _, invalid := range []string{"", "a", "a=", "=1", "a=-1", "a=01", "a=1,a=2", "a=1,", "a|b=1"} {
+		if _, err := ParseVector(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestVectorClock(t *testing.T) {
+	localClock := NewWithMode(VECTOR, "a")
+	value, vector := localClock.Stamp()
+	if value != 1 || vector.Compare(Vector{"a": 1}) != EQUAL {
+		t.Errorf("Expected 1 and a=1 after a send, got %d and %v", value, vector)
+	}
+
+	// Receber junta o vetor recebido e conta o próprio evento
+	localClock.UpdateMax(5, Vector{"b": 4})
+	if localClock.Get() != 6 || localClock.Vector().Compare(Vector{"a": 2, "b": 4}) != EQUAL {
+		t.Errorf("Expected 6 and a=2,b=4, got %d and %v", localClock.Get(), localClock.Vector())
+	}
+
+	// A cópia retornada não muda o relógio
+	localClock.Vector()["a"] = 100
+	if localClock.Vector()["a"] != 2 {
+		t.Errorf("Expected Vector to return a copy")
+	}
+
+	// No modo de Lamport não há vetor
+	if _, vector := New().Stamp(); vector != nil {
+		t.Errorf("Expected no vector in lamport mode, got %v", vector)
+	}
+	if _, err := GetMode("Vector"); err != nil {
+		t.Errorf("GetMode failed: %v", err)
+	}
+	if _, err := GetMode("sundial"); err == nil {
+		t.Errorf("Expected an error for an unknown mode")
+	}
+}
+
+func TestHybridClock(t *testing.T) {
+	now := time.UnixMilli(1750000000000)
+	localClock := NewWithMode(HYBRID, "a")
+	localClock.now = func() time.Time { return now }
+	physical := int(now.UnixMilli()) << HYBRID_LOGICAL_BITS
+
+	// O primeiro evento pula para o horário do sistema, e os seguintes no mesmo milissegundo contam no contador
+	if value := localClock.Update(); value != physical {
+		t.Errorf("Expected the physical time with counter 0, got %d", value)
+	}
+	if value, vector := localClock.Stamp(); value != physical+1 || vector != nil {
+		t.Errorf("Expected counter 1 and no vector, got %d and %v", value, vector)
+	}
+
+	// Um relógio recebido à frente é seguido, e um atrasado não faz o relógio voltar
+	if value := localClock.UpdateMax(physical+5, nil); value != physical+6 {
+		t.Errorf("Expected to move past the received clock, got %d", value)
+	}
+	if value := localClock.UpdateMax(3, nil); value != physical+7 {
+		t.Errorf("Expected an old clock to only advance the counter, got %d", value)
+	}
+
+	// Quando o horário do sistema passa do relógio, o contador volta a 0
+	now = now.Add(time.Millisecond)
+	value := localClock.Update()
+	if stamp, logical := SplitHybrid(value); !stamp.Equal(now) || logical != 0 {
+		t.Errorf("Expected %v +0, got %v +%d", now, stamp, logical)
+	}
+	if mode, err := GetMode("HYBRID"); err != nil || mode != HYBRID {
+		t.Errorf("GetMode failed: %v, %v", mode, err)
+	}
+}
+
+func TestClockCheckpoint(t *testing.T) {
+	// Cada gravação só termina quando o teste libera, para ver o relógio esperando por ela
+	checkpoints := make(chan int, 1)
+	release := make(chan struct{}, 1)
+	localClock := New()
+	release <- struct{}{}
+	localClock.SetCheckpoint(func(value int, vector Vector) {
+		checkpoints <- value
+		<-release
+	})
+	if value := <-checkpoints; value != CHECKPOINT_RESERVE {
+		t.Fatalf("Expected a first checkpoint at %d, got %d", CHECKPOINT_RESERVE, value)
+	}
+
+	// Passada metade da reserva, o próximo checkpoint começa em segundo plano, sem travar o relógio
+	for i := 0; i < CHECKPOINT_RESERVE/2; i++ {
+		localClock.Update()
+	}
+	if value := <-checkpoints; value != CHECKPOINT_RESERVE/2+CHECKPOINT_RESERVE {
+		t.Errorf("Expected a checkpoint at %d, got %d", CHECKPOINT_RESERVE/2+CHECKPOINT_RESERVE, value)
+	}
+	for i := 0; i < CHECKPOINT_RESERVE/2; i++ {
+		localClock.Update()
+	}
+
+	// Sem a gravação terminar, o relógio não passa do último checkpoint gravado
+	updated := make(chan int)
+	go func() { updated <- localClock.Update() }()
+	select {
+	case value := <-updated:
+		t.Fatalf("Expected the clock to wait for the checkpoint, got %d", value)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	if value := <-updated; value != CHECKPOINT_RESERVE+1 {
+		t.Errorf("Expected the clock to continue at %d, got %d", CHECKPOINT_RESERVE+1, value)
+	}
+
+	// O relógio restaurado nunca volta
+	restored := New()
+	restored.Restore(2*CHECKPOINT_RESERVE, nil)
+	restored.Restore(5, nil)
+	if restored.Get() != 2*CHECKPOINT_RESERVE {
+		t.Errorf("Expected the restored clock to be %d, got %d", 2*CHECKPOINT_RESERVE, restored.Get())
+	}
+
+	// No vetor, a entrada do próprio peer também é reservada
+	vectorClock := NewWithMode(VECTOR, "a")
+	vectorClock.Update()
+	var reserved Vector
+	vectorClock.SetCheckpoint(func(value int, vector Vector) {
+		reserved = vector
+	})
+	if reserved["a"] != 1+CHECKPOINT_RESERVE || vectorClock.Vector()["a"] != 1 {
+		t.Errorf("Expected a=%d reserved and a=1 in the clock, got %v and %v", 1+CHECKPOINT_RESERVE, reserved, vectorClock.Vector())
+	}
+
+	// No híbrido a reserva é de tempo, então eventos em milissegundos diferentes não gravam a cada um
+	hybridClock := NewWithMode(HYBRID, "a")
+	now := time.Now()
+	hybridClock.now = func() time.Time { return now }
+	var saves atomic.Int32
+	hybridClock.SetCheckpoint(func(value int, vector Vector) {
+		saves.Add(1)
+	})
+	for i := 0; i < 50; i++ {
+		now = now.Add(time.Millisecond)
+		hybridClock.Update()
+	}
+	if count := saves.Load(); count != 1 {
+		t.Errorf("Expected only the first checkpoint in 50ms of hybrid events, got %d", count)
+	}
+}
@@ -0,0 +1,133 @@
+package clock
+
+// Pacotes nativos de go
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Separadores do relógio vetorial no formato da linha, ex.: "127.0.0.1:9001=3,127.0.0.1:9002=1"
+const (
+	VECTOR_SEPARATOR = ","
+	ENTRY_SEPARATOR  = "="
+)
+
+// Erro para um relógio vetorial que não segue o formato da linha
+var ErrBadVector = errors.New("relógio vetorial inválido")
+
+// Tipo para o relógio vetorial, com a quantidade de eventos vistos de cada peer
+type Vector map[string]int
+
+// Define uma int para o resultado da comparação entre dois relógios vetoriais
+type Ordering uint8
+
+// Define uma enum para a comparação, do ponto de vista do relógio que chama Compare
+const (
+	EQUAL      Ordering = iota // Os dois viram exatamente os mesmos eventos
+	BEFORE                     // Aconteceu antes do outro, que já viu tudo o que este viu
+	AFTER                      // Aconteceu depois do outro
+	CONCURRENT                 // Cada um viu eventos que o outro não viu
+)
+
+// Retorna a comparação como string
+func (o Ordering) String() string {
+	switch o {
+	case EQUAL:
+		return "EQUAL"
+	case BEFORE:
+		return "BEFORE"
+	case AFTER:
+		return "AFTER"
+	default:
+		return "CONCURRENT"
+	}
+}
+
+// Função para comparar dois relógios vetoriais, com peers ausentes valendo 0
+func (v Vector) Compare(other Vector) Ordering {
+	less, greater := false, false
+	for peer, count := range v {
+		if count > other[peer] {
+			greater = true
+		} else if count < other[peer] {
+			less = true
+		}
+	}
+	for peer, count := range other {
+		if _, exists := v[peer]; !exists && count > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case less && greater:
+		return CONCURRENT
+	case less:
+		return BEFORE
+	case greater:
+		return AFTER
+	default:
+		return EQUAL
+	}
+}
+
+// Função para juntar dois relógios vetoriais, ficando com o maior valor de cada peer
+func (v Vector) Merge(other Vector) Vector {
+	merged := v.Copy()
+	if merged == nil && len(other) > 0 {
+		merged = make(Vector, len(other))
+	}
+	for peer, count := range other {
+		merged[peer] = max(merged[peer], count)
+	}
+	return merged
+}
+
+// Função para copiar o relógio vetorial, já que mapas são compartilhados por referência
+func (v Vector) Copy() Vector {
+	if v == nil {
+		return nil
+	}
+	copied := make(Vector, len(v))
+	for peer, count := range v {
+		copied[peer] = count
+	}
+	return copied
+}
+
+// Função para o relógio vetorial no formato da linha, com os peers em ordem
+func (v Vector) String() string {
+	peers := make([]string, 0, len(v))
+	for peer := range v {
+		peers = append(peers, peer)
+	}
+	slices.Sort(peers)
+
+	entries := make([]string, len(peers))
+	for i, peer := range peers {
+		entries[i] = peer + ENTRY_SEPARATOR + strconv.Itoa(v[peer])
+	}
+	return strings.Join(entries, VECTOR_SEPARATOR)
+}
+
+// Função para interpretar o relógio vetorial no formato da linha
+func ParseVector(s string) (Vector, error) {
+	vector := make(Vector)
+	for _, entry := range strings.Split(s, VECTOR_SEPARATOR) {
+		peer, countString, found := strings.Cut(entry, ENTRY_SEPARATOR)
+		if !found || peer == "" || strings.ContainsAny(peer, " \n\r|"+ENTRY_SEPARATOR) {
+			return nil, ErrBadVector
+		}
+		count, err := strconv.Atoi(countString)
+		if err != nil || count < 0 || strconv.Itoa(count) != countString {
+			return nil, ErrBadVector
+		}
+		if _, exists := vector[peer]; exists {
+			return nil, ErrBadVector
+		}
+		vector[peer] = count
+	}
+	return vector, nil
+}
@@ -6,10 +6,13 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"math"
-	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,102 +20,76 @@ import (
 
 	"eachare/src/clock"
 	"eachare/src/connection"
+	"eachare/src/download"
+	"eachare/src/files"
 	"eachare/src/logger"
 	"eachare/src/message"
 	"eachare/src/peers"
 )
 
-const MAX_CONCURRENT_PER_MANAGER = 50
-const MAX_FAILURES_PER_ORIGIN = 15
-const MAX_RETRIES_PER_CHUNK = 15
+// Tamanho de chunk que liga o modo adaptativo, em que o tamanho é escolhido para cada origem durante o download
+const ADAPTIVE_CHUNK = 0
 
-type HealthyOrigins struct {
-	mu         sync.Mutex
-	origins    []string
-	failCounts map[string]int
+// Erro para um arquivo montado cujo SHA-256 não confere com o anunciado no LS_LIST
+var ErrFileIntegrity = errors.New("hash do arquivo não confere")
+
+// Erro para um download que terminou sem todos os chunks, mas que pode ser retomado
+var ErrIncomplete = errors.New("download incompleto")
+
+// Intervalo mínimo entre gravações do diário durante o download
+const JOURNAL_INTERVAL = time.Second
+
+// Estrutura para um arquivo do download
+// Com hash, o arquivo é identificado pelo conteúdo e cada origem pode guardá-lo com outro nome
+type File struct {
+	name        string
+	size        int
+	hash        string
+	origin      []string
+	aliases     []string
+	remoteNames map[string]string
 }
 
-func NewHealthyOrigins(initialOrigins []string) *HealthyOrigins {
-	return &HealthyOrigins{
-		origins:    initialOrigins,
-		failCounts: make(map[string]int),
-	}
+func (f *File) OriginsString() string {
+	return strings.Join(f.origin, ", ")
 }
 
-func (h *HealthyOrigins) Remove(originToRemove string) {
-	if originToRemove == "" {
+// Função para adicionar uma origem que guarda o arquivo com determinado nome
+func (f *File) AppendOrigin(origin string, filename string) {
+	if filename != f.name && !slices.Contains(f.aliases, filename) {
+		f.aliases = append(f.aliases, filename)
+	}
+	if slices.Contains(f.origin, origin) {
 		return
 	}
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	h.failCounts[originToRemove]++
-	if h.failCounts[originToRemove] >= MAX_FAILURES_PER_ORIGIN {
-		// remove origin from h.origins
-		for i, origin := range h.origins {
-			if origin == originToRemove {
-				h.origins = append(h.origins[:i], h.origins[i+1:]...)
-				return
-			}
+	f.origin = append(f.origin, origin)
+	if filename != f.name {
+		if f.remoteNames == nil {
+			f.remoteNames = make(map[string]string)
 		}
+		f.remoteNames[origin] = filename
 	}
 }
 
-func (h *HealthyOrigins) ErrorSummary() string {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	var sb strings.Builder
-	for origin, count := range h.failCounts {
-		sb.WriteString(fmt.Sprintf("Origin %s: %d errors\n", origin, count))
-	}
-	return sb.String()
-}
-
-func (h *HealthyOrigins) UnsafeErrorSummary() string {
-	var sb strings.Builder
-	for origin, count := range h.failCounts {
-		sb.WriteString(fmt.Sprintf("Origin %s: %d errors\n", origin, count))
+// Função para obter o nome do arquivo na origem, usado no DL
+func (f *File) NameAt(origin string) string {
+	if name, exists := f.remoteNames[origin]; exists {
+		return name
 	}
-	return sb.String()
+	return f.name
 }
 
-func (h *HealthyOrigins) GetNext() (string, error) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	if len(h.origins) == 0 {
-		return "", errors.New("não era pra dar errado: " + h.UnsafeErrorSummary())
-	}
-
-	randomIndex := rand.Intn(len(h.origins))
-	return h.origins[randomIndex], nil
+// Função para o SHA-256 anunciado pelas origens, vazio se elas não anunciaram HASH_FEATURE
+func (f *File) Hash() string {
+	return f.hash
 }
 
-func (h *HealthyOrigins) GetAll() ([]string, error) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	if len(h.origins) == 0 {
-		return nil, errors.New("no healthy origins available")
+// Função para o nome mostrado no menu, com os outros nomes do mesmo conteúdo entre parênteses
+func (f *File) DisplayName() string {
+	if len(f.aliases) == 0 {
+		return f.name
 	}
-	listCopy := make([]string, len(h.origins))
-	copy(listCopy, h.origins)
-	return listCopy, nil
-}
-
-// Estrutura para um arquivo do download
-type File struct {
-	name   string
-	size   int
-	origin []string
-}
-
-func (f *File) OriginsString() string {
-	return strings.Join(f.origin, ", ")
-}
-
-func (f *File) AppendOrigin(origin string) {
-	f.origin = append(f.origin, origin)
+	return f.name + " (" + strings.Join(f.aliases, ", ") + ")"
 }
 
 // Estrutura para lista de arquivos do download
@@ -128,24 +105,58 @@ func (fl *FileList) Len() int {
 	return len(fl.files)
 }
 
-func (fl *FileList) AppendFile(filename string, size int, origin string) {
+// Função para encontrar um arquivo da busca pelo nome, inclusive pelos outros nomes do mesmo conteúdo
+func (fl *FileList) Find(filename string) (File, bool) {
+	for _, file := range fl.files {
+		if file.name == filename || slices.Contains(file.aliases, filename) {
+			return file, true
+		}
+	}
+	return File{}, false
+}
+
+// Arquivos com hash são agrupados pelo conteúdo, independente do nome em cada origem
+// Sem hash (peers que não anunciam HASH_FEATURE), só nome e tamanho iguais são agrupados
+func (fl *FileList) AppendFile(filename string, size int, hash string, origin string) {
 	for idx, file := range fl.files {
-		if file.name == filename && file.size == size {
-			fl.files[idx].AppendOrigin(origin)
+		sameContent := hash != "" && file.hash == hash && file.size == size
+		sameName := hash == "" && file.hash == "" && file.name == filename && file.size == size
+		if sameContent || sameName {
+			fl.files[idx].AppendOrigin(origin, filename)
 			return
 		}
 	}
-	fl.files = append(fl.files, File{filename, size, []string{origin}})
+	fl.files = append(fl.files, File{name: filename, size: size, hash: hash, origin: []string{origin}})
 }
 
 // Estrutura para estatísticas do download
+// Downloads no modo adaptativo têm chunckSize ADAPTIVE_CHUNK e guardam em chosenSizes o chunk médio de cada um
 type Statistic struct {
-	chunckSize int
-	peersQty   int
-	fileSize   int
-	times      []float64
+	chunckSize  int
+	peersQty    int
+	fileSize    int
+	times       []float64
+	chosenSizes []int
 }
 
+// Função para descrever o tamanho de chunk da estatística
+func (s Statistic) chunkSizeString() string {
+	if s.chunckSize != ADAPTIVE_CHUNK {
+		return strconv.Itoa(s.chunckSize)
+	}
+	mean := 0
+	for _, size := range s.chosenSizes {
+		mean += size
+	}
+	if len(s.chosenSizes) > 0 {
+		mean /= len(s.chosenSizes)
+	}
+	return "auto (~" + strconv.Itoa(mean) + ")"
+}
+
+// Trava para as estatísticas, atualizadas pelos downloads em segundo plano
+var statisticsMu sync.Mutex
+
 // Função para verificar e imprimir mensagem de erro
 func check(err error) {
 	if err != nil {
@@ -154,7 +165,7 @@ func check(err error) {
 }
 
 // Função para listar os peers conhecidos e enviar HELLO para o peer escolhido
-func ListPeers(knownPeers *peers.SafePeers, senderAddress string) {
+func ListPeers(knownPeers *peers.SafePeers, localClock *clock.Clock, pool *connection.Pool, senderAddress string) {
 	// Declara variável para o comando e inicia o loop do menu de peers
 	var comm string
 	for {
@@ -183,14 +194,7 @@ func ListPeers(knownPeers *peers.SafePeers, senderAddress string) {
 			logger.Std("\n")
 
 			// Cria e envia a mensagem HELLO para o peer escolhido
-			sendMessage := message.BaseMessage{Origin: senderAddress, Clock: 0, Type: message.HELLO, Arguments: nil}
-			conn, _ := net.Dial("tcp", addrList[number-1])
-			connection.SendMessage(knownPeers, conn, sendMessage, addrList[number-1])
-			if conn != nil {
-				logger.Info("Atualizando peer " + addrList[number-1] + " status " + peers.ONLINE.String())
-				defer conn.Close()
-				conn.SetDeadline(time.Now().Add(2 * time.Second))
-			}
+			HelloRequest(knownPeers, localClock, pool, senderAddress, addrList[number-1])
 			break
 		} else {
 			logger.Std("\nOpção inválida, tente novamente.\n\n")
@@ -198,47 +202,114 @@ func ListPeers(knownPeers *peers.SafePeers, senderAddress string) {
 	}
 }
 
+// Tempo máximo para as respostas de HELLO, GET_PEERS e LS
+const REQUEST_TIMEOUT = 2 * time.Second
+
+// Função para negociar as capacidades com o peer que ainda não fez HELLO, antes de lhe enviar uma requisição
+// Retorna se o peer continua online depois da negociação
+func negotiate(knownPeers *peers.SafePeers, localClock *clock.Clock, pool *connection.Pool, senderAddress string, receiverAddress string) bool {
+	if neighbor, _ := knownPeers.Get(receiverAddress); !neighbor.Capabilities.Known() {
+		HelloRequest(knownPeers, localClock, pool, senderAddress, receiverAddress)
+	}
+	neighbor, _ := knownPeers.Get(receiverAddress)
+	return neighbor.Status == peers.ONLINE
+}
+
+// Tempo máximo para a resposta de cada chunk
+const CHUNK_TIMEOUT = 10 * time.Second
+
+// Função para mensagem HELLO, anuncia as capacidades e guarda as do peer se ele responder
+func HelloRequest(knownPeers *peers.SafePeers, localClock *clock.Clock, pool *connection.Pool, senderAddress string, receiverAddress string) {
+	sendMessage := message.BaseMessage{Origin: senderAddress, Clock: 0, Type: message.HELLO, Arguments: message.LocalCapabilities().Arguments()}
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
+
+	// Peers no formato original fecham a conexão sem responder, e só eles ficam marcados com LEGACY_VERSION
+	// Um peer que só demorou continua com as capacidades desconhecidas, para o próximo HELLO negociar de novo
+	receivedMessage, err := pool.Request(ctx, knownPeers, sendMessage, receiverAddress)
+	var malformedErr *message.MalformedError
+	if errors.Is(err, connection.ErrNotDelivered) || errors.As(err, &malformedErr) {
+		return
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		logger.Info("Sem resposta ao HELLO de " + receiverAddress + ": " + err.Error())
+		return
+	}
+	logger.Info("Atualizando peer " + receiverAddress + " status " + peers.ONLINE.String())
+	if err != nil || receivedMessage.Type != message.HELLO {
+		knownPeers.SetCapabilities(receiverAddress, message.Capabilities{Version: message.LEGACY_VERSION})
+		return
+	}
+	logger.Info("Resposta recebida: \"" + receivedMessage.String() + "\"")
+	localClock.UpdateMax(receivedMessage.Clock, receivedMessage.Vector)
+
+	capabilities, err := message.ParseCapabilities(receivedMessage.Arguments)
+	if err != nil {
+		logger.Error("Capacidades inválidas recebidas de " + receiverAddress + ": " + err.Error())
+		return
+	}
+	knownPeers.SetCapabilities(receiverAddress, capabilities)
+}
+
 // Função para mensagem GET_PEERS, solicita para os vizinhos sobre quem eles conhecem
-func GetPeersRequest(knownPeers *peers.SafePeers, senderAddress string) {
+func GetPeersRequest(knownPeers *peers.SafePeers, localClock *clock.Clock, pool *connection.Pool, senderAddress string) {
 	// Cria a estrutura da mensagem GET_PEERS
 	sendMessage := message.BaseMessage{Origin: senderAddress, Clock: 0, Type: message.GET_PEERS, Arguments: nil}
 
 	// Envia mensagem GET_PEERS para cada peer conhecido
 	for _, peer := range knownPeers.GetAll() {
-		conn, _ := net.Dial("tcp", peer.Address)
-		connection.SendMessage(knownPeers, conn, sendMessage, peer.Address)
-		if conn != nil {
-			defer conn.Close()
-			conn.SetDeadline(time.Now().Add(2 * time.Second))
-
-			// Recebe a resposta apenas se a conexão for bem-sucedida
-			receivedMessage := connection.ReceiveMessage(knownPeers, conn)
-			logger.Info("Resposta recebida: \"" + receivedMessage.String() + "\"")
-			clock.UpdateMaxClock(receivedMessage.Clock)
-			logger.Info("Atualizando peer " + receivedMessage.Origin + " status " + peers.ONLINE.String())
-
-			// Itera sobre os peers no argumento da mensagem recebida
-			for _, peer := range receivedMessage.Arguments[1:] {
-				// Salva as partes do peer
-				peerParts := strings.Split(peer, ":")
-				peerAddress := peerParts[0] + ":" + peerParts[1]
-				peerStatus := peers.GetStatus(peerParts[2])
-				peerClock, _ := strconv.Atoi(peerParts[3])
-
-				// Verifica as condições para atualizar ou adicionar o peer recebido
-				neighbor, exists := knownPeers.Get(peerAddress)
-				if exists {
-					// Atualiza o status e o clock apenas se for mais recente
-					if peerClock >= neighbor.Clock {
-						knownPeers.Add(peers.Peer{Address: peerAddress, Status: peerStatus, Clock: peerClock})
-						logger.Info("Atualizando peer " + peerAddress + " status " + peerParts[2])
-					} else {
-						logger.Info("Continuando peer " + peerAddress + " status " + neighbor.Status.String() + " (informação desatualizada recebida)")
-					}
-				} else {
-					knownPeers.Add(peers.Peer{Address: peerAddress, Status: peerStatus, Clock: peerClock})
-					logger.Info("Adicionando novo peer " + peerAddress + " status " + peerParts[2])
-				}
+		// Sem o HELLO, nenhum dos lados sabe que o outro entende o relógio vetorial
+		if !peer.Capabilities.Known() && !negotiate(knownPeers, localClock, pool, senderAddress, peer.Address) {
+			continue
+		}
+
+		// Recebe a resposta apenas se a conexão for bem-sucedida
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		receivedMessage, err := pool.Request(ctx, knownPeers, sendMessage, peer.Address)
+		cancel()
+		if err != nil {
+			continue
+		}
+		logger.Info("Resposta recebida: \"" + receivedMessage.String() + "\"")
+		localClock.UpdateMax(receivedMessage.Clock, receivedMessage.Vector)
+		logger.Info("Atualizando peer " + receivedMessage.Origin + " status " + peers.ONLINE.String())
+
+		// Um peer que recusou a requisição não tem lista de peers para processar
+		if receivedMessage.Type == message.ERROR {
+			logger.Info("Pedido de peers recusado: " + message.ParseError(receivedMessage).Error())
+			continue
+		} else if receivedMessage.Type != message.PEERS_LIST || len(receivedMessage.Arguments) == 0 {
+			continue
+		}
+
+		// Itera sobre os peers no argumento da mensagem recebida
+		for _, peer := range receivedMessage.Arguments[1:] {
+			// Salva as partes do peer
+			peerParts, err := message.SplitFields(peer)
+			if err != nil || len(peerParts) < 4 {
+				continue
+			}
+			peerAddress := net.JoinHostPort(peerParts[0], peerParts[1])
+			peerStatus := peers.GetStatus(peerParts[2])
+			peerClock, _ := strconv.Atoi(peerParts[3])
+
+			// O quinto campo (opcional) é o relógio vetorial de quando o status foi visto
+			var peerVector clock.Vector
+			if len(peerParts) > 4 {
+				peerVector, _ = clock.ParseVector(peerParts[4])
+			}
+
+			// Atualiza o status e o clock apenas se for mais recente, ver SafePeers.Merge
+			merged, result := knownPeers.Merge(peers.Peer{Address: peerAddress, Status: peerStatus, Clock: peerClock, Vector: peerVector})
+			switch result {
+			case peers.ADDED:
+				logger.Info("Adicionando novo peer " + peerAddress + " status " + peerParts[2])
+			case peers.NEWER:
+				logger.Info("Atualizando peer " + peerAddress + " status " + peerParts[2])
+			case peers.OUTDATED:
+				logger.Info("Continuando peer " + peerAddress + " status " + merged.Status.String() + " (informação desatualizada recebida)")
+			case peers.CONCURRENT:
+				logger.Info("Atualizando peer " + peerAddress + " status " + merged.Status.String() + " (informação concorrente recebida)")
 			}
 		}
 	}
@@ -253,55 +324,80 @@ func ListLocalFiles(sharedPath string) {
 	}
 }
 
-// Função para mensagem LS, solicita para os vizinhos onlines os seus arquivos
-func LsRequest(knownPeers *peers.SafePeers, senderAddress string, sharedPath string, chunkSize int, statistics *[]Statistic) {
+// Função para mensagem LS, solicita para os vizinhos onlines os seus arquivos e mostra o menu de download
+func LsRequest(knownPeers *peers.SafePeers, localClock *clock.Clock, pool *connection.Pool, jobs *Jobs, senderAddress string, sharedPath string, chunkSize int, statistics *[]Statistic) {
+	fileList, noPeers := SearchFiles(knownPeers, localClock, pool, senderAddress)
+
+	// Chama a função para download apenas se havia arquivos disponíveis na busca
+	if noPeers {
+		logger.Std("Não havia nenhum peer online na busca\n")
+	} else if fileList.Empty() {
+		logger.Std("Não havia nenhum arquivo disponível na busca\n")
+	} else {
+		DlMenu(knownPeers, localClock, pool, jobs, senderAddress, sharedPath, fileList, chunkSize, statistics)
+	}
+}
+
+// Função para a busca do LS, retornando os arquivos encontrados e se nenhum peer online respondeu
+func SearchFiles(knownPeers *peers.SafePeers, localClock *clock.Clock, pool *connection.Pool, senderAddress string) (*FileList, bool) {
 	// Cria a estrutura da mensagem LS
 	sendMessage := message.BaseMessage{Origin: senderAddress, Clock: 0, Type: message.LS, Arguments: nil}
 
 	// Envia mensagem LS para cada peer conhecido online
 	var noPeers bool = true
-	var files *FileList = &FileList{files: []File{}}
+	var fileList *FileList = &FileList{files: []File{}}
 	for _, peer := range knownPeers.GetAll() {
 		if !peer.Status {
 			continue
 		}
-		conn, _ := net.Dial("tcp", peer.Address)
-		connection.SendMessage(knownPeers, conn, sendMessage, peer.Address)
-		if conn != nil {
-			defer conn.Close()
-			conn.SetDeadline(time.Now().Add(2 * time.Second))
-
-			// Recebe a resposta apenas se a conexão for bem-sucedida
-			receivedMessage := connection.ReceiveMessage(knownPeers, conn)
-			logger.Info("Resposta recebida: \"" + receivedMessage.String() + "\"")
-			clock.UpdateMaxClock(receivedMessage.Clock)
-			logger.Info("Atualizando peer " + receivedMessage.Origin + " status " + peers.ONLINE.String())
-			noPeers = false
-
-			// Itera sobre os arquivos no argumento da mensagem recebida
-			for _, file := range receivedMessage.Arguments[1:] {
-				nameSize := strings.Split(file, ":")
-				size, err := strconv.Atoi(nameSize[1])
-				if err != nil {
-					continue
-				}
-				files.AppendFile(nameSize[0], size, receivedMessage.Origin)
-			}
+
+		// Sem o HELLO, o peer não sabe que pode mandar os hashes no LS_LIST
+		if !negotiate(knownPeers, localClock, pool, senderAddress, peer.Address) {
+			continue
 		}
-	}
 
-	// Chama a função para download apenas se havia arquivos disponíveis na busca
-	if noPeers {
-		logger.Std("Não havia nenhum peer online na busca\n")
-	} else if files.Empty() {
-		logger.Std("Não havia nenhum arquivo disponível na busca\n")
-	} else {
-		DlMenu(knownPeers, senderAddress, sharedPath, files, chunkSize, statistics)
+		// Recebe a resposta apenas se a conexão for bem-sucedida
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		receivedMessage, err := pool.Request(ctx, knownPeers, sendMessage, peer.Address)
+		cancel()
+		if err != nil {
+			continue
+		}
+		logger.Info("Resposta recebida: \"" + receivedMessage.String() + "\"")
+		localClock.UpdateMax(receivedMessage.Clock, receivedMessage.Vector)
+		logger.Info("Atualizando peer " + receivedMessage.Origin + " status " + peers.ONLINE.String())
+		noPeers = false
+
+		// Um peer que recusou a requisição continua online, mas sem arquivos nessa busca
+		if receivedMessage.Type == message.ERROR {
+			logger.Info("Busca recusada: " + message.ParseError(receivedMessage).Error())
+			continue
+		} else if receivedMessage.Type != message.LS_LIST || len(receivedMessage.Arguments) == 0 {
+			continue
+		}
+
+		// Itera sobre os arquivos no argumento da mensagem recebida
+		for _, file := range receivedMessage.Arguments[1:] {
+			nameSize, err := message.SplitFields(file)
+			if err != nil || len(nameSize) < 2 {
+				continue
+			}
+			size, err := strconv.Atoi(nameSize[1])
+			if err != nil {
+				continue
+			}
+			hash := ""
+			if len(nameSize) > 2 && files.IsHash(nameSize[2]) {
+				hash = nameSize[2]
+			}
+			fileList.AppendFile(nameSize[0], size, hash, receivedMessage.Origin)
+		}
 	}
+	return fileList, noPeers
 }
 
 // Função para mensagem DL, escolhe um arquivo dentre os buscados para baixar
-func DlMenu(knownPeers *peers.SafePeers, senderAddress string, sharedPath string, fileList *FileList, chunkSize int, statistics *[]Statistic) {
+func DlMenu(knownPeers *peers.SafePeers, localClock *clock.Clock, pool *connection.Pool, jobs *Jobs, senderAddress string, sharedPath string, fileList *FileList, chunkSize int, statistics *[]Statistic) {
 	// Declara variável para o comando e inicia o loop do menu de arquivos
 	var comm string
 	for {
@@ -309,8 +405,8 @@ func DlMenu(knownPeers *peers.SafePeers, senderAddress string, sharedPath string
 		biggestName := len("<Cancelar>")
 		biggestSize := len("Tamanho")
 		for _, file := range fileList.files {
-			if len(file.name) > biggestName {
-				biggestName = len(file.name)
+			if len(file.DisplayName()) > biggestName {
+				biggestName = len(file.DisplayName())
 			}
 			if len(strconv.Itoa(file.size)) > biggestSize {
 				biggestSize = len(strconv.Itoa(file.size))
@@ -326,385 +422,453 @@ func DlMenu(knownPeers *peers.SafePeers, senderAddress string, sharedPath string
 		logger.Std(fmt.Sprintf(header, "Nome", "Tamanho", "Peer"))
 		logger.Std(fmt.Sprintf(row, 0, "<Cancelar>", "", ""))
 		for i, file := range fileList.files {
-			logger.Std(fmt.Sprintf(row, i+1, file.name, strconv.Itoa(file.size), file.OriginsString()))
+			logger.Std(fmt.Sprintf(row, i+1, file.DisplayName(), strconv.Itoa(file.size), file.OriginsString()))
 		}
 
 		// Lê a entrada do usuário
-		logger.Std("\nDigite o numero do arquivo para fazer o download:\n> ")
+		logger.Std("\nDigite os numeros dos arquivos para fazer o download (ex.: 1,3-5):\n> ")
 		fmt.Scanln(&comm)
-		number, err := strconv.Atoi(comm)
+		if comm == "0" {
+			break
+		}
+		selection, err := parseSelection(comm, fileList.Len())
 		if err != nil {
 			logger.Std("\nOpção inválida, tente novamente.\n")
 			continue
 		}
 
-		// Solicitação de download para o arquivo escolhido
-		if number == 0 {
-			break
-		} else if number > 0 && number <= fileList.Len() {
-			DlRequest(knownPeers, fileList.files[number-1], senderAddress, sharedPath, chunkSize, statistics)
-			break
-		} else {
-			logger.Std("\nOpção inválida, tente novamente.\n")
+		// Coloca os arquivos escolhidos na fila de downloads
+		for _, number := range selection {
+			jobs.Enqueue(knownPeers, localClock, pool, fileList.files[number-1], senderAddress, sharedPath, chunkSize, statistics)
 		}
+		break
 	}
 }
 
-// Estrutura para resposta do download
-type DlResponse struct {
-	index  int
-	hash   string
-	origin string
-	err    error
-}
-
-func (dr DlResponse) String() string {
-	errMsg := "nil"
-	if dr.err != nil {
-		errMsg = dr.err.Error()
+// Função para interpretar a escolha de vários itens, separados por vírgula e com intervalos (ex.: "1,3-5")
+// Retorna os números escolhidos em ordem e sem repetição, entre 1 e total
+func parseSelection(input string, total int) ([]int, error) {
+	var selection []int
+	for _, part := range strings.Split(input, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil {
+				return nil, err
+			}
+		}
+		if start < 1 || end > total || start > end {
+			return nil, fmt.Errorf("opção fora da lista: %s", part)
+		}
+		for number := start; number <= end; number++ {
+			if !slices.Contains(selection, number) {
+				selection = append(selection, number)
+			}
+		}
 	}
-	return fmt.Sprintf("index: %d, hash: %s, origin: %s, error: %s", dr.index, dr.hash, dr.origin, errMsg)
-}
-
-type OriginManagerConfig struct {
-	knownPeers     *peers.SafePeers
-	file           *File
-	senderAddress  string
-	chunkSize      int
-	resultCh       chan *DlResponse
-	retryCh        chan *DlResponse
-	rebalanceCh    chan *ManagerError
-	mainWg         *sync.WaitGroup
-	healthyOrigins *HealthyOrigins
+	return selection, nil
 }
 
-type OriginManager struct {
-	origin string
-	wg     *sync.WaitGroup
-	cfg    *OriginManagerConfig
-	ctx    context.Context
-	cancel context.CancelFunc
+// Estrutura para buscar os blocos de um download nas origens, pelo pool de conexões
+type chunkTransport struct {
+	knownPeers    *peers.SafePeers
+	localClock    *clock.Clock
+	pool          *connection.Pool
+	file          *File
+	senderAddress string
+	chunkSize     int
+	job           *Job
 }
 
-type ManagerError struct {
-	lastCreatedIndex int
-	finalIndex       int
-	origin           string
+// Função para buscar um bloco na origem, respeitando o limite de requisições simultâneas para ela
+func (t *chunkTransport) Fetch(ctx context.Context, origin string, index int, units int) ([]byte, error) {
+	if !t.job.budget.acquire(ctx, origin) {
+		return nil, ctx.Err()
+	}
+	defer t.job.budget.release(origin)
+	return requestChunk(ctx, t, index, units, origin)
 }
 
-func requestChunk(ctx context.Context, cancel context.CancelFunc, cfg *OriginManagerConfig, wg *sync.WaitGroup, index int, origin string) {
-	defer wg.Done()
-
-	// Constrói a mensagem a ser enviada.
-	arguments := []string{cfg.file.name, strconv.Itoa(cfg.chunkSize), strconv.Itoa(index)}
+// Pede à origem o bloco de units unidades que começa em index. A origem recebe o bloco como um único
+// chunk de units*chunkSize bytes, no índice index/units, então index precisa ser múltiplo de units.
+// Retorna o conteúdo já conferido.
+func requestChunk(ctx context.Context, cfg *chunkTransport, index int, units int, origin string) ([]byte, error) {
+	// Constrói a mensagem a ser enviada, pedindo o conteúdo cru se a origem anunciou suporte.
+	arguments := []string{message.Escape(cfg.file.NameAt(origin)), strconv.Itoa(units * cfg.chunkSize), strconv.Itoa(index / units)}
+	if neighbor, _ := cfg.knownPeers.Get(origin); neighbor.Capabilities.SupportsEncoding(message.BINARY_ENCODING) {
+		arguments = append(arguments, message.BINARY_ENCODING)
+	}
 	sendMessage := message.BaseMessage{Origin: cfg.senderAddress, Clock: 0, Type: message.DL, Arguments: arguments}
 
 	// Nessa mensagem em específico, enviamos com o contexto. Se ele for cancelado, as mensagens
-	// Param de ser enviadas mais rapidamente.
-	dialer := &net.Dialer{}
-	conn, err := dialer.DialContext(ctx, "tcp", origin)
-	connection.SendMessage(cfg.knownPeers, conn, sendMessage, origin)
+	// Param de ser enviadas mais rapidamente. A conexão com a origem é reaproveitada pelo pool.
+	reqCtx, reqCancel := context.WithTimeout(ctx, CHUNK_TIMEOUT)
+	receivedMessage, err := cfg.pool.Request(reqCtx, cfg.knownPeers, sendMessage, origin)
+	reqCancel()
 	if err != nil {
-		// Se há algum erro, enviamos para o retry e matamos o manager que chamou esse requestChunk.
-		// Isso vale para todos os erros dessa função.
-		defer cancel()
-		cfg.retryCh <- &DlResponse{index: index, err: err, origin: origin}
-		return
-	}
-	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(10 * time.Second))
-
-	receivedMessage := connection.ReceiveMessage(cfg.knownPeers, conn)
-	if receivedMessage.Origin == "" {
-		err := fmt.Errorf("empty response from origin %s for chunk %d", origin, index)
-		cfg.retryCh <- &DlResponse{index: index, err: err, origin: origin}
-		defer cancel()
-		return
+		return nil, fmt.Errorf("no valid response from origin %s for chunk %d: %w", origin, index, err)
 	}
 
 	logger.Info("Resposta recebida: \"" + receivedMessage.String() + "\"")
-	clock.UpdateMaxClock(receivedMessage.Clock)
+	cfg.localClock.UpdateMax(receivedMessage.Clock, receivedMessage.Vector)
 	logger.Info("Atualizando peer " + receivedMessage.Origin + " status " + peers.ONLINE.String())
 
+	// Se a origem recusou a requisição, quem chamou decide o que fazer a partir do código recebido.
+	if receivedMessage.Type == message.ERROR {
+		return nil, message.ParseError(receivedMessage)
+	} else if receivedMessage.Type != message.FILE || len(receivedMessage.Arguments) < 4 {
+		return nil, fmt.Errorf("unexpected response from origin %s for chunk %d", origin, index)
+	}
+
 	receivedIdx, err := strconv.Atoi(receivedMessage.Arguments[2])
+	if err == nil && receivedIdx != index/units {
+		err = fmt.Errorf("origin %s answered chunk %d instead of %d", origin, receivedIdx, index/units)
+	}
 	if err != nil {
-		defer cancel()
-		cfg.retryCh <- &DlResponse{index: index, err: err, origin: origin}
-		return
+		return nil, err
 	}
 
-	// Envia o resultado de sucesso para o canal de resultados.
-	cfg.resultCh <- &DlResponse{index: receivedIdx, hash: receivedMessage.Arguments[3], err: nil, origin: receivedMessage.Origin}
-}
-
-// Função principal do manager. Envia requisições considerando um intervalo de índices.
-func (om *OriginManager) createRequests(initialIndex, finalIndex int) {
-	defer om.cfg.mainWg.Done()
+	// O conteúdo vem cru depois da linha ou em base64 no último argumento, dependendo do que a origem suporta.
+	data := receivedMessage.Payload
+	if !receivedMessage.HasBinaryPayload() {
+		data, err = base64.StdEncoding.DecodeString(receivedMessage.Arguments[3])
+		if err != nil {
+			return nil, fmt.Errorf("erro ao decodificar chunk %d: %v", index, err)
+		}
+	}
 
-	// Semáforo para limitar a quantidade de requisições enviadas.
-	sem := make(chan struct{}, MAX_CONCURRENT_PER_MANAGER)
+	// Confere o tamanho do chunk e, se a origem mandou, o hash dele.
+	expectedSize := min(units*cfg.chunkSize, cfg.file.size-index*cfg.chunkSize)
+	if len(data) != expectedSize {
+		return nil, fmt.Errorf("%w: chunk %d de %s tem %d bytes, esperado %d", download.ErrChunkIntegrity, index, origin, len(data), expectedSize)
+	} else if len(receivedMessage.Arguments) > 4 && files.HashBytes(data) != receivedMessage.Arguments[4] {
+		return nil, fmt.Errorf("%w: hash do chunk %d de %s não confere", download.ErrChunkIntegrity, index, origin)
+	}
+	return data, nil
+}
 
-	var lastCreatedIndex int
-	// O loop está nomeado para caso haja alguma falha seja fácil de sair dele.
-mainloop:
-	for indexNum := initialIndex; indexNum < finalIndex; indexNum++ {
-		// select está checando sempre se houve alguma falha.
-		select {
-		case <-om.ctx.Done():
-			// Caso haja alguma falha, envia o último index enviado e o final para o rebalance.
-			lastCreatedIndex = indexNum
-			om.cfg.rebalanceCh <- &ManagerError{
-				lastCreatedIndex: lastCreatedIndex,
-				finalIndex:       finalIndex,
-				origin:           om.origin,
-			}
-			om.cfg.healthyOrigins.Remove(om.origin) // remove o peer dos peers saudáveis.
-			break mainloop
-		default:
-			sem <- struct{}{} // adiciona +1 no semáforo.
-			om.wg.Add(1)      // adiciona +1 no waitgroup.
-			// Goroutine que envia a requisição de determinado index.
-			go func(index int) {
-				defer func() { <-sem }() // essa função libera o semáforo no fim da execução da request.
-				requestChunk(om.ctx, om.cancel, om.cfg, om.wg, index, om.origin)
-			}(indexNum)
+// Função para verificar se o diário é de um download do mesmo arquivo
+// Sem hash, nome e tamanho não bastam, então as origens e os nomes em cada uma também precisam ser os mesmos
+func sameDownload(journal *files.Journal, file *File) bool {
+	if journal.Size != file.size || journal.Hash != file.hash {
+		return false
+	} else if file.hash != "" {
+		return true
+	}
+	if len(journal.Origins) != len(file.origin) {
+		return false
+	}
+	for _, origin := range file.origin {
+		if name, exists := journal.Origins[origin]; !exists || name != file.NameAt(origin) {
+			return false
 		}
 	}
-	// Espera todas as requisições terminem.
-	om.wg.Wait()
+	return true
 }
 
-// Goroutine responsável para executar retries em peers que ainda estão vivos.
-func retryManager(cfg *OriginManagerConfig, retryWg *sync.WaitGroup) {
-	defer retryWg.Done()
+// Função para abrir o arquivo temporário do download
+// Se houver um download interrompido do mesmo arquivo, continua dele com o tamanho de chunk usado antes
+func openDownload(file *File, finalPath string, chunkSize int, chunkLimit int) (*files.Partial, *files.Journal, error) {
+	journal, err := files.LoadJournal(finalPath)
+	if err == nil && sameDownload(journal, file) && (chunkLimit == 0 || journal.ChunkSize <= chunkLimit) {
+		if partial, err := files.ResumePartial(finalPath, int64(file.size)); err == nil {
+			logger.Info(fmt.Sprintf("Retomando download com %d de %d chunks já recebidos\n", journal.Completed(), journal.Chunks()))
+			return partial, journal, nil
+		}
+	}
 
-	// Conta quantas vezes um peer falhou.
-	retryCounts := make(map[int]int)
+	// Sem diário compatível, o download começa do zero
+	files.RemoveJournal(finalPath)
+	partial, err := files.CreatePartial(finalPath, int64(file.size))
+	if err != nil {
+		return nil, nil, err
+	}
+	origins := make(map[string]string, len(file.origin))
+	for _, origin := range file.origin {
+		origins[origin] = file.NameAt(origin)
+	}
+	return partial, files.NewJournal(file.name, file.size, file.hash, chunkSize, origins), nil
+}
 
-	for failedReq := range cfg.retryCh {
-		chunkIndex := failedReq.index
-		failedOrigin := failedReq.origin
+// Função para gravar o diário do download, só depois de garantir que os chunks marcados estão no disco
+func saveJournal(partial *files.Partial, journal *files.Journal, finalPath string) {
+	err := partial.Sync()
+	if err == nil {
+		err = journal.Save(finalPath)
+	}
+	if err != nil {
+		logger.Error("Não foi possível gravar o diário do download: " + err.Error())
+	}
+}
 
-		// Tenta remover a origem.
-		cfg.healthyOrigins.Remove(failedOrigin)
+// Função para listar os downloads interrompidos e retomar o escolhido
+func ResumeMenu(knownPeers *peers.SafePeers, localClock *clock.Clock, pool *connection.Pool, jobs *Jobs, senderAddress string, sharedPath string, chunkSize int, statistics *[]Statistic) {
+	journals, err := files.ListJournals(sharedPath)
+	if err != nil || len(journals) == 0 {
+		logger.Std("Não há downloads interrompidos\n")
+		return
+	}
 
-		// Se um chunk falha MAX_RETRIES_PER_CHUNK, o download é cancelado.
-		retryCounts[chunkIndex]++
-		if retryCounts[chunkIndex] > MAX_RETRIES_PER_CHUNK {
-			logger.Debug(fmt.Sprintf("Chunk %d failed more than %d times. Aborting download. Last faling origin: %s", chunkIndex, MAX_RETRIES_PER_CHUNK, failedReq.origin))
-			return
+	// Declara variável para o comando e inicia o loop do menu de downloads
+	var comm string
+	for {
+		// Imprime o menu de opções
+		logger.Std("Downloads interrompidos:\n")
+		logger.Std("\t[0] voltar para o menu anterior\n")
+		for i, journal := range journals {
+			logger.Std(fmt.Sprintf("\t[%d] %s (%d de %d chunks)\n", i+1, journal.Name, journal.Completed(), journal.Chunks()))
 		}
 
-		newOrigin, err := cfg.healthyOrigins.GetNext() // Escolhemos uma origem aleatória.
+		// Lê a entrada do usuário
+		logger.Std("> ")
+		fmt.Scanln(&comm)
+		number, err := strconv.Atoi(comm)
 		if err != nil {
-			// Função que adiciona um tempo antes de reenviar a requisição para o retry.
-			go func(resp *DlResponse) {
-				time.Sleep(time.Second)
-				cfg.retryCh <- resp
-			}(failedReq)
+			logger.Std("\nOpção inválida, tente novamente.\n\n")
+			continue
 		}
 
-		// Aumenta em 1 o WaitGroup e envia reenvia a requisição para determinado chunk.
-		retryWg.Add(1)
-		ctx, cancel := context.WithCancel(context.Background())
-		go requestChunk(ctx, cancel, cfg, retryWg, chunkIndex, newOrigin)
+		// Retoma o download escolhido com as origens guardadas no diário
+		if number == 0 {
+			break
+		} else if number > 0 && number <= len(journals) {
+			journal := journals[number-1]
+			file := File{name: journal.Name, size: journal.Size, hash: journal.Hash}
+			for _, origin := range slices.Sorted(maps.Keys(journal.Origins)) {
+				file.AppendOrigin(origin, journal.Origins[origin])
+			}
+			jobs.Enqueue(knownPeers, localClock, pool, file, senderAddress, sharedPath, chunkSize, statistics)
+			break
+		} else {
+			logger.Std("\nOpção inválida, tente novamente.\n\n")
+		}
 	}
 }
 
-// Goroutine responsável pelo rebalanceamento das requisições caso um manager falhe.
-func rebalanceManager(cfg *OriginManagerConfig, rebalanceWg *sync.WaitGroup) {
-	defer rebalanceWg.Done()
+// Função para mensagem DL, solicita o download do arquivo escolhido em chunks.
+// A distribuição dos blocos entre as origens, os retries e a reta final ficam no pacote download.
+// Caso todos os peers morram durante o download, ele termina incompleto.
+// Essa função espera o download terminar. Para baixar em segundo plano, use Jobs.Enqueue.
+func DlRequest(knownPeers *peers.SafePeers, localClock *clock.Clock, pool *connection.Pool, file File, senderAddress string, sharedPath string, chunkSize int, statistics *[]Statistic) error {
+	job := newJob(0, file, newPeerBudget(MAX_REQUESTS_PER_PEER))
+	job.begin()
+	err := runDownload(job, knownPeers, localClock, pool, senderAddress, sharedPath, chunkSize, statistics)
+	job.finish(err)
+	return err
+}
+
+// Função que executa o download controlado por job
+func runDownload(job *Job, knownPeers *peers.SafePeers, localClock *clock.Clock, pool *connection.Pool, senderAddress string, sharedPath string, chunkSize int, statistics *[]Statistic) error {
+	file := job.file
+	job.notify("\nArquivo escolhido " + file.name + "\n")
+	startTime := time.Now()
+	if len(file.origin) == 0 {
+		job.notify("Nenhuma origem disponível para o arquivo.\n")
+		return errors.New("arquivo sem origens: " + file.name)
+	}
 
-	// semáforo para limitar o número de requisições concorrentes enviadas a cada peer.
-	sem := make(chan struct{}, MAX_CONCURRENT_PER_MANAGER)
+	// Negocia as capacidades com as origens que ainda não fizeram HELLO, para reaproveitar conexões e respeitar limites
+	for _, origin := range file.origin {
+		negotiate(knownPeers, localClock, pool, senderAddress, origin)
+	}
 
-	for job := range cfg.rebalanceCh {
-		if job.lastCreatedIndex-job.finalIndex == 0 {
-			continue
+	// Respeita o maior chunk aceito pelas origens que anunciaram um limite no HELLO
+	// No modo adaptativo, as origens sem limite conhecido recebem no máximo MAX_CHUNK_SIZE
+	chunkLimit := 0
+	originLimits := make(map[string]int, len(file.origin))
+	for _, origin := range file.origin {
+		neighbor, _ := knownPeers.Get(origin)
+		limit := neighbor.Capabilities.ChunkLimit()
+		if limit > 0 && (chunkLimit == 0 || limit < chunkLimit) {
+			chunkLimit = limit
 		}
-
-		// Caso haja alguma requisição para rebalancear, captura todos os peers ainda saudáveis
-		healthyPeers, err := cfg.healthyOrigins.GetAll()
-		if err != nil {
-			return
+		if limit == 0 {
+			limit = message.MAX_CHUNK_SIZE
 		}
+		originLimits[origin] = limit
+	}
+	adaptive := chunkSize == ADAPTIVE_CHUNK
+	if adaptive {
+		// O download começa com chunks pequenos, que também são a unidade do diário
+		chunkSize = download.ADAPTIVE_PROBE_SIZE
+		if chunkLimit > 0 {
+			chunkSize = min(chunkSize, chunkLimit)
+		}
+	} else if chunkLimit > 0 && chunkSize > chunkLimit {
+		logger.Info("Reduzindo tamanho de chunk para " + strconv.Itoa(chunkLimit) + " (limite das origens)")
+		chunkSize = chunkLimit
+	}
 
-		peerCount := len(healthyPeers)
-		counter := 0
-		// lógica de redistribuição de carga round robin.
-		for i := job.lastCreatedIndex; i < job.finalIndex; i++ {
-			sem <- struct{}{} // envia uma struct para o semáforo. Se ele estiver cheio, a rotina espera um espaço.
-			originIdx := counter % peerCount
-			newOrigin := healthyPeers[originIdx]
-			rebalanceWg.Add(1) // Avisa para o WaitGroup que está chegando mais uma requisição.
-
-			// Função que vai enviar 1 requisição para alguma origem disponível.
-			go func(idx int, origin string) {
-				chunkReqCtx, chunkReqCancel := context.WithCancel(context.Background())
-
-				// Essa função vai ser executada no final da operação da atual goroutine.
-				// Ela finaliza o contexto corretamente e libera um espaço do semáforo, consumindo-o.
-				defer func() {
-					chunkReqCancel()
-					<-sem
-				}()
+	// Os chunks são escritos direto no disco, num arquivo temporário que só ganha o nome final no fim do download
+	if file.name == "" || filepath.Base(file.name) != file.name {
+		return fmt.Errorf("nome de arquivo inválido: %q", file.name)
+	}
+	finalPath := sharedPath + file.name
+	partial, journal, err := openDownload(&file, finalPath, chunkSize, chunkLimit)
+	if err != nil {
+		job.notify("Não foi possível criar o arquivo do download.\n")
+		return err
+	}
+	chunkSize = journal.ChunkSize
 
-				// requisição sendo enviada.
-				requestChunk(chunkReqCtx, chunkReqCancel, cfg, rebalanceWg, idx, origin)
-			}(i, newOrigin)
+	// Calcula a quantidade de requisições necessárias e marca os chunks que já estão no disco
+	totalRequests := int(math.Ceil(float64(file.size) / float64(chunkSize)))
+	done := make([]bool, totalRequests)
+	for i := range done {
+		done[i] = journal.IsDone(i)
+	}
+
+	// O motor de download distribui os blocos entre as origens, que são buscados pelo pool de conexões
+	engine := download.New(download.Config{
+		Origins:  file.origin,
+		UnitSize: chunkSize,
+		Done:     done,
+		Adaptive: adaptive,
+		Limits:   originLimits,
+		Transport: &chunkTransport{
+			knownPeers:    knownPeers,
+			localClock:    localClock,
+			pool:          pool,
+			file:          &file,
+			senderAddress: senderAddress,
+			chunkSize:     chunkSize,
+			job:           job,
+		},
+		Wait: job.wait,
+	})
+	resultCh := engine.Start(job.ctx)
 
-			counter++
+	// Nesse loop, como iteramos em cima de um go channel, ele espera mensagens chegarem nele até que o canal se feche.
+	// Cada chunk é escrito na sua posição assim que chega, então só os chunks em trânsito ficam na memória.
+	// O diário é gravado de tempos em tempos, para que uma interrupção perca no máximo os últimos chunks.
+	var writeErr error
+	unsaved := false
+	ticker := time.NewTicker(JOURNAL_INTERVAL)
+	defer ticker.Stop()
+	job.progress.begin(journal.Completed(), totalRequests, chunkSize, file.size)
+resultLoop:
+	for {
+		select {
+		case dlResponse, ok := <-resultCh:
+			if !ok {
+				break resultLoop
+			}
+			if writeErr != nil {
+				continue
+			}
+			writeErr = partial.WriteAt(dlResponse.Data, int64(dlResponse.Index)*int64(chunkSize))
+			if writeErr != nil {
+				continue
+			}
+			// Um bloco pode cobrir várias unidades, e só as que ainda não estavam no disco contam no progresso
+			newUnits := 0
+			for unit := dlResponse.Index; unit < dlResponse.Index+dlResponse.Units; unit++ {
+				if !journal.IsDone(unit) {
+					journal.MarkDone(unit)
+					newUnits++
+				}
+			}
+			if newUnits > 0 {
+				job.progress.add(dlResponse.Origin, newUnits, len(dlResponse.Data))
+				unsaved = true
+			}
+		case <-ticker.C:
+			if unsaved {
+				saveJournal(partial, journal, finalPath)
+				unsaved = false
+			}
 		}
 	}
-}
 
-// Função para mensagem DL, solicita o download do arquivo escolhido em chunks.
-// Funcionamento: criamos 3 tipos de goroutines: n managers, 1 RetryManager e 1 RebalanceManager.
-// Caso uma goroutine manager falhe em alguma requisição, envia a falha para RetryManager, depois
-// é morta e envia as requisições que ainda fez para o RebalanceManager. O RebalanceManager divide
-// todas as requisições de quem teve um erro entre as origens que ainda estão ativas.
-// Para o RebalanceManager e o RetryManager, um peer só é dado como morto mesmo depois de um certo
-// número de falhas. Caso todos os peers morram durante o download, ele é cancelado.
-func DlRequest(knownPeers *peers.SafePeers, file File, senderAddress string, sharedPath string, chunkSize int, statistics *[]Statistic) error {
-	logger.Std("\nArquivo escolhido " + file.name + "\n")
-	startTime := time.Now()
+	// Um download cancelado não deixa nada para trás
+	if job.ctx.Err() != nil && job.Status() == CANCELED {
+		partial.Discard()
+		files.RemoveJournal(finalPath)
+		job.notify("\nDownload do arquivo " + file.name + " cancelado.\n")
+		return ErrCanceled
+	}
 
-	// Calcula a quantidade de requisições necessárias e cria o canal de respostas
-	totalRequests := int(math.Ceil(float64(file.size) / float64(chunkSize)))
+	// O tempo do download não conta a conferência do hash nem a gravação
+	finalTime := time.Since(startTime).Seconds()
 
-	// cria os canais de comunicação para o valor resultado retornado, resiliência (retry) e rebalanceamento
-	resultCh := make(chan *DlResponse, totalRequests)
-	retryCh := make(chan *DlResponse, totalRequests)
-	rebalanceCh := make(chan *ManagerError, len(file.origin))
-
-	// grupos de espera para sincronizar chamadas que foram para os canais de resiliência e rebalanceamento
-	var retryWg sync.WaitGroup
-	var rebalanceWg sync.WaitGroup
-
-	// configuração comum para os gerenciadores de origem
-	cfg := OriginManagerConfig{
-		knownPeers:     knownPeers,
-		file:           &file,
-		senderAddress:  senderAddress,
-		chunkSize:      chunkSize,
-		resultCh:       resultCh,
-		retryCh:        retryCh,
-		rebalanceCh:    rebalanceCh,
-		mainWg:         &sync.WaitGroup{},
-		healthyOrigins: NewHealthyOrigins(file.origin),
-	}
-
-	// criamos o array de gerentes e populamos
-	managers := make([]OriginManager, 0, len(file.origin))
-	for _, origin := range file.origin {
-		ctx, cancel := context.WithCancel(context.Background())
-		manager := OriginManager{
-			origin: origin,
-			wg:     &sync.WaitGroup{},
-			cfg:    &cfg,
-			ctx:    ctx,
-			cancel: cancel,
-		}
-		managers = append(managers, manager)
-	}
-
-	nManagers := len(managers)
-	cfg.mainWg.Add(nManagers)
-
-	// A partir daqui ocorre a lógica de distribuição inicial das requisições entre os peers.
-	base := totalRequests / nManagers
-	remainder := totalRequests % nManagers
-	start := 0
-	for i := range managers {
-		count := base
-		if i < remainder {
-			count++
-		}
-		end := start + count
-		if start <= end {
-			go managers[i].createRequests(start, end)
-		}
-		start = end
-	}
-
-	// Iniciando goroutines responsáveis para resiliência
-	retryWg.Add(1)
-	go retryManager(&cfg, &retryWg)
-	rebalanceWg.Add(1)
-	go rebalanceManager(&cfg, &rebalanceWg)
-
-	// Rotina para fechar os canais de comunicação na ordem correta.
-	// Primeiro, esperamos os Managers terminarem.
-	// Depois, fechamos o canal de rebalanceamento e esperamos todas as operações do rebalanceManager terminarem.
-	// Por fim, fechamos o canal de retry e esperamos todas as chamadas de retry restantes terminarem e fechamos o canal de resultados.
-	go func() {
-		cfg.mainWg.Wait()
-		close(rebalanceCh)
-		rebalanceWg.Wait()
-		close(cfg.retryCh) // aqui pode ter um bug. O RetryManager em alguns momentos coloca na própria fila, então tem chance de colocar nela já fechada
-		retryWg.Wait()
-		close(resultCh)
-	}()
-
-	// Array para guardar os hashs recebidos.
-	receivedHashes := make([]string, totalRequests)
+	// Verifica se todos os chunks foram escritos e tratamos erros
+	if writeErr != nil {
+		partial.Discard()
+		files.RemoveJournal(finalPath)
+		job.notify("Não foi possível fazer o download.")
+		return fmt.Errorf("erro ao escrever o arquivo: %w", writeErr)
+	}
+	if completed := journal.Completed(); completed < totalRequests {
+		// Guarda o que já chegou para continuar depois, pela busca ou pelo menu de downloads interrompidos
+		saveJournal(partial, journal, finalPath)
+		partial.Close()
+		job.notify(fmt.Sprintf("Download interrompido com %d de %d chunks. Ele pode ser retomado depois.\n", completed, totalRequests))
+		return fmt.Errorf("%w: %d de %d chunks recebidos", ErrIncomplete, completed, totalRequests)
+	}
 
-	// Nesse loop, como iteramos em cima de um go channel, ele espera mensagens chegarem nele até que o canal se feche.
-	for dlResponse := range resultCh {
-		receivedHashes[dlResponse.index] = dlResponse.hash
+	// Confere o arquivo montado com o hash anunciado pelas origens antes de gravá-lo
+	if file.hash != "" {
+		hash, err := partial.Hash()
+		if err != nil || hash != file.hash {
+			partial.Discard()
+			files.RemoveJournal(finalPath)
+			job.notify("Não foi possível fazer o download: o conteúdo recebido não confere com o arquivo anunciado.\n")
+			return fmt.Errorf("%w: %s", ErrFileIntegrity, file.name)
+		}
 	}
 
-	// Salva a nova estatística do download
-	finalTime := time.Since(startTime).Seconds()
+	// Move o arquivo temporário para o nome final, substituindo um arquivo anterior com o mesmo nome
+	if err := partial.Commit(); err != nil {
+		return err
+	}
+
+	// Salva a nova estatística do download, só para downloads gravados por inteiro
+	// No modo adaptativo, a estatística guarda o tamanho médio dos chunks que foram de fato pedidos
+	statChunkSize := chunkSize
+	if adaptive {
+		statChunkSize = ADAPTIVE_CHUNK
+		logger.Info("Tamanhos de chunk escolhidos: " + engine.ChunkSizes())
+	}
+	statisticsMu.Lock()
 	found := false
 	for i, stat := range *statistics {
-		if stat.chunckSize == chunkSize && stat.peersQty == len(file.origin) && stat.fileSize == file.size {
+		if stat.chunckSize == statChunkSize && stat.peersQty == len(file.origin) && stat.fileSize == file.size {
 			(*statistics)[i].times = append((*statistics)[i].times, finalTime)
+			if adaptive {
+				(*statistics)[i].chosenSizes = append((*statistics)[i].chosenSizes, engine.AverageChunkSize())
+			}
 			found = true
 			break
 		}
 	}
 	if !found {
-		*statistics = append(*statistics, Statistic{
-			chunckSize: chunkSize,
+		stat := Statistic{
+			chunckSize: statChunkSize,
 			peersQty:   len(file.origin),
 			fileSize:   file.size,
 			times:      []float64{finalTime},
-		})
-	}
-
-	// Loop em que decodificamos os hashs recebidos e tratamos erros
-	var decodedChunks []byte
-	for i, r := range receivedHashes {
-		if r == "" {
-			logger.Std("Não foi possível fazer o download.")
-			return fmt.Errorf("chunk %d está vazio. próximo chunk: %s. Total chunks: %d", i, receivedHashes[i+1], totalRequests)
 		}
-		dec, err := base64.StdEncoding.DecodeString(r)
-		if err != nil {
-			logger.Std("Não foi possível fazer o download.")
-			return fmt.Errorf("erro ao decodificar chunk %d: %v", i, err)
+		if adaptive {
+			stat.chosenSizes = []int{engine.AverageChunkSize()}
 		}
-		decodedChunks = append(decodedChunks, dec...)
+		*statistics = append(*statistics, stat)
 	}
+	statisticsMu.Unlock()
 
-	// Cria/substitui o arquivo e escreve o conteúdo decodificado
-	createdFile, err := os.Create(sharedPath + file.name)
-	if err != nil {
-		return err
-	}
-	defer createdFile.Close()
-	_, err = createdFile.Write(decodedChunks)
-	if err != nil {
-		return err
-	}
-	logger.Std("\nDownload do arquivo " + file.name + " finalizado.\n")
-	//logger.Std("\nErros de peer: " + cfg.healthyOrigins.ErrorSummary())
+	files.RemoveJournal(finalPath)
+	job.notify("\nDownload do arquivo " + file.name + " finalizado.\n")
 	return nil
 }
 
 // Função para mostrar as estatísticas do download
 func ShowStatistics(statistics *[]Statistic) {
+	statisticsMu.Lock()
+	defer statisticsMu.Unlock()
+
 	// Encontra os maiores tamanhos de cada coluna
 	biggestChunkSize := len("Tam. chunk")
 	biggestPeersQty := len("N peers")
@@ -712,8 +876,8 @@ func ShowStatistics(statistics *[]Statistic) {
 	biggestAttemps := len("N")
 	biggestMeanTime := len("Tempo [s]")
 	for _, stat := range *statistics {
-		if len(strconv.Itoa(stat.chunckSize)) > biggestChunkSize {
-			biggestChunkSize = len(strconv.Itoa(stat.chunckSize))
+		if len(stat.chunkSizeString()) > biggestChunkSize {
+			biggestChunkSize = len(stat.chunkSizeString())
 		}
 		if len(strconv.Itoa(stat.peersQty)) > biggestPeersQty {
 			biggestPeersQty = len(strconv.Itoa(stat.peersQty))
@@ -742,28 +906,33 @@ func ShowStatistics(statistics *[]Statistic) {
 			stdDeviation += (t - meanTime) * (t - meanTime)
 		}
 		stdDeviation = math.Sqrt(stdDeviation / float64(len(stat.times)))
-		logger.Std(fmt.Sprintf(row, strconv.Itoa(stat.chunckSize), strconv.Itoa(stat.peersQty), strconv.Itoa(stat.fileSize), strconv.Itoa(len(stat.times)), fmt.Sprintf("%.5f", meanTime), fmt.Sprintf("%.5f", stdDeviation)))
+		logger.Std(fmt.Sprintf(row, stat.chunkSizeString(), strconv.Itoa(stat.peersQty), strconv.Itoa(stat.fileSize), strconv.Itoa(len(stat.times)), fmt.Sprintf("%.5f", meanTime), fmt.Sprintf("%.5f", stdDeviation)))
 	}
 }
 
 // Função para alterar o tamanho do chunk
+// O valor 0 (ADAPTIVE_CHUNK) faz cada download escolher o tamanho do chunk de cada origem
 func ChangeChunk(chunkSize *int) {
 	var chunk string
-	logger.Std("Digite novo tamanho de chunk:\n> ")
+	logger.Std("Digite novo tamanho de chunk (0 para ajustar automaticamente):\n> ")
 	for {
 		fmt.Scanln(&chunk)
 		number, err := strconv.Atoi(chunk)
-		if err == nil && number > 0 {
+		if err == nil && number == ADAPTIVE_CHUNK {
+			*chunkSize = number
+			logger.Info("Tamanho de chunk alterado: automático")
+			return
+		} else if err == nil && number > 0 {
 			*chunkSize = number
 			logger.Info("Tamanho de chunk alterado: " + strconv.Itoa(number))
 			return
 		}
-		logger.Std("\nValor inválido. Precisa ser um inteiro maior que 0.\n> ")
+		logger.Std("\nValor inválido. Precisa ser um inteiro maior ou igual a 0.\n> ")
 	}
 }
 
 // Função para mensagem BYE, avisando os peers sobre a saída
-func ByeRequest(knownPeers *peers.SafePeers, senderAddress string) {
+func ByeRequest(knownPeers *peers.SafePeers, pool *connection.Pool, senderAddress string) {
 	// Imprime mensagem de saída e cria a mensagem BYE
 	logger.Std("Saindo...\n")
 	sendMessage := message.BaseMessage{Origin: senderAddress, Clock: 0, Type: message.BYE, Arguments: nil}
@@ -773,11 +942,9 @@ func ByeRequest(knownPeers *peers.SafePeers, senderAddress string) {
 		if !peer.Status {
 			continue
 		}
-		conn, _ := net.Dial("tcp", peer.Address)
-		connection.SendMessage(knownPeers, conn, sendMessage, peer.Address)
-		if conn != nil {
-			defer conn.Close()
-			conn.SetDeadline(time.Now().Add(2 * time.Second))
-		}
+		ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+		pool.Send(ctx, knownPeers, sendMessage, peer.Address)
+		cancel()
 	}
+	pool.Close()
 }
@@ -2,22 +2,37 @@ package commands
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"net"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"eachare/src/clock"
+	"eachare/src/connection"
+	"eachare/src/download"
+	"eachare/src/files"
 	"eachare/src/logger"
+	"eachare/src/message"
 	"eachare/src/peers"
+	"eachare/src/response"
 )
 
 var senderAddress = "localhost"
 
+// Rede em memória compartilhada pelos testes, para nenhum teste abrir portas de verdade
+var network = connection.NewMemoryNetwork()
+
 func TestGetPeersRequest(t *testing.T) {
 	var initialPeers peers.SafePeers
 	initialPeers.Add(peers.Peer{Address: "127.0.0.1:9001", Status: peers.ONLINE, Clock: 0})
 	initialPeers.Add(peers.Peer{Address: "127.0.0.2:9002", Status: peers.OFFLINE, Clock: 0})
 
-	GetPeersRequest(&initialPeers, senderAddress)
+	GetPeersRequest(&initialPeers, clock.New(), connection.NewPool(network, clock.New()), senderAddress)
 
 	for _, peer := range initialPeers.GetAll() {
 		if peer.Status {
@@ -26,21 +41,151 @@ func TestGetPeersRequest(t *testing.T) {
 	}
 }
 
+func TestGetPeersRequestVectorClock(t *testing.T) {
+	listener, err := network.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	address := listener.Addr().String()
+
+	// O vizinho responde com o que sabe de cada peer e do vetor de quando viu cada status
+	entries := []string{
+		message.JoinFields("10.0.0.1", "1", "ONLINE", "2", "10.0.0.1:1=3,"+address+"=1"),
+		message.JoinFields("10.0.0.2", "2", "ONLINE", "2", "10.0.0.2:2=1,"+address+"=5"),
+		message.JoinFields("10.0.0.3", "3", "ONLINE", "2", "10.0.0.3:3=2,"+address+"=2"),
+		message.JoinFields("10.0.0.4", "4", "ONLINE", "2", "10.0.0.4:4=1,"+address+"=2"),
+		message.JoinFields("10.0.0.5", "5", "ONLINE", "100", "10.0.0.5:5=2"),
+		message.JoinFields("10.0.0.6", "6", "ONLINE", "1", "10.0.0.6:6=1"),
+	}
+	var serverPeers peers.SafePeers
+	serverClock := clock.New()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				connection.Serve(&serverPeers, conn, func(receivedMessage message.BaseMessage, conn net.Conn) {
+					if receivedMessage.Type == message.HELLO {
+						response.HelloResponse(&serverPeers, serverClock, receivedMessage, address, conn)
+						return
+					}
+					reply := message.BaseMessage{Origin: address, Type: message.PEERS_LIST, Arguments: append([]string{strconv.Itoa(len(entries))}, entries...)}
+					connection.SendMessage(&serverPeers, serverClock, conn, reply, receivedMessage.Origin)
+				})
+			}()
+		}
+	}()
+
+	// Os peers conhecidos ficam OFFLINE, senão a própria tentativa de enviar o GET_PEERS para eles mudaria o status
+	// Com as capacidades já conhecidas, só o vizinho recebe o HELLO que negocia o relógio vetorial
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: address, Status: peers.ONLINE})
+	knownPeers.Add(peers.Peer{Address: "10.0.0.1:1", Status: peers.OFFLINE, Clock: 1, Vector: clock.Vector{"10.0.0.1:1": 2}})
+	knownPeers.Add(peers.Peer{Address: "10.0.0.2:2", Status: peers.OFFLINE, Clock: 1, Vector: clock.Vector{"10.0.0.2:2": 3}})
+	knownPeers.Add(peers.Peer{Address: "10.0.0.3:3", Status: peers.OFFLINE, Clock: 1, Vector: clock.Vector{"10.0.0.3:3": 1, "localhost": 4}})
+	knownPeers.Add(peers.Peer{Address: "10.0.0.4:4", Status: peers.OFFLINE, Clock: 1, Vector: clock.Vector{"10.0.0.4:4": 1, "localhost": 4}})
+	knownPeers.Add(peers.Peer{Address: "10.0.0.5:5", Status: peers.OFFLINE, Clock: 1, Vector: clock.Vector{"10.0.0.5:5": 5}})
+	for _, peer := range knownPeers.GetAll() {
+		if peer.Address != address {
+			knownPeers.SetCapabilities(peer.Address, message.Capabilities{Version: message.LEGACY_VERSION})
+		}
+	}
+	GetPeersRequest(&knownPeers, clock.NewWithMode(clock.VECTOR, senderAddress), connection.NewPool(network, clock.New()), senderAddress)
+	if neighbor, _ := knownPeers.Get(address); !neighbor.Capabilities.HasFeature(message.VECTOR_FEATURE) {
+		t.Errorf("Expected GET_PEERS to negotiate the capabilities of %s, got %+v", address, neighbor.Capabilities)
+	}
+
+	expected := map[string]peers.PeerStatus{
+		"10.0.0.1:1": peers.ONLINE,  // Aconteceu depois do que era conhecido
+		"10.0.0.2:2": peers.OFFLINE, // Concorrente, mas o conhecido viu mais eventos do próprio peer
+		"10.0.0.3:3": peers.ONLINE,  // Concorrente, e o recebido viu mais eventos do próprio peer
+		"10.0.0.4:4": peers.OFFLINE, // Concorrente e empatado no próprio peer, OFFLINE vence
+		"10.0.0.5:5": peers.OFFLINE, // Aconteceu antes, mesmo com o relógio escalar maior
+		"10.0.0.6:6": peers.ONLINE,  // Peer novo
+	}
+	for peerAddress, status := range expected {
+		if neighbor, _ := knownPeers.Get(peerAddress); neighbor.Status != status {
+			t.Errorf("Expected %s to be %s, got %s", peerAddress, status, neighbor.Status)
+		}
+	}
+
+	// O vetor guardado junta as duas informações, para comparar com as próximas
+	if neighbor, _ := knownPeers.Get("10.0.0.2:2"); neighbor.Vector.Compare(clock.Vector{"10.0.0.2:2": 3, address: 5}) != clock.EQUAL {
+		t.Errorf("Expected merged vector, got %v", neighbor.Vector)
+	}
+}
+
+func TestHelloRequest(t *testing.T) {
+	// Um peer no formato original fecha a conexão sem responder, e o outro lê o HELLO mas nunca responde
+	listen := func(handle func(conn net.Conn)) string {
+		listener, err := network.Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go handle(conn)
+			}
+		}()
+		return listener.Addr().String()
+	}
+	legacy := listen(func(conn net.Conn) {
+		connection.ReceiveMessage(&peers.SafePeers{}, conn)
+		conn.Close()
+	})
+	slow := listen(func(conn net.Conn) {
+		connection.ReceiveMessage(&peers.SafePeers{}, conn)
+		time.Sleep(REQUEST_TIMEOUT + time.Second)
+		conn.Close()
+	})
+
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: legacy, Status: peers.ONLINE})
+	knownPeers.Add(peers.Peer{Address: slow, Status: peers.ONLINE})
+	pool := connection.NewPool(network, clock.New())
+	defer pool.Close()
+
+	HelloRequest(&knownPeers, clock.New(), pool, senderAddress, legacy)
+	if neighbor, _ := knownPeers.Get(legacy); neighbor.Capabilities.Version != message.LEGACY_VERSION {
+		t.Errorf("Expected a closed connection to mark the legacy version, got %+v", neighbor.Capabilities)
+	}
+
+	// Um peer que só demorou não perde as extensões
+	HelloRequest(&knownPeers, clock.New(), pool, senderAddress, slow)
+	if neighbor, _ := knownPeers.Get(slow); neighbor.Capabilities.Known() {
+		t.Errorf("Expected a timeout to keep the capabilities unknown, got %+v", neighbor.Capabilities)
+	}
+}
+
 func TestByeRequest(t *testing.T) {
 	var initialPeers peers.SafePeers
 	initialPeers.Add(peers.Peer{Address: "127.0.0.1:9001", Status: peers.ONLINE, Clock: 0})
 	initialPeers.Add(peers.Peer{Address: "127.0.0.2:9002", Status: peers.OFFLINE, Clock: 0})
 
+	// Descarta os logs pendentes dos testes anteriores antes de capturar a saída
 	var buffer bytes.Buffer
+	logger.Flush()
 	logger.SetOutput(&buffer)
 
-	ByeRequest(&initialPeers, senderAddress)
+	ByeRequest(&initialPeers, connection.NewPool(network, clock.New()), senderAddress)
+	logger.Flush()
+	logger.SetOutput(nil)
 
+	// Cada peer tem o próprio relógio, então o BYE sai com 1 mesmo depois de outros testes
 	out := buffer.String()
-	expected := `Saindo...
-    => Atualizando relogio para 1
-    Encaminhando mensagem "localhost 1 BYE" para 127.0.0.1:9001
-    Atualizando peer 127.0.0.1:9001 status OFFLINE`
+	expected := "Saindo...\n" +
+		"\t=> Atualizando relogio para 1\n" +
+		"\tEncaminhando mensagem \"localhost 1 BYE\" para 127.0.0.1:9001\n" +
+		"\tAtualizando peer 127.0.0.1:9001 status OFFLINE"
 
 	if strings.TrimSpace(expected) != strings.TrimSpace(out) {
 		t.Errorf("\nExpected %d:\n%s\nGot %d:\n%s", len(expected), expected, len(out), out)
@@ -84,3 +229,451 @@ func TestGetSharedDirectory(t *testing.T) {
 
 	}
 }
+
+// Função para subir um peer local que responde HELLO e DL a partir de sharedPath
+func startFileServer(t *testing.T, sharedPath string) string {
+	return startDelayedFileServer(t, sharedPath, 0)
+}
+
+// Servidor de arquivos que demora delay para responder cada DL
+func startDelayedFileServer(t *testing.T, sharedPath string, delay time.Duration) string {
+	listener, err := network.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	address := listener.Addr().String()
+	var serverPeers peers.SafePeers
+	serverClock := clock.New()
+	handler := func(receivedMessage message.BaseMessage, conn net.Conn) {
+		switch receivedMessage.Type {
+		case message.HELLO:
+			response.HelloResponse(&serverPeers, serverClock, receivedMessage, address, conn)
+		case message.DL:
+			time.Sleep(delay)
+			response.DlResponse(&serverPeers, serverClock, receivedMessage, address, sharedPath, conn)
+		}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				connection.Serve(&serverPeers, conn, handler)
+			}()
+		}
+	}()
+	return address
+}
+
+func TestDlRequestIntegrity(t *testing.T) {
+	serverPath := t.TempDir() + "/"
+	content := []byte("some content split in several chunks")
+	os.WriteFile(serverPath+"file.txt", content, 0644)
+	address := startFileServer(t, serverPath)
+
+	tests := []struct {
+		hash     string
+		expected error
+	}{
+		{files.HashBytes(content), nil},
+		{"", nil},
+		{files.HashBytes([]byte("another file with the same name")), ErrFileIntegrity},
+	}
+
+	for _, test := range tests {
+		var knownPeers peers.SafePeers
+		knownPeers.Add(peers.Peer{Address: address, Status: peers.ONLINE, Clock: 0})
+		pool := connection.NewPool(network, clock.New())
+		clientPath := t.TempDir() + "/"
+		file := File{name: "file.txt", size: len(content), hash: test.hash, origin: []string{address}}
+
+		err := DlRequest(&knownPeers, clock.New(), pool, file, senderAddress, clientPath, 8, &[]Statistic{})
+		pool.Close()
+		if !errors.Is(err, test.expected) {
+			t.Errorf("hash %q: expected error %v, got %v", test.hash, test.expected, err)
+			continue
+		}
+
+		written, readErr := os.ReadFile(clientPath + "file.txt")
+		if test.expected == nil && string(written) != string(content) {
+			t.Errorf("hash %q: expected %q written, got %q (%v)", test.hash, content, written, readErr)
+		} else if test.expected != nil && readErr == nil {
+			t.Errorf("hash %q: file with wrong hash should not be written", test.hash)
+		}
+		if _, err := os.Stat(clientPath + "file.txt" + files.PARTIAL_SUFFIX); err == nil {
+			t.Errorf("hash %q: temporary file left behind", test.hash)
+		}
+	}
+}
+
+func TestFileListAppendFile(t *testing.T) {
+	hashA := files.HashBytes([]byte("a"))
+	hashB := files.HashBytes([]byte("b"))
+
+	var fileList FileList
+	fileList.AppendFile("report.pdf", 10, hashA, "peer:1")
+	fileList.AppendFile("copy of report.pdf", 10, hashA, "peer:2")
+	fileList.AppendFile("report.pdf", 10, hashB, "peer:3")
+	fileList.AppendFile("report.pdf", 10, "", "peer:4")
+	fileList.AppendFile("report.pdf", 10, "", "peer:5")
+
+	if fileList.Len() != 3 {
+		t.Fatalf("Expected 3 files, got %d: %+v", fileList.Len(), fileList.files)
+	}
+	merged := fileList.files[0]
+	if merged.OriginsString() != "peer:1, peer:2" || merged.NameAt("peer:2") != "copy of report.pdf" || merged.NameAt("peer:1") != "report.pdf" {
+		t.Errorf("Expected same content to be merged across names, got %+v", merged)
+	}
+	if merged.DisplayName() != "report.pdf (copy of report.pdf)" {
+		t.Errorf("Unexpected display name %q", merged.DisplayName())
+	}
+	if fileList.files[2].OriginsString() != "peer:4, peer:5" {
+		t.Errorf("Expected files without hash to be merged by name and size, got %+v", fileList.files[2])
+	}
+}
+
+func TestDlRequestAlternateNames(t *testing.T) {
+	content := []byte("same bytes stored under two different names")
+	firstPath, secondPath := t.TempDir()+"/", t.TempDir()+"/"
+	os.WriteFile(firstPath+"original.txt", content, 0644)
+	os.WriteFile(secondPath+"renamed.txt", content, 0644)
+	first, second := startFileServer(t, firstPath), startFileServer(t, secondPath)
+
+	var fileList FileList
+	fileList.AppendFile("original.txt", len(content), files.HashBytes(content), first)
+	fileList.AppendFile("renamed.txt", len(content), files.HashBytes(content), second)
+	if fileList.Len() != 1 {
+		t.Fatalf("Expected one file, got %+v", fileList.files)
+	}
+
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: first, Status: peers.ONLINE, Clock: 0})
+	knownPeers.Add(peers.Peer{Address: second, Status: peers.ONLINE, Clock: 0})
+	pool := connection.NewPool(network, clock.New())
+	defer pool.Close()
+	clientPath := t.TempDir() + "/"
+
+	if err := DlRequest(&knownPeers, clock.New(), pool, fileList.files[0], senderAddress, clientPath, 4, &[]Statistic{}); err != nil {
+		t.Fatalf("DlRequest returned error: %v", err)
+	}
+	written, _ := os.ReadFile(clientPath + "original.txt")
+	if string(written) != string(content) {
+		t.Errorf("Expected %q, got %q", content, written)
+	}
+}
+
+func TestDlRequestResume(t *testing.T) {
+	serverPath := t.TempDir() + "/"
+	os.WriteFile(serverPath+"file.txt", []byte("0123456789abcdef"), 0644)
+	address := startFileServer(t, serverPath)
+
+	// Chunks marcados no diário não são pedidos de novo, então o conteúdo local deles é mantido
+	clientPath := t.TempDir() + "/"
+	partial, _ := files.CreatePartial(clientPath+"file.txt", 16)
+	partial.WriteAt([]byte("WXYZ"), 4)
+	partial.Close()
+	journal := files.NewJournal("file.txt", 16, "", 4, map[string]string{address: "file.txt"})
+	journal.MarkDone(1)
+	journal.Save(clientPath + "file.txt")
+
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: address, Status: peers.ONLINE, Clock: 0})
+	pool := connection.NewPool(network, clock.New())
+	defer pool.Close()
+	file := File{name: "file.txt", size: 16, origin: []string{address}}
+
+	if err := DlRequest(&knownPeers, clock.New(), pool, file, senderAddress, clientPath, 8, &[]Statistic{}); err != nil {
+		t.Fatalf("DlRequest returned error: %v", err)
+	}
+	if written, _ := os.ReadFile(clientPath + "file.txt"); string(written) != "0123WXYZ89abcdef" {
+		t.Errorf("Expected resumed download to keep chunk 1, got %q", written)
+	}
+	if _, err := files.LoadJournal(clientPath + "file.txt"); err == nil {
+		t.Errorf("Journal left behind after a finished download")
+	}
+
+	// Sem hash, um diário de outras origens pode ser de outro arquivo com o mesmo nome e tamanho, e é descartado
+	os.Remove(clientPath + "file.txt")
+	partial, _ = files.CreatePartial(clientPath+"file.txt", 16)
+	partial.WriteAt([]byte("WXYZ"), 4)
+	partial.Close()
+	journal = files.NewJournal("file.txt", 16, "", 4, map[string]string{"127.0.0.1:1": "file.txt"})
+	journal.MarkDone(1)
+	journal.Save(clientPath + "file.txt")
+	if err := DlRequest(&knownPeers, clock.New(), pool, file, senderAddress, clientPath, 8, &[]Statistic{}); err != nil {
+		t.Fatalf("DlRequest returned error: %v", err)
+	}
+	if written, _ := os.ReadFile(clientPath + "file.txt"); string(written) != "0123456789abcdef" {
+		t.Errorf("Expected a stale journal to be ignored, got %q", written)
+	}
+}
+
+func TestDlRequestIncomplete(t *testing.T) {
+	// A origem só tem a primeira metade do arquivo anunciado
+	serverPath := t.TempDir() + "/"
+	os.WriteFile(serverPath+"file.txt", []byte("01234567"), 0644)
+	address := startFileServer(t, serverPath)
+
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: address, Status: peers.ONLINE, Clock: 0})
+	pool := connection.NewPool(network, clock.New())
+	defer pool.Close()
+	clientPath := t.TempDir() + "/"
+	file := File{name: "file.txt", size: 16, origin: []string{address}}
+
+	var statistics []Statistic
+	err := DlRequest(&knownPeers, clock.New(), pool, file, senderAddress, clientPath, 4, &statistics)
+	if !errors.Is(err, ErrIncomplete) {
+		t.Fatalf("Expected ErrIncomplete, got %v", err)
+	}
+	if len(statistics) != 0 {
+		t.Errorf("Expected no statistic for an interrupted download, got %+v", statistics)
+	}
+	journal, err := files.LoadJournal(clientPath + "file.txt")
+	if err != nil || journal.IsDone(2) || journal.IsDone(3) {
+		t.Fatalf("Expected journal without chunks 2 and 3, got %+v (%v)", journal, err)
+	}
+
+	// Com o arquivo completo na origem, o mesmo download termina a partir do diário
+	os.WriteFile(serverPath+"file.txt", []byte("0123456789abcdef"), 0644)
+	if err := DlRequest(&knownPeers, clock.New(), pool, file, senderAddress, clientPath, 4, &statistics); err != nil {
+		t.Fatalf("Resumed DlRequest returned error: %v", err)
+	}
+	if len(statistics) != 1 || len(statistics[0].times) != 1 {
+		t.Errorf("Expected a single statistic for the resumed download, got %+v", statistics)
+	}
+	if written, _ := os.ReadFile(clientPath + "file.txt"); string(written) != "0123456789abcdef" {
+		t.Errorf("Expected complete file after resuming, got %q", written)
+	}
+}
+
+func TestJobsPauseResumeCancel(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 2048)
+	serverPath := t.TempDir() + "/"
+	os.WriteFile(serverPath+"big.txt", content, 0644)
+	address := startFileServer(t, serverPath)
+
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: address, Status: peers.ONLINE, Clock: 0})
+	pool := connection.NewPool(network, clock.New())
+	defer pool.Close()
+	jobs := NewJobs(MAX_ACTIVE_DOWNLOADS)
+	clientPath := t.TempDir() + "/"
+	file := File{name: "big.txt", size: len(content), hash: files.HashBytes(content), origin: []string{address}}
+
+	// Pausado, nenhum chunk novo é pedido até o download continuar
+	job := jobs.Enqueue(&knownPeers, clock.New(), pool, file, senderAddress, clientPath, 16, &[]Statistic{})
+	if !job.Pause() || job.Status() != PAUSED {
+		t.Fatalf("Expected job to be paused, got %s", job.Status())
+	}
+	time.Sleep(200 * time.Millisecond)
+	before := job.Progress().Done
+	time.Sleep(200 * time.Millisecond)
+	if after := job.Progress().Done; after != before {
+		t.Errorf("Chunks kept arriving while paused: %d -> %d", before, after)
+	}
+	if !job.Resume() {
+		t.Fatalf("Expected job to resume, got %s", job.Status())
+	}
+	<-job.Done()
+	if job.Status() != FINISHED {
+		t.Fatalf("Expected finished job, got %s", job.String())
+	}
+	if written, _ := os.ReadFile(clientPath + "big.txt"); !bytes.Equal(written, content) {
+		t.Errorf("Downloaded content does not match")
+	}
+
+	// Cancelado, o arquivo temporário e o diário são apagados
+	os.Remove(clientPath + "big.txt")
+	job = jobs.Enqueue(&knownPeers, clock.New(), pool, file, senderAddress, clientPath, 16, &[]Statistic{})
+	job.Pause()
+	if !job.Cancel() {
+		t.Fatalf("Expected job to be canceled, got %s", job.Status())
+	}
+	<-job.Done()
+	if job.Status() != CANCELED || job.Resume() {
+		t.Errorf("Expected canceled job, got %s", job.String())
+	}
+	for _, suffix := range []string{"", files.PARTIAL_SUFFIX, files.JOURNAL_SUFFIX} {
+		if _, err := os.Stat(clientPath + "big.txt" + suffix); err == nil {
+			t.Errorf("File %q left behind after cancel", "big.txt"+suffix)
+		}
+	}
+}
+
+func TestParseSelection(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []int
+	}{
+		{"2", []int{2}},
+		{"1,3-5", []int{1, 3, 4, 5}},
+		{"4,2,4", []int{4, 2}},
+		{"0", nil},
+		{"6", nil},
+		{"3-1", nil},
+		{"a", nil},
+		{"1,", nil},
+	}
+	for _, test := range tests {
+		selection, err := parseSelection(test.input, 5)
+		if test.expected == nil && err == nil {
+			t.Errorf("parseSelection(%q) = %v; expected an error", test.input, selection)
+		} else if test.expected != nil && (err != nil || !slices.Equal(selection, test.expected)) {
+			t.Errorf("parseSelection(%q) = %v, %v; expected %v", test.input, selection, err, test.expected)
+		}
+	}
+}
+
+func TestJobsQueue(t *testing.T) {
+	serverPath := t.TempDir() + "/"
+	contents := map[string][]byte{}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		contents[name] = bytes.Repeat([]byte(name), 1000)
+		os.WriteFile(serverPath+name, contents[name], 0644)
+	}
+	address := startFileServer(t, serverPath)
+
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: address, Status: peers.ONLINE, Clock: 0})
+	pool := connection.NewPool(network, clock.New())
+	defer pool.Close()
+	jobs := NewJobs(1)
+	clientPath := t.TempDir() + "/"
+
+	var queued []*Job
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		file := File{name: name, size: len(contents[name]), hash: files.HashBytes(contents[name]), origin: []string{address}}
+		queued = append(queued, jobs.Enqueue(&knownPeers, clock.New(), pool, file, senderAddress, clientPath, 64, &[]Statistic{}))
+	}
+
+	// Só um download roda por vez, e os outros esperam na fila
+	running := 0
+	for _, job := range queued {
+		if job.Status() == RUNNING {
+			running++
+		}
+	}
+	if running > 1 || queued[2].Status() != QUEUED {
+		t.Errorf("Expected one running job and the rest queued, got %d running and %s", running, queued[2].Status())
+	}
+	if again := jobs.Enqueue(&knownPeers, clock.New(), pool, queued[2].file, senderAddress, clientPath, 64, &[]Statistic{}); again != queued[2] {
+		t.Errorf("Expected the same file not to be queued twice")
+	}
+
+	for _, job := range queued {
+		<-job.Done()
+		if job.Status() != FINISHED {
+			t.Errorf("Expected %s to finish, got %s", job.file.name, job.String())
+		}
+		if progress := job.Progress(); progress.Done != progress.Total || progress.Bytes != progress.Size {
+			t.Errorf("Expected complete progress for %s, got %+v", job.file.name, progress)
+		}
+		if written, _ := os.ReadFile(clientPath + job.file.name); !bytes.Equal(written, contents[job.file.name]) {
+			t.Errorf("Downloaded content of %s does not match", job.file.name)
+		}
+	}
+}
+
+func TestPeerBudget(t *testing.T) {
+	budget := newPeerBudget(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if !budget.acquire(ctx, "peer:1") || !budget.acquire(ctx, "peer:1") || !budget.acquire(ctx, "peer:2") {
+		t.Fatalf("Expected free slots to be acquired")
+	}
+	if budget.acquire(ctx, "peer:1") {
+		t.Errorf("Expected third request to peer:1 to wait until the context ends")
+	}
+	budget.release("peer:1")
+	if !budget.acquire(context.Background(), "peer:1") {
+		t.Errorf("Expected released slot to be acquired")
+	}
+}
+
+func TestProgressTracker(t *testing.T) {
+	tracker := newProgressTracker()
+	tracker.begin(2, 10, 100, 950)
+	tracker.add("peer:1", 1, 100)
+	tracker.add("peer:2", 1, 100)
+	tracker.add("peer:1", 1, 100)
+	time.Sleep(10 * time.Millisecond)
+
+	progress := tracker.snapshot()
+	if progress.Done != 5 || progress.Total != 10 || progress.Bytes != 500 || progress.Percent() != 50 {
+		t.Errorf("Unexpected progress %+v", progress)
+	}
+	if progress.Rate <= 0 || progress.ETA <= 0 {
+		t.Errorf("Expected rate and ETA, got %+v", progress)
+	}
+	if progress.OriginRates["peer:1"] != 2*progress.OriginRates["peer:2"] {
+		t.Errorf("Expected peer:1 twice as fast as peer:2, got %v", progress.OriginRates)
+	}
+	if formatBytes(1536) != "1.5 KB" {
+		t.Errorf("formatBytes(1536) = %q", formatBytes(1536))
+	}
+}
+
+func TestDlRequestAdaptive(t *testing.T) {
+	serverPath := t.TempDir() + "/"
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*download.ADAPTIVE_PROBE_SIZE/16+3)
+	os.WriteFile(serverPath+"file.txt", content, 0644)
+	address := startFileServer(t, serverPath)
+
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: address, Status: peers.ONLINE, Clock: 0})
+	pool := connection.NewPool(network, clock.New())
+	defer pool.Close()
+	clientPath := t.TempDir() + "/"
+	file := File{name: "file.txt", size: len(content), hash: files.HashBytes(content), origin: []string{address}}
+
+	var statistics []Statistic
+	if err := DlRequest(&knownPeers, clock.New(), pool, file, senderAddress, clientPath, ADAPTIVE_CHUNK, &statistics); err != nil {
+		t.Fatalf("DlRequest returned error: %v", err)
+	}
+	if written, _ := os.ReadFile(clientPath + "file.txt"); !bytes.Equal(written, content) {
+		t.Errorf("Downloaded content differs from the original")
+	}
+	if len(statistics) != 1 || statistics[0].chunckSize != ADAPTIVE_CHUNK || len(statistics[0].chosenSizes) != 1 {
+		t.Fatalf("Expected one adaptive statistic, got %+v", statistics)
+	}
+	if size := statistics[0].chosenSizes[0]; size < download.ADAPTIVE_PROBE_SIZE/2 || size > message.MAX_CHUNK_SIZE {
+		t.Errorf("Unexpected chosen chunk size %d", size)
+	}
+	if !strings.HasPrefix(statistics[0].chunkSizeString(), "auto") {
+		t.Errorf("Unexpected chunk size label %q", statistics[0].chunkSizeString())
+	}
+}
+
+func TestDlRequestSlowOrigin(t *testing.T) {
+	serverPath := t.TempDir() + "/"
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	os.WriteFile(serverPath+"file.txt", content, 0644)
+	fast := startFileServer(t, serverPath)
+	slow := startDelayedFileServer(t, serverPath, 3*time.Second)
+
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: fast, Status: peers.ONLINE, Clock: 0})
+	knownPeers.Add(peers.Peer{Address: slow, Status: peers.ONLINE, Clock: 0})
+	pool := connection.NewPool(network, clock.New())
+	defer pool.Close()
+	clientPath := t.TempDir() + "/"
+	file := File{name: "file.txt", size: len(content), hash: files.HashBytes(content), origin: []string{slow, fast}}
+
+	// A origem rápida pega os blocos livres e repete os que estão com a lenta, sem esperar por ela
+	start := time.Now()
+	if err := DlRequest(&knownPeers, clock.New(), pool, file, senderAddress, clientPath, 16, &[]Statistic{}); err != nil {
+		t.Fatalf("DlRequest returned error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected download not to wait for the slow origin, took %v", elapsed)
+	}
+	if written, _ := os.ReadFile(clientPath + "file.txt"); !bytes.Equal(written, content) {
+		t.Errorf("Downloaded content differs from the original")
+	}
+}
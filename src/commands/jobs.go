@@ -0,0 +1,443 @@
+package commands
+
+// Pacotes nativos de go e pacotes internos
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"eachare/src/clock"
+	"eachare/src/connection"
+	"eachare/src/logger"
+	"eachare/src/peers"
+)
+
+// Estados de um download
+type JobStatus int
+
+const (
+	QUEUED JobStatus = iota
+	RUNNING
+	PAUSED
+	FINISHED
+	FAILED
+	CANCELED
+)
+
+// Função para retornar a string do estado do download
+func (status JobStatus) String() string {
+	switch status {
+	case QUEUED:
+		return "NA FILA"
+	case RUNNING:
+		return "BAIXANDO"
+	case PAUSED:
+		return "PAUSADO"
+	case FINISHED:
+		return "CONCLUÍDO"
+	case FAILED:
+		return "FALHOU"
+	case CANCELED:
+		return "CANCELADO"
+	default:
+		return "DESCONHECIDO"
+	}
+}
+
+// Erro para um download cancelado pelo usuário
+var ErrCanceled = errors.New("download cancelado")
+
+// Quantidade padrão de downloads da fila rodando ao mesmo tempo
+const MAX_ACTIVE_DOWNLOADS = 2
+
+// Quantidade máxima de requisições de chunk em andamento para um mesmo peer, somando todos os downloads
+const MAX_REQUESTS_PER_PEER = 64
+
+// Estrutura para limitar as requisições simultâneas para cada peer
+type peerBudget struct {
+	mu    sync.Mutex
+	limit int
+	slots map[string]chan struct{}
+}
+
+// Função para instanciar o limite de requisições por peer
+func newPeerBudget(limit int) *peerBudget {
+	return &peerBudget{limit: limit, slots: make(map[string]chan struct{})}
+}
+
+// Função para obter o semáforo do peer
+func (b *peerBudget) peer(address string) chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sem, exists := b.slots[address]
+	if !exists {
+		sem = make(chan struct{}, b.limit)
+		b.slots[address] = sem
+	}
+	return sem
+}
+
+// Função para esperar uma vaga para requisitar ao peer, retornando falso se o contexto acabar antes
+func (b *peerBudget) acquire(ctx context.Context, address string) bool {
+	select {
+	case b.peer(address) <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Função para liberar a vaga usada na requisição ao peer
+func (b *peerBudget) release(address string) {
+	<-b.peer(address)
+}
+
+// Estrutura para um download rodando em segundo plano
+// Pausar faz as requisições de chunk esperarem antes de serem enviadas, cancelar encerra o contexto de todas elas
+type Job struct {
+	id         int
+	file       File
+	ctx        context.Context
+	cancel     context.CancelFunc
+	budget     *peerBudget
+	background bool
+	run        func() error
+
+	mu      sync.Mutex
+	status  JobStatus
+	resumed chan struct{}
+	err     error
+	done    chan struct{}
+
+	progress *progressTracker
+}
+
+// Função para instanciar um download, que começa na fila
+func newJob(id int, file File, budget *peerBudget) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Job{id: id, file: file, ctx: ctx, cancel: cancel, budget: budget, status: QUEUED, done: make(chan struct{}), progress: newProgressTracker()}
+}
+
+// Função para mostrar uma mensagem do download sem atrapalhar o prompt se ele roda em segundo plano
+func (j *Job) notify(str string) {
+	if j.background {
+		logger.Notify("[download " + strconv.Itoa(j.id) + "] " + strings.TrimSpace(str))
+	} else {
+		logger.Std(str)
+	}
+}
+
+// Função para tirar o download da fila, retornando falso se ele foi cancelado antes
+func (j *Job) begin() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status != QUEUED {
+		return false
+	}
+	j.status = RUNNING
+	return true
+}
+
+// Função para obter o estado atual do download
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Função para obter um canal que é fechado quando o download termina, inclusive depois de cancelado
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Função para pausar o download, retornando falso se ele não estava baixando
+func (j *Job) Pause() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status != RUNNING {
+		return false
+	}
+	j.status = PAUSED
+	j.resumed = make(chan struct{})
+	return true
+}
+
+// Função para continuar um download pausado, retornando falso se ele não estava pausado
+func (j *Job) Resume() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status != PAUSED {
+		return false
+	}
+	j.status = RUNNING
+	close(j.resumed)
+	return true
+}
+
+// Função para cancelar o download, retornando falso se ele já tinha terminado
+func (j *Job) Cancel() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	previous := j.status
+	if previous != QUEUED && previous != RUNNING && previous != PAUSED {
+		return false
+	}
+	j.status = CANCELED
+	j.cancel()
+
+	// Um download que ainda estava na fila nunca vai rodar, então termina aqui
+	if previous == QUEUED {
+		close(j.done)
+	}
+	return true
+}
+
+// Função para esperar enquanto o download estiver pausado
+// Retorna falso se o download foi cancelado e a requisição não deve mais ser feita
+func (j *Job) wait() bool {
+	for {
+		j.mu.Lock()
+		status, resumed := j.status, j.resumed
+		j.mu.Unlock()
+		if status != PAUSED {
+			return j.ctx.Err() == nil
+		}
+		select {
+		case <-resumed:
+		case <-j.ctx.Done():
+			return false
+		}
+	}
+}
+
+// Função para registrar o fim do download, mantendo o estado de cancelado se for o caso
+func (j *Job) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer close(j.done)
+	j.err = err
+	if j.status == CANCELED {
+		return
+	}
+	if err != nil {
+		j.status = FAILED
+	} else {
+		j.status = FINISHED
+	}
+	j.cancel()
+}
+
+// Função para a linha do download na lista de downloads
+func (j *Job) String() string {
+	j.mu.Lock()
+	status, err := j.status, j.err
+	j.mu.Unlock()
+
+	progress := j.Progress()
+	line := fmt.Sprintf("%s %s (%d de %d chunks)", j.file.name, status.String(), progress.Done, progress.Total)
+	if status == RUNNING && len(progress.OriginRates) > 0 {
+		line += " " + formatOriginRates(progress.OriginRates)
+	}
+	if err != nil && status == FAILED {
+		line += ": " + err.Error()
+	}
+	return line
+}
+
+// Função para obter o progresso atual do download
+func (j *Job) Progress() Progress {
+	progress := j.progress.snapshot()
+	progress.File = j.file.name
+	progress.Status = j.Status()
+	return progress
+}
+
+// Estrutura para a fila de downloads dessa execução
+// Até maxActive downloads rodam ao mesmo tempo, dividindo o limite de requisições de cada peer
+type Jobs struct {
+	mu        sync.Mutex
+	nextID    int
+	jobs      []*Job
+	maxActive int
+	budget    *peerBudget
+}
+
+// Função para instanciar a fila de downloads
+func NewJobs(maxActive int) *Jobs {
+	return &Jobs{nextID: 1, maxActive: max(maxActive, 1), budget: newPeerBudget(MAX_REQUESTS_PER_PEER)}
+}
+
+// Função para alterar quantos downloads rodam ao mesmo tempo
+func (js *Jobs) SetMaxActive(maxActive int) {
+	js.mu.Lock()
+	js.maxActive = max(maxActive, 1)
+	js.mu.Unlock()
+	js.schedule()
+}
+
+// Função para colocar o download do arquivo na fila, iniciando-o assim que houver vaga
+func (js *Jobs) Enqueue(knownPeers *peers.SafePeers, localClock *clock.Clock, pool *connection.Pool, file File, senderAddress string, sharedPath string, chunkSize int, statistics *[]Statistic) *Job {
+	js.mu.Lock()
+	// Dois downloads do mesmo arquivo escreveriam no mesmo arquivo temporário
+	for _, job := range js.jobs {
+		if status := job.Status(); job.file.name == file.name && (status == QUEUED || status == RUNNING || status == PAUSED) {
+			js.mu.Unlock()
+			logger.Std("O arquivo " + file.name + " já está na fila (download " + strconv.Itoa(job.id) + ")\n")
+			return job
+		}
+	}
+	job := newJob(js.nextID, file, js.budget)
+	job.background = true
+	job.run = func() error {
+		return runDownload(job, knownPeers, localClock, pool, senderAddress, sharedPath, chunkSize, statistics)
+	}
+	js.nextID++
+	js.jobs = append(js.jobs, job)
+	js.mu.Unlock()
+
+	logger.Std("Download " + strconv.Itoa(job.id) + " (" + file.name + ") adicionado à fila\n")
+	js.schedule()
+	return job
+}
+
+// Função para iniciar os downloads da fila enquanto houver vaga
+// Downloads pausados continuam ocupando a vaga, já que mantêm o arquivo temporário aberto
+func (js *Jobs) schedule() {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	active := 0
+	for _, job := range js.jobs {
+		if status := job.Status(); status == RUNNING || status == PAUSED {
+			active++
+		}
+	}
+	for _, job := range js.jobs {
+		if active >= js.maxActive {
+			return
+		}
+		if job.begin() {
+			active++
+			go js.execute(job)
+		}
+	}
+}
+
+// Função para executar o download e liberar a vaga para o próximo da fila quando ele terminar
+// O resultado é avisado pelo próprio download, com job.notify
+func (js *Jobs) execute(job *Job) {
+	job.finish(job.run())
+	js.schedule()
+}
+
+// Função para obter um download pelo identificador
+func (js *Jobs) Get(id int) (*Job, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	for _, job := range js.jobs {
+		if job.id == id {
+			return job, true
+		}
+	}
+	return nil, false
+}
+
+// Função para obter uma cópia da lista de downloads
+func (js *Jobs) GetAll() []*Job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return append([]*Job{}, js.jobs...)
+}
+
+// Função para listar os downloads e pausar, continuar ou cancelar o escolhido
+func JobsMenu(jobs *Jobs) {
+	// Declara variável para o comando e inicia o loop do menu de downloads
+	var comm, id string
+	for {
+		// Imprime a lista de downloads e as opções
+		logger.Std("Downloads:\n")
+		all := jobs.GetAll()
+		if len(all) == 0 {
+			logger.Std("\tNenhum download iniciado\n")
+			return
+		}
+		for _, job := range all {
+			logger.Std("\t<" + strconv.Itoa(job.id) + "> " + job.String() + "\n")
+		}
+		logger.Std("\n\t[0] voltar para o menu anterior\n")
+		logger.Std("\t[1] pausar\n")
+		logger.Std("\t[2] continuar\n")
+		logger.Std("\t[3] cancelar\n")
+		logger.Std("\t[4] atualizar lista\n")
+		logger.Std("\t[5] alterar downloads simultâneos\n")
+		logger.Std("\t[6] acompanhar progresso\n> ")
+
+		// Lê a entrada do usuário
+		fmt.Scanln(&comm)
+		if comm == "0" {
+			return
+		} else if comm == "4" {
+			logger.Std("\n")
+			continue
+		} else if comm == "6" {
+			// A linha de progresso é atualizada até o usuário apertar Enter
+			logger.Std("\nAperte Enter para voltar.\n")
+			stop := make(chan struct{})
+			rendered := make(chan struct{})
+			go func() {
+				renderProgress(jobs, stop)
+				close(rendered)
+			}()
+			var enter string
+			fmt.Scanln(&enter)
+			close(stop)
+			<-rendered
+			logger.Std("\n")
+			continue
+		} else if comm == "5" {
+			logger.Std("Digite a quantidade de downloads simultâneos:\n> ")
+			fmt.Scanln(&id)
+			number, err := strconv.Atoi(id)
+			if err != nil || number <= 0 {
+				logger.Std("\nValor inválido. Precisa ser um inteiro maior que 0.\n\n")
+				continue
+			}
+			jobs.SetMaxActive(number)
+			logger.Info("Downloads simultâneos alterados: " + id)
+			logger.Std("\n")
+			continue
+		} else if comm != "1" && comm != "2" && comm != "3" {
+			logger.Std("\nOpção inválida, tente novamente.\n\n")
+			continue
+		}
+
+		// Lê o identificador do download escolhido
+		logger.Std("Digite o número do download:\n> ")
+		fmt.Scanln(&id)
+		number, err := strconv.Atoi(id)
+		job, exists := jobs.Get(number)
+		if err != nil || !exists {
+			logger.Std("\nDownload inexistente, tente novamente.\n\n")
+			continue
+		}
+
+		// Executa a ação escolhida
+		var ok bool
+		switch comm {
+		case "1":
+			ok = job.Pause()
+		case "2":
+			ok = job.Resume()
+		case "3":
+			ok = job.Cancel()
+		}
+		if !ok {
+			logger.Std("\nO download " + id + " está " + job.Status().String() + ", ação não aplicada.\n\n")
+		} else {
+			logger.Std("\nDownload " + id + " " + job.Status().String() + "\n\n")
+		}
+	}
+}
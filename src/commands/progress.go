@@ -0,0 +1,160 @@
+package commands
+
+// Pacotes nativos de go e pacotes internos
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"eachare/src/logger"
+)
+
+// Intervalo entre as atualizações da linha de progresso
+const PROGRESS_INTERVAL = 500 * time.Millisecond
+
+// Estrutura com o progresso de um download, para a CLI ou qualquer outra interface
+// Rate e OriginRates estão em bytes por segundo, contando só os chunks recebidos nessa execução
+type Progress struct {
+	File        string
+	Status      JobStatus
+	Done        int
+	Total       int
+	Bytes       int64
+	Size        int64
+	Rate        float64
+	OriginRates map[string]float64
+	ETA         time.Duration
+}
+
+// Função para obter a porcentagem já baixada
+func (p Progress) Percent() float64 {
+	if p.Total == 0 {
+		return 100
+	}
+	return 100 * float64(p.Done) / float64(p.Total)
+}
+
+// Função para a linha de progresso do download
+func (p Progress) String() string {
+	line := fmt.Sprintf("%s %.0f%% (%d/%d chunks) %s/s", p.File, p.Percent(), p.Done, p.Total, formatBytes(p.Rate))
+	if p.ETA > 0 {
+		line += " ETA " + p.ETA.Round(time.Second).String()
+	}
+	return line
+}
+
+// Estrutura que acumula o progresso a partir dos chunks que chegam no resultCh
+type progressTracker struct {
+	mu          sync.Mutex
+	start       time.Time
+	done        int
+	total       int
+	bytes       int64
+	size        int64
+	received    int64
+	originBytes map[string]int64
+}
+
+// Função para instanciar o acompanhamento de um download
+func newProgressTracker() *progressTracker {
+	return &progressTracker{originBytes: make(map[string]int64)}
+}
+
+// Função para começar a contar o tempo, considerando os chunks que já estavam no disco
+func (pt *progressTracker) begin(done int, total int, chunkSize int, size int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.start = time.Now()
+	pt.done = done
+	pt.total = total
+	pt.size = int64(size)
+	pt.bytes = min(int64(done)*int64(chunkSize), pt.size)
+}
+
+// Função para registrar um bloco de chunks recebido de uma origem
+func (pt *progressTracker) add(origin string, chunks int, size int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.done += chunks
+	pt.bytes += int64(size)
+	pt.received += int64(size)
+	pt.originBytes[origin] += int64(size)
+}
+
+// Função para obter uma cópia do progresso atual
+func (pt *progressTracker) snapshot() Progress {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	progress := Progress{Done: pt.done, Total: pt.total, Bytes: pt.bytes, Size: pt.size, OriginRates: make(map[string]float64)}
+	elapsed := time.Since(pt.start).Seconds()
+	if pt.start.IsZero() || elapsed <= 0 {
+		return progress
+	}
+	progress.Rate = float64(pt.received) / elapsed
+	for origin, bytes := range pt.originBytes {
+		progress.OriginRates[origin] = float64(bytes) / elapsed
+	}
+	if progress.Rate > 0 && pt.bytes < pt.size {
+		progress.ETA = time.Duration(float64(pt.size-pt.bytes) / progress.Rate * float64(time.Second))
+	}
+	return progress
+}
+
+// Função para formatar uma quantidade de bytes com a unidade adequada
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units)-1 {
+		bytes /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
+
+// Função para descrever a velocidade de cada origem, da mais rápida para a mais lenta
+func formatOriginRates(rates map[string]float64) string {
+	origins := slices.SortedFunc(maps.Keys(rates), func(a, b string) int {
+		if rates[a] > rates[b] {
+			return -1
+		} else if rates[a] < rates[b] {
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	parts := make([]string, len(origins))
+	for i, origin := range origins {
+		parts[i] = origin + " " + formatBytes(rates[origin]) + "/s"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Função para mostrar o progresso dos downloads ativos numa única linha, atualizada até stop ser fechado
+func renderProgress(jobs *Jobs, stop <-chan struct{}) {
+	ticker := time.NewTicker(PROGRESS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		var parts []string
+		for _, job := range jobs.GetAll() {
+			if status := job.Status(); status == RUNNING || status == PAUSED {
+				parts = append(parts, fmt.Sprintf("<%d> %s", job.id, job.Progress().String()))
+			}
+		}
+		line := "Nenhum download em andamento"
+		if len(parts) > 0 {
+			line = strings.Join(parts, " | ")
+		}
+		// Volta para o começo da linha e apaga o que sobrou da atualização anterior
+		logger.Std("\r" + line + "\x1b[K")
+
+		select {
+		case <-stop:
+			logger.Std("\n")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -4,9 +4,10 @@ package connection
 import (
 	"bufio"
 	"errors"
+	"io"
 	"net"
 	"strconv"
-	"strings"
+	"time"
 
 	"eachare/src/clock"
 	"eachare/src/logger"
@@ -14,70 +15,113 @@ import (
 	"eachare/src/peers"
 )
 
-// Função para verificar e imprimir mensagem de erro
-func check(err error) {
-	if err != nil {
-		panic(err)
-	}
+// Função para enviar mensagem, marcada com o relógio do peer que envia
+func SendMessage(knownPeers *peers.SafePeers, localClock *clock.Clock, conn net.Conn, message message.BaseMessage, receiverAddress string) {
+	// Tenta enviar a mensagem, depois atualiza o peer e mostra atualização
+	err := writeMessage(knownPeers, localClock, conn, message, receiverAddress)
+	updateStatus(knownPeers, receiverAddress, err)
 }
 
-// Função para enviar mensagem
-func SendMessage(knownPeers *peers.SafePeers, conn net.Conn, message message.BaseMessage, receiverAddress string) {
+// Função para marcar a mensagem com o relógio e escrevê-la na conexão, sem mexer no status do peer
+func writeMessage(knownPeers *peers.SafePeers, localClock *clock.Clock, conn net.Conn, message message.BaseMessage, receiverAddress string) error {
 	// Atualiza o clock e mostra o encaminhamento
-	message.Clock = clock.UpdateClock()
-	logger.Info("Encaminhando mensagem \"" + message.String() + "\" para " + receiverAddress)
+	message = stampMessage(knownPeers, localClock, message, receiverAddress)
+	if conn == nil {
+		return errors.New("connection is nil")
+	}
+	_, err := conn.Write(message.Encode())
+	return err
+}
 
-	// Tenta enviar a mensagem e verificar se há um erro
-	var err error
+// Função para lidar com a conexão recebida
+// Retorna o erro de leitura da conexão ou *message.MalformedError se a linha recebida for inválida
+func ReceiveMessage(knownPeers *peers.SafePeers, conn net.Conn) (message.BaseMessage, error) {
 	if conn == nil {
-		err = errors.New("connection is nil")
-	} else {
-		_, err = conn.Write([]byte(message.String() + "\n"))
+		return message.BaseMessage{}, errors.New("connection is nil")
+	}
+
+	// Lê a mensagem recebida no buffer até encontrar \n e decodifica as partes da mensagem
+	receivedMessage, err := readMessage(bufio.NewReader(conn))
+	if err != nil {
+		return message.BaseMessage{}, err
+	}
+
+	// Adiciona ou atualiza o peer que enviou a mensagem e a retorna
+	registerSender(knownPeers, receivedMessage)
+	return receivedMessage, nil
+}
+
+// Função para atualizar o clock da mensagem e mostrar o encaminhamento
+// O relógio vetorial só vai para peers que anunciaram VECTOR_FEATURE, os demais recebem só o escalar
+// As mensagens do detector de falhas só aparecem no nível DEBUG, para não encher a CLI a cada rodada
+func stampMessage(knownPeers *peers.SafePeers, localClock *clock.Clock, sendMessage message.BaseMessage, receiverAddress string) message.BaseMessage {
+	log := logger.Info
+	if message.IsHeartbeat(sendMessage) {
+		log = logger.Debug
+	}
+	var vector clock.Vector
+	sendMessage.Clock, vector = localClock.StampWith(log)
+	if neighbor, _ := knownPeers.Get(receiverAddress); neighbor.Capabilities.HasFeature(message.VECTOR_FEATURE) {
+		sendMessage.Vector = vector
 	}
+	log("Encaminhando mensagem \"" + sendMessage.String() + "\" para " + receiverAddress)
+	return sendMessage
+}
 
-	// Atualiza o peer e mostra atualização
-	neighbor, _ := knownPeers.Get(receiverAddress)
+// Função para atualizar o status do peer de acordo com o resultado do envio
+func updateStatus(knownPeers *peers.SafePeers, receiverAddress string, err error) {
 	if err == nil {
-		knownPeers.Add(peers.Peer{Address: receiverAddress, Status: peers.ONLINE, Clock: neighbor.Clock})
+		neighbor, _ := knownPeers.Get(receiverAddress)
+		knownPeers.Add(peers.Peer{Address: receiverAddress, Status: peers.ONLINE, Clock: neighbor.Clock, LastSeen: time.Now()})
 	} else {
 		logger.Info("Atualizando peer " + receiverAddress + " status " + peers.OFFLINE.String())
-		knownPeers.Add(peers.Peer{Address: receiverAddress, Status: peers.OFFLINE, Clock: neighbor.Clock})
+		knownPeers.RecordFailure(receiverAddress)
 	}
 }
 
-// Função para lidar com a conexão recebida
-func ReceiveMessage(knownPeers *peers.SafePeers, conn net.Conn) message.BaseMessage {
-	// Lê a mensagem recebida no buffer até encontrar \n e constrói as partes da mensagem
-	msg, err := bufio.NewReader(conn).ReadString('\n')
+// Função para ler uma linha do buffer e decodificar a mensagem, registrando mensagens malformadas
+func readMessage(reader *bufio.Reader) (message.BaseMessage, error) {
+	line, err := reader.ReadString('\n')
 	if err != nil {
-		return message.BaseMessage{Origin: "", Clock: 0, Type: message.UNKNOWN, Arguments: []string{}}
+		return message.BaseMessage{}, err
 	}
-	msg = strings.TrimSuffix(msg, "\n")
-	msgParts := strings.Split(msg, " ")
+	receivedMessage, err := decodeLine(line)
+	if err != nil {
+		return message.BaseMessage{}, err
+	}
+	return receivedMessage, readPayload(reader, &receivedMessage)
+}
 
-	// Cria variáveis para as partes da mensagem
-	receivedAddress := msgParts[0]
-	receivedClock, err := strconv.Atoi(msgParts[1])
-	check(err)
-	receivedMessageType := message.GetMessageType(msgParts[2])
-	var receivedArguments []string
-	if len(msgParts) > 3 {
-		receivedArguments = msgParts[3:]
+// Função para ler os bytes crus que seguem a linha de um FILE em modo binário
+func readPayload(reader *bufio.Reader, receivedMessage *message.BaseMessage) error {
+	if !receivedMessage.HasBinaryPayload() {
+		return nil
 	}
 
-	// Adiciona ou atualiza (apenas se for informação mais recente) o peer recebido
-	neighbor, exists := knownPeers.Get(receivedAddress)
-	if exists && neighbor.Clock > receivedClock {
-		knownPeers.Add(peers.Peer{Address: receivedAddress, Status: peers.ONLINE, Clock: neighbor.Clock})
-	} else {
-		knownPeers.Add(peers.Peer{Address: receivedAddress, Status: peers.ONLINE, Clock: receivedClock})
+	// O tamanho já foi validado no Decode
+	size, _ := strconv.Atoi(receivedMessage.Arguments[1])
+	receivedMessage.Payload = make([]byte, size)
+	_, err := io.ReadFull(reader, receivedMessage.Payload)
+	return err
+}
+
+// Função para decodificar uma linha já lida, registrando mensagens malformadas
+func decodeLine(line string) (message.BaseMessage, error) {
+	receivedMessage, err := message.Decode(line)
+	if err != nil {
+		logger.Error("Mensagem malformada descartada: " + err.Error())
+		return message.BaseMessage{}, err
 	}
+	return receivedMessage, nil
+}
 
-	// Retorna a mensagem recebida
-	return message.BaseMessage{
-		Origin:    receivedAddress,
-		Clock:     receivedClock,
-		Type:      receivedMessageType,
-		Arguments: receivedArguments,
+// Função para adicionar ou atualizar (apenas se for informação mais recente) o peer que enviou a mensagem
+func registerSender(knownPeers *peers.SafePeers, receivedMessage message.BaseMessage) {
+	neighbor, exists := knownPeers.Get(receivedMessage.Origin)
+	vector := neighbor.Vector.Merge(receivedMessage.Vector)
+	if exists && neighbor.Clock > receivedMessage.Clock {
+		knownPeers.Add(peers.Peer{Address: receivedMessage.Origin, Status: peers.ONLINE, Clock: neighbor.Clock, Vector: vector, LastSeen: time.Now()})
+	} else {
+		knownPeers.Add(peers.Peer{Address: receivedMessage.Origin, Status: peers.ONLINE, Clock: receivedMessage.Clock, Vector: vector, LastSeen: time.Now()})
 	}
 }
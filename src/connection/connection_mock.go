@@ -1,18 +1,24 @@
 package connection
 
 import (
+	"bytes"
 	"errors"
+	"io"
 	"net"
 	"strings"
 	"time"
 )
 
 type mockConn struct {
-	data []byte
+	data  []byte
+	input bytes.Buffer
 }
 
 func (m *mockConn) Read(b []byte) (n int, err error) {
-	return 0, nil
+	if m.input.Len() == 0 {
+		return 0, io.EOF
+	}
+	return m.input.Read(b)
 }
 
 func (m *mockConn) Write(b []byte) (n int, err error) {
@@ -1,8 +1,19 @@
 package connection
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"eachare/src/clock"
 	"eachare/src/message"
 	"eachare/src/peers"
 )
@@ -18,7 +29,7 @@ func TestSendMessageArgumentsNilOK(t *testing.T) {
 	var knownPeers peers.SafePeers
 	knownPeers.Add(peers.Peer{Address: "127.0.0.1:9001", Status: peers.ONLINE, Clock: 0})
 
-	SendMessage(&knownPeers, conn, message, "127.0.0.1:9001")
+	SendMessage(&knownPeers, clock.New(), conn, message, "127.0.0.1:9001")
 
 	if string(conn.data) != "localhost 1 UNKNOWN\n" {
 		t.Fatalf("Expected %s, got %s", "localhost 1 UNKNOWN\n", string(conn.data))
@@ -35,10 +46,419 @@ func TestSendMessageConnNil(t *testing.T) {
 	var knownPeers peers.SafePeers
 	knownPeers.Add(peers.Peer{Address: "127.0.0.1:9001", Status: peers.ONLINE, Clock: 0})
 
-	SendMessage(&knownPeers, nil, message, "127.0.0.1:9001")
+	SendMessage(&knownPeers, clock.New(), nil, message, "127.0.0.1:9001")
 
 	neighbor, _ := knownPeers.Get("127.0.0.1:9001")
 	if neighbor.Status != peers.OFFLINE {
 		t.Fatalf("Expected peer status to be OFFLINE, got %s", neighbor.Status.String())
 	}
 }
+
+func TestReceiveMessageValid(t *testing.T) {
+	conn := &mockConn{}
+	conn.input.WriteString("127.0.0.1:9002 7 LS_LIST 1 my%20file.txt:10\n")
+	var knownPeers peers.SafePeers
+
+	received, err := ReceiveMessage(&knownPeers, conn)
+	if err != nil {
+		t.Fatalf("ReceiveMessage returned error: %v", err)
+	}
+	if received.Type != message.LS_LIST || received.Clock != 7 {
+		t.Errorf("Unexpected message: %+v", received)
+	}
+	neighbor, exists := knownPeers.Get("127.0.0.1:9002")
+	if !exists || neighbor.Status != peers.ONLINE || neighbor.Clock != 7 {
+		t.Errorf("Expected sender to be added as ONLINE with clock 7, got %+v", neighbor)
+	}
+}
+
+func TestReceiveMessageMalformed(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected error
+	}{
+		{"127.0.0.1:9002\n", message.ErrShortMessage},
+		{"127.0.0.1:9002 7\n", message.ErrShortMessage},
+		{"127.0.0.1:9002 abc HELLO\n", message.ErrBadClock},
+		{"127.0.0.1:9002 -3 HELLO\n", message.ErrBadClock},
+		{"127.0.0.1:9002 7 NOPE\n", message.ErrUnknownType},
+		{"127.0.0.1:9002 7 DL file.txt\n", message.ErrArgumentCount},
+		{"127.0.0.1:9002 7 FILE a 1 0\n", message.ErrArgumentCount},
+		{"127.0.0.1:9002 7 LS_LIST 3 a:1\n", message.ErrArgumentCount},
+		{"127.0.0.1:9002 7 BYE now\n", message.ErrArgumentCount},
+		{" 7 HELLO\n", message.ErrInvalidLine},
+	}
+
+	for _, test := range tests {
+		conn := &mockConn{}
+		conn.input.WriteString(test.line)
+		var knownPeers peers.SafePeers
+
+		_, err := ReceiveMessage(&knownPeers, conn)
+		if !errors.Is(err, test.expected) {
+			t.Errorf("ReceiveMessage(%q) error = %v; expected %v", test.line, err, test.expected)
+		}
+		if knownPeers.Len() != 0 {
+			t.Errorf("ReceiveMessage(%q) should not touch the peer table", test.line)
+		}
+	}
+}
+
+func TestReceiveMessageClosed(t *testing.T) {
+	var knownPeers peers.SafePeers
+	if _, err := ReceiveMessage(&knownPeers, &mockConn{}); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected io.EOF for closed connection, got %v", err)
+	}
+	if _, err := ReceiveMessage(&knownPeers, nil); err == nil {
+		t.Errorf("Expected error for nil connection")
+	}
+}
+
+func FuzzReceiveMessage(f *testing.F) {
+	f.Add("127.0.0.1:9001 1 HELLO\n")
+	f.Add("127.0.0.1:9001 1 HELLO version=2 types=HELLO,DL chunk=256 encodings=base64\n")
+	f.Add("127.0.0.1:9001 2 PEERS_LIST 1 127.0.0.1:9002:ONLINE:3\n")
+	f.Add("127.0.0.1:9001 3 DL a%20b.txt 256 0\n")
+	f.Add("127.0.0.1:9001 4 FILE a.txt 5 0 aGVsbG8=\n")
+	f.Add("127.0.0.1:9001 5 ERROR BUSY\n")
+	f.Add("garbage\n")
+	f.Fuzz(func(t *testing.T, line string) {
+		conn := &mockConn{}
+		conn.input.WriteString(line)
+		var knownPeers peers.SafePeers
+
+		received, err := ReceiveMessage(&knownPeers, conn)
+		if err != nil {
+			if knownPeers.Len() != 0 {
+				t.Fatalf("Rejected message %q changed the peer table", line)
+			}
+			return
+		}
+
+		// Toda mensagem aceita tem origem, tipo conhecido e registra o remetente
+		if received.Origin == "" || received.Type == message.UNKNOWN {
+			t.Fatalf("Accepted invalid message %q: %+v", line, received)
+		}
+		if _, exists := knownPeers.Get(received.Origin); !exists {
+			t.Fatalf("Accepted message %q did not register its origin", line)
+		}
+	})
+}
+
+// Função para subir um listener local que atende as conexões com Serve e conta quantas conexões recebeu
+func startServer(t *testing.T, transport Transport, knownPeers *peers.SafePeers, handler Handler) (string, *atomic.Int32) {
+	listener, err := transport.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				Serve(knownPeers, conn, handler)
+			}()
+		}
+	}()
+	return listener.Addr().String(), &accepted
+}
+
+// Handler que responde o LS com um LS_LIST contendo o relógio recebido, para identificar cada resposta
+func echoHandler(serverPeers *peers.SafePeers) Handler {
+	serverClock := clock.New()
+	return func(receivedMessage message.BaseMessage, conn net.Conn) {
+		if receivedMessage.Type != message.LS {
+			return
+		}
+		reply := message.BaseMessage{Origin: "server:1", Type: message.LS_LIST, Arguments: []string{"1", message.JoinFields(strconv.Itoa(receivedMessage.Clock), "1")}}
+		SendMessage(serverPeers, serverClock, conn, reply, receivedMessage.Origin)
+	}
+}
+
+func TestPoolRequestLegacy(t *testing.T) {
+	var serverPeers, clientPeers peers.SafePeers
+	address, accepted := startServer(t, &TCPTransport{}, &serverPeers, echoHandler(&serverPeers))
+	pool := NewPool(&TCPTransport{}, clock.New())
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		reply, err := pool.Request(ctx, &clientPeers, message.BaseMessage{Origin: "client:1", Type: message.LS}, address)
+		cancel()
+		if err != nil || reply.Type != message.LS_LIST {
+			t.Fatalf("Request %d failed: %+v, %v", i, reply, err)
+		}
+	}
+	if accepted.Load() != 3 {
+		t.Errorf("Expected one connection per message for legacy peers, got %d", accepted.Load())
+	}
+}
+
+func TestPoolRequestMultiplexed(t *testing.T) {
+	var serverPeers, clientPeers peers.SafePeers
+	address, accepted := startServer(t, &TCPTransport{}, &serverPeers, echoHandler(&serverPeers))
+	clientPeers.Add(peers.Peer{Address: address, Status: peers.ONLINE})
+	clientPeers.SetCapabilities(address, message.LocalCapabilities())
+	pool := NewPool(&TCPTransport{}, clock.New())
+	defer pool.Close()
+
+	// Várias requisições em paralelo precisam receber cada uma a sua própria resposta
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			reply, err := pool.Request(ctx, &clientPeers, message.BaseMessage{Origin: "client:1", Type: message.LS}, address)
+			if err != nil {
+				errs <- err
+				return
+			}
+			fields, _ := message.SplitFields(reply.Arguments[1])
+			if fields[0] == "" {
+				errs <- errors.New("empty reply")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Multiplexed request failed: %v", err)
+	}
+
+	// Mensagens sem resposta também passam pela mesma sessão
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Send(ctx, &clientPeers, message.BaseMessage{Origin: "client:1", Type: message.BYE}, address); err != nil {
+		t.Errorf("Send failed: %v", err)
+	}
+	if accepted.Load() != 1 {
+		t.Errorf("Expected a single multiplexed connection, got %d", accepted.Load())
+	}
+}
+
+func TestPoolRequestNoReply(t *testing.T) {
+	var serverPeers, clientPeers peers.SafePeers
+	address, _ := startServer(t, &TCPTransport{}, &serverPeers, echoHandler(&serverPeers))
+	clientPeers.Add(peers.Peer{Address: address, Status: peers.ONLINE})
+	clientPeers.SetCapabilities(address, message.LocalCapabilities())
+	pool := NewPool(&TCPTransport{}, clock.New())
+	defer pool.Close()
+
+	// Uma requisição sem resposta do handler falha na hora, sem esperar o prazo
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := pool.Request(ctx, &clientPeers, message.BaseMessage{Origin: "client:1", Type: message.GET_PEERS}, address); !errors.Is(err, ErrNoReply) {
+		t.Errorf("Expected ErrNoReply, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to fail right away, took %v", elapsed)
+	}
+
+	// Uma linha que não dá para decodificar recebe um frame vazio com o mesmo identificador
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte(FRAME_PREFIX + "7 not a message\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != FRAME_PREFIX+"7 \n" {
+		t.Errorf("Expected an empty frame for request 7, got %q, %v", line, err)
+	}
+
+	// A sessão continua atendendo as próximas requisições
+	if reply, err := pool.Request(ctx, &clientPeers, message.BaseMessage{Origin: "client:1", Type: message.LS}, address); err != nil || reply.Type != message.LS_LIST {
+		t.Errorf("Expected the session to keep working, got %+v, %v", reply, err)
+	}
+}
+
+func TestPoolRequestUnreachable(t *testing.T) {
+	var clientPeers peers.SafePeers
+	clientPeers.Add(peers.Peer{Address: "127.0.0.1:1", Status: peers.ONLINE})
+	pool := NewPool(&TCPTransport{}, clock.New())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := pool.Request(ctx, &clientPeers, message.BaseMessage{Origin: "client:1", Type: message.LS}, "127.0.0.1:1")
+	if !errors.Is(err, ErrNotDelivered) {
+		t.Errorf("Expected ErrNotDelivered, got %v", err)
+	}
+	if neighbor, _ := clientPeers.Get("127.0.0.1:1"); neighbor.Status != peers.OFFLINE {
+		t.Errorf("Expected unreachable peer to be OFFLINE")
+	}
+}
+
+func TestPoolMemoryNetwork(t *testing.T) {
+	network := NewMemoryNetwork()
+	var serverPeers, legacyPeers, muxPeers peers.SafePeers
+	address, accepted := startServer(t, network, &serverPeers, echoHandler(&serverPeers))
+	muxPeers.Add(peers.Peer{Address: address, Status: peers.ONLINE})
+	muxPeers.SetCapabilities(address, message.LocalCapabilities())
+	pool := NewPool(network, clock.New())
+	defer pool.Close()
+
+	// O mesmo pool atende peers no formato original e peers com sessão
+	for _, knownPeers := range []*peers.SafePeers{&legacyPeers, &legacyPeers, &muxPeers, &muxPeers} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		reply, err := pool.Request(ctx, knownPeers, message.BaseMessage{Origin: "client:1", Type: message.LS}, address)
+		cancel()
+		if err != nil || reply.Type != message.LS_LIST {
+			t.Fatalf("Request over memory network failed: %+v, %v", reply, err)
+		}
+	}
+	if accepted.Load() != 3 {
+		t.Errorf("Expected two legacy connections and one session, got %d", accepted.Load())
+	}
+}
+
+func TestMemoryNetworkListen(t *testing.T) {
+	network := NewMemoryNetwork()
+	first, err := network.Listen("peer:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	second, err := network.Listen("peer:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if first.Addr().String() == second.Addr().String() {
+		t.Errorf("Expected distinct ports, got %s twice", first.Addr())
+	}
+	if _, err := network.Listen(first.Addr().String()); !errors.Is(err, ErrAddressInUse) {
+		t.Errorf("Expected ErrAddressInUse, got %v", err)
+	}
+
+	// Depois do Close o endereço recusa conexões e pode ser escutado de novo
+	first.Close()
+	if _, err := first.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected net.ErrClosed from closed listener, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := network.Dial(ctx, first.Addr().String()); !errors.Is(err, ErrConnectionRefused) {
+		t.Errorf("Expected ErrConnectionRefused, got %v", err)
+	}
+	again, err := network.Listen(first.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to listen again on a released address: %v", err)
+	}
+	again.Close()
+	second.Close()
+}
+
+func TestParseFaultRules(t *testing.T) {
+	rules, seed, err := ParseFaultRules("kind=drop,p=0.25,type=DL,peer=127.0.0.1:9002; kind=DELAY,delay=20ms ;seed=42")
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	expected := []FaultRule{
+		{Kind: DROP, Probability: 0.25, Type: message.DL, Peer: "127.0.0.1:9002"},
+		{Kind: DELAY, Probability: 1, Delay: 20 * time.Millisecond},
+	}
+	if seed != 42 || len(rules) != len(expected) {
+		t.Fatalf("Expected %d rules and seed 42, got %+v and %d", len(expected), rules, seed)
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Errorf("Rule %d: expected %+v, got %+v", i, expected[i], rules[i])
+		}
+	}
+
+	for _, spec := range []string{"p=0.5", "kind=explode", "kind=drop,p=2", "kind=drop,type=NOPE", "kind=drop,when", "seed=x"} {
+		if _, _, err := ParseFaultRules(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestFaultInjector(t *testing.T) {
+	network := NewMemoryNetwork()
+	var serverPeers peers.SafePeers
+	address, _ := startServer(t, network, &serverPeers, echoHandler(&serverPeers))
+
+	// Função para fazer um LS pelo injetor e retornar o erro
+	request := func(injector *FaultInjector) error {
+		var clientPeers peers.SafePeers
+		pool := NewPool(injector, clock.New())
+		defer pool.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		_, err := pool.Request(ctx, &clientPeers, message.BaseMessage{Origin: "client:1", Type: message.LS}, address)
+		return err
+	}
+
+	// Regras que não casam com a mensagem não mudam nada
+	injector := NewFaultInjector(network, 1, FaultRule{Kind: RESET, Type: message.DL, Probability: 1}, FaultRule{Kind: DROP, Peer: "other:1", Probability: 1})
+	if err := request(injector); err != nil {
+		t.Errorf("Expected unmatched rules to be harmless, got %v", err)
+	}
+
+	// Cada falha aparece para quem enviou como a mesma coisa que apareceria numa rede de verdade
+	cases := []struct {
+		kind  FaultKind
+		check func(error) bool
+	}{
+		{DROP, func(err error) bool { return errors.Is(err, os.ErrDeadlineExceeded) }},
+		{TRUNCATE, func(err error) bool { return err != nil }},
+		{RESET, func(err error) bool { return err != nil }},
+		{DELAY, func(err error) bool { return err == nil }},
+	}
+	for _, c := range cases {
+		injector := NewFaultInjector(network, 1, FaultRule{Kind: c.kind, Peer: address, Type: message.LS, Probability: 1, Delay: 10 * time.Millisecond})
+		if err := request(injector); !c.check(err) {
+			t.Errorf("%s: unexpected result %v", c.kind, err)
+		}
+		if injector.Injected(c.kind) != 1 {
+			t.Errorf("%s: expected one injected fault, got %d", c.kind, injector.Injected(c.kind))
+		}
+	}
+}
+
+func TestFaultInjectorSeed(t *testing.T) {
+	// A mesma semente sorteia as mesmas mensagens
+	draws := func(seed int64) []bool {
+		injector := NewFaultInjector(NewMemoryNetwork(), seed, FaultRule{Kind: DROP, Probability: 0.5})
+		var picked []bool
+		for i := 0; i < 32; i++ {
+			_, faulty := injector.pick("a:1", "b:1", message.LS)
+			picked = append(picked, faulty)
+		}
+		return picked
+	}
+	first, second := draws(7), draws(7)
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Expected the same draws for the same seed, differ at %d", i)
+		}
+	}
+}
+
+func TestFaultContentRange(t *testing.T) {
+	cases := []struct {
+		encoded  string
+		expected string
+	}{
+		{"a:1 3 FILE x 4 0 -\nDATA", "DATA"},
+		{"#7 a:1 3 FILE x 4 0 -\nDATA", "DATA"},
+		{"a:1 3 LS_LIST 1 x:4\n", "1 x:4"},
+		{"#2 a:1 3 LS\n", ""},
+	}
+	for _, c := range cases {
+		start, end := contentRange([]byte(c.encoded))
+		if got := c.encoded[start:max(start, end)]; got != c.expected {
+			t.Errorf("%q: expected content %q, got %q", c.encoded, c.expected, got)
+		}
+	}
+}
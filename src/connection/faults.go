@@ -0,0 +1,336 @@
+package connection
+
+// Pacotes nativos de go e pacotes internos
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"eachare/src/logger"
+	"eachare/src/message"
+)
+
+// Define uma int para o tipo de falha injetada
+type FaultKind uint8
+
+// Define uma enum para as falhas que podem ser injetadas numa mensagem
+const (
+	DROP     FaultKind = iota // A mensagem some, mas quem enviou acha que deu certo
+	DELAY                     // A mensagem é enviada depois de um atraso
+	TRUNCATE                  // Só a primeira metade da mensagem é enviada e a conexão é fechada
+	CORRUPT                   // Um bit do conteúdo da mensagem é invertido, sem mexer no cabeçalho
+	RESET                     // A conexão é fechada e o envio falha como "connection reset by peer"
+)
+
+// Atraso usado pelas regras DELAY que não informam um
+const DEFAULT_FAULT_DELAY = 500 * time.Millisecond
+
+// Tamanho máximo da primeira linha guardada para descobrir quem abriu uma conexão recebida
+const MAX_FAULT_LINE = 512
+
+// Retorna o tipo de falha como string
+func (kind FaultKind) String() string {
+	switch kind {
+	case DROP:
+		return "DROP"
+	case DELAY:
+		return "DELAY"
+	case TRUNCATE:
+		return "TRUNCATE"
+	case CORRUPT:
+		return "CORRUPT"
+	case RESET:
+		return "RESET"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Função para obter o tipo de falha a partir de uma string, sem diferenciar maiúsculas
+func GetFaultKind(s string) (FaultKind, error) {
+	for kind := DROP; kind <= RESET; kind++ {
+		if strings.EqualFold(kind.String(), s) {
+			return kind, nil
+		}
+	}
+	return 0, errors.New("tipo de falha desconhecido: " + s)
+}
+
+// Estrutura para uma regra de falha
+// Peer vazio vale para qualquer peer, e casa com a origem da mensagem ou com o peer do outro lado da conexão
+// Type UNKNOWN vale para qualquer tipo de mensagem
+type FaultRule struct {
+	Kind        FaultKind
+	Peer        string
+	Type        message.MessageType
+	Probability float64
+	Delay       time.Duration
+}
+
+// Função para verificar se a regra vale para a mensagem enviada
+func (r FaultRule) matches(origin string, remote string, messageType message.MessageType) bool {
+	if r.Peer != "" && r.Peer != origin && r.Peer != remote {
+		return false
+	}
+	return r.Type == message.UNKNOWN || r.Type == messageType
+}
+
+// Função para interpretar as regras de falha do formato da linha de comando
+// Regras são separadas por ";" e seus campos por ",", ex.: "kind=drop,p=0.2,type=DL;kind=delay,delay=1s;seed=42"
+// Retorna as regras e a semente, que é 1 se não for informada
+func ParseFaultRules(spec string) ([]FaultRule, int64, error) {
+	var rules []FaultRule
+	var seed int64 = 1
+	for _, ruleSpec := range strings.Split(spec, ";") {
+		ruleSpec = strings.TrimSpace(ruleSpec)
+		if ruleSpec == "" {
+			continue
+		}
+
+		// A semente vem num item próprio
+		if value, found := strings.CutPrefix(ruleSpec, "seed="); found {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, 0, fmt.Errorf("semente inválida %q: %w", value, err)
+			}
+			seed = parsed
+			continue
+		}
+
+		rule := FaultRule{Probability: 1}
+		hasKind := false
+		for _, field := range strings.Split(ruleSpec, ",") {
+			key, value, found := strings.Cut(strings.TrimSpace(field), "=")
+			if !found {
+				return nil, 0, fmt.Errorf("campo sem valor %q na regra %q", field, ruleSpec)
+			}
+			var err error
+			switch key {
+			case "kind":
+				rule.Kind, err = GetFaultKind(value)
+				hasKind = true
+			case "p":
+				rule.Probability, err = strconv.ParseFloat(value, 64)
+				if err == nil && (rule.Probability < 0 || rule.Probability > 1) {
+					err = errors.New("probabilidade fora de [0, 1]")
+				}
+			case "peer":
+				rule.Peer = value
+			case "type":
+				rule.Type = message.GetMessageType(value)
+				if rule.Type == message.UNKNOWN {
+					err = errors.New("tipo de mensagem desconhecido")
+				}
+			case "delay":
+				rule.Delay, err = time.ParseDuration(value)
+			default:
+				err = errors.New("campo desconhecido")
+			}
+			if err != nil {
+				return nil, 0, fmt.Errorf("campo %q inválido na regra %q: %w", field, ruleSpec, err)
+			}
+		}
+		if !hasKind {
+			return nil, 0, fmt.Errorf("regra %q sem kind", ruleSpec)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, seed, nil
+}
+
+// Estrutura para um transporte que injeta falhas nas mensagens enviadas pelas conexões de outro transporte
+// A mesma semente e as mesmas mensagens, na mesma ordem, geram as mesmas falhas
+type FaultInjector struct {
+	transport Transport
+	rules     []FaultRule
+
+	mu       sync.Mutex
+	random   *rand.Rand
+	injected map[FaultKind]int
+}
+
+// Função para instanciar o injetor de falhas sobre um transporte
+func NewFaultInjector(transport Transport, seed int64, rules ...FaultRule) *FaultInjector {
+	return &FaultInjector{transport: transport, rules: rules, random: rand.New(rand.NewSource(seed)), injected: make(map[FaultKind]int)}
+}
+
+// Função para abrir uma conexão em que o peer do outro lado é o endereço discado
+func (f *FaultInjector) Dial(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := f.transport.Dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{Conn: conn, injector: f, remote: address, learned: true}, nil
+}
+
+// Função para escutar conexões que também recebem as falhas nas respostas
+func (f *FaultInjector) Listen(address string) (net.Listener, error) {
+	listener, err := f.transport.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return &faultListener{Listener: listener, injector: f}, nil
+}
+
+// Função para retornar quantas falhas de um tipo já foram injetadas
+func (f *FaultInjector) Injected(kind FaultKind) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.injected[kind]
+}
+
+// Função para sortear a falha aplicada a uma mensagem, seguindo a ordem das regras
+// A primeira regra que casa e é sorteada vale, e as demais não são consultadas
+func (f *FaultInjector) pick(origin string, remote string, messageType message.MessageType) (FaultRule, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, rule := range f.rules {
+		if !rule.matches(origin, remote, messageType) {
+			continue
+		}
+		if f.random.Float64() < rule.Probability {
+			f.injected[rule.Kind]++
+			return rule, true
+		}
+	}
+	return FaultRule{}, false
+}
+
+// Função para sortear uma posição da mensagem, usada pelo CORRUPT
+func (f *FaultInjector) intn(n int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.random.Intn(n)
+}
+
+// Estrutura para um listener que entrega conexões com falhas
+type faultListener struct {
+	net.Listener
+	injector *FaultInjector
+}
+
+// Função para aceitar a próxima conexão, cujo peer é descoberto pela primeira mensagem recebida
+func (l *faultListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{Conn: conn, injector: l.injector}, nil
+}
+
+// Estrutura para uma conexão com falhas nas escritas
+// Cada Write leva uma mensagem inteira (ou um frame de sessão), então as falhas valem por mensagem
+type faultConn struct {
+	net.Conn
+	injector *FaultInjector
+
+	mu        sync.Mutex
+	remote    string
+	learned   bool
+	firstLine []byte
+}
+
+// Função para ler da conexão, guardando a origem da primeira mensagem das conexões recebidas
+func (c *faultConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	if !c.learned {
+		c.firstLine = append(c.firstLine, b[:n]...)
+		if line, _, found := strings.Cut(string(c.firstLine), "\n"); found || len(c.firstLine) >= MAX_FAULT_LINE {
+			c.remote, _ = parseHeader([]byte(line))
+			c.learned = true
+			c.firstLine = nil
+		}
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// Função para escrever a mensagem, aplicando a falha sorteada para ela
+func (c *faultConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	remote := c.remote
+	c.mu.Unlock()
+	origin, messageType := parseHeader(b)
+	rule, faulty := c.injector.pick(origin, remote, messageType)
+	if !faulty {
+		return c.Conn.Write(b)
+	}
+	logger.Debug("Falha injetada: " + rule.Kind.String() + " em " + messageType.String() + " de " + origin + " (peer " + remote + ")")
+
+	switch rule.Kind {
+	case DROP:
+		return len(b), nil
+	case DELAY:
+		delay := rule.Delay
+		if delay == 0 {
+			delay = DEFAULT_FAULT_DELAY
+		}
+		time.Sleep(delay)
+		return c.Conn.Write(b)
+	case TRUNCATE:
+		c.Conn.Write(b[:len(b)/2])
+		c.Conn.Close()
+		return len(b), nil
+	case CORRUPT:
+		start, end := contentRange(b)
+		if start >= end {
+			return c.Conn.Write(b)
+		}
+		corrupted := append([]byte(nil), b...)
+		corrupted[start+c.injector.intn(end-start)] ^= 1 << c.injector.intn(8)
+		return c.Conn.Write(corrupted)
+	default:
+		c.Conn.Close()
+		return 0, &net.OpError{Op: "write", Net: "fault", Addr: c.Conn.RemoteAddr(), Err: syscall.ECONNRESET}
+	}
+}
+
+// Função para obter a origem e o tipo de uma mensagem pela sua linha, aceitando o prefixo de sessão
+func parseHeader(b []byte) (string, message.MessageType) {
+	line, _, _ := strings.Cut(string(b[:min(len(b), MAX_FAULT_LINE)]), "\n")
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], FRAME_PREFIX) {
+		fields = fields[1:]
+	}
+	if len(fields) < 3 {
+		return "", message.UNKNOWN
+	}
+	return fields[0], message.GetMessageType(fields[2])
+}
+
+// Função para obter o trecho da mensagem que o CORRUPT pode alterar
+// Com conteúdo cru depois da linha, só ele é alterado, senão só os argumentos da linha
+// Assim o cabeçalho e os tamanhos continuam válidos e quem recebe não fica esperando bytes que não vêm
+func contentRange(b []byte) (int, int) {
+	lineEnd := bytes.IndexByte(b, '\n')
+	if lineEnd < 0 {
+		lineEnd = len(b)
+	}
+	if lineEnd+1 < len(b) {
+		return lineEnd + 1, len(b)
+	}
+
+	// Pula o prefixo de sessão, a origem, o relógio e o tipo
+	fields := 3
+	if bytes.HasPrefix(b, []byte(FRAME_PREFIX)) {
+		fields++
+	}
+	start := 0
+	for ; fields > 0 && start < lineEnd; fields-- {
+		next := bytes.IndexByte(b[start:lineEnd], ' ')
+		if next < 0 {
+			return lineEnd, lineEnd
+		}
+		start += next + 1
+	}
+	return start, lineEnd
+}
@@ -0,0 +1,389 @@
+package connection
+
+// Pacotes nativos de go e pacotes internos
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"eachare/src/clock"
+	"eachare/src/logger"
+	"eachare/src/message"
+	"eachare/src/peers"
+)
+
+// Prefixo das linhas de uma sessão multiplexada, seguido do identificador da requisição
+// Ex.: "#12 127.0.0.1:9001 5 DL arquivo.txt 256 0"
+const FRAME_PREFIX = "#"
+
+// Tempo sem uso depois do qual o pool descarta a sessão em vez de reaproveitá-la
+// O lado que recebe espera o dobro antes de fechar, então quem pede sempre fecha primeiro
+const SESSION_IDLE_TIMEOUT = 60 * time.Second
+
+// Erro para uma sessão que foi encerrada enquanto havia requisições pendentes
+var ErrSessionClosed = errors.New("sessão encerrada")
+
+// Erro para uma mensagem que nem chegou a ser entregue ao peer, usado com errors.Is
+var ErrNotDelivered = errors.New("mensagem não entregue")
+
+// Erro para uma requisição da sessão que o peer encerrou sem resposta, com um frame vazio
+var ErrNoReply = errors.New("requisição encerrada sem resposta")
+
+// Estrutura para o resultado de uma requisição feita numa sessão
+type frameResult struct {
+	message message.BaseMessage
+	err     error
+}
+
+// Estrutura para uma conexão longa com um peer, com várias requisições em andamento
+type session struct {
+	address string
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	nextID   uint64
+	pending  map[uint64]chan frameResult
+	lastUsed time.Time
+	closed   bool
+}
+
+// Estrutura para o pool de sessões, com no máximo uma sessão por peer
+type Pool struct {
+	mu        sync.Mutex
+	sessions  map[string]*session
+	dialing   map[string]chan struct{}
+	transport Transport
+	clock     *clock.Clock
+}
+
+// Função para instanciar o pool, abrindo as conexões pelo transporte recebido
+// As mensagens enviadas pelo pool são marcadas com o relógio do peer dono dele
+func NewPool(transport Transport, localClock *clock.Clock) *Pool {
+	return &Pool{sessions: make(map[string]*session), dialing: make(map[string]chan struct{}), transport: transport, clock: localClock}
+}
+
+// Função para enviar uma mensagem e esperar a resposta do peer
+// Peers que anunciaram MUX_FEATURE compartilham uma única conexão, os demais recebem uma conexão por mensagem
+func (p *Pool) Request(ctx context.Context, knownPeers *peers.SafePeers, sendMessage message.BaseMessage, receiverAddress string) (message.BaseMessage, error) {
+	return p.request(ctx, knownPeers, sendMessage, receiverAddress, false)
+}
+
+// Função para sondar se o peer está vivo com uma requisição, como o HELLO do detector de falhas
+// Ao contrário do Request, uma falha não muda o status do peer, que fica a cargo de quem sondou
+// Sem sessão, uma mensagem entregue já conta, já que peers no formato original fecham a conexão sem responder ao HELLO
+func (p *Pool) Probe(ctx context.Context, knownPeers *peers.SafePeers, sendMessage message.BaseMessage, receiverAddress string) (message.BaseMessage, error) {
+	receivedMessage, err := p.request(ctx, knownPeers, sendMessage, receiverAddress, true)
+	if err == nil {
+		return receivedMessage, nil
+	}
+	if supportsMux(knownPeers, receiverAddress) || errors.Is(err, ErrNotDelivered) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return message.BaseMessage{}, err
+	}
+	neighbor, _ := knownPeers.Get(receiverAddress)
+	knownPeers.Add(peers.Peer{Address: receiverAddress, Status: peers.ONLINE, Clock: neighbor.Clock, LastSeen: time.Now()})
+	return message.BaseMessage{}, nil
+}
+
+// Função para enviar a requisição e esperar a resposta, com probe indicando uma sondagem, que não atualiza o status
+func (p *Pool) request(ctx context.Context, knownPeers *peers.SafePeers, sendMessage message.BaseMessage, receiverAddress string, probe bool) (message.BaseMessage, error) {
+	if !supportsMux(knownPeers, receiverAddress) {
+		return p.legacyExchange(ctx, knownPeers, sendMessage, receiverAddress, true, probe)
+	}
+
+	// Envia pela sessão e espera a resposta com o mesmo identificador
+	s, id, ch, err := p.send(ctx, knownPeers, sendMessage, receiverAddress, true, probe)
+	if err != nil {
+		return message.BaseMessage{}, err
+	}
+	select {
+	case result := <-ch:
+		if result.err != nil {
+			return message.BaseMessage{}, result.err
+		}
+		registerSender(knownPeers, result.message)
+		return result.message, nil
+	case <-ctx.Done():
+		s.forget(id)
+		return message.BaseMessage{}, ctx.Err()
+	}
+}
+
+// Função para enviar uma mensagem que não tem resposta, como o BYE
+func (p *Pool) Send(ctx context.Context, knownPeers *peers.SafePeers, sendMessage message.BaseMessage, receiverAddress string) error {
+	if !supportsMux(knownPeers, receiverAddress) {
+		_, err := p.legacyExchange(ctx, knownPeers, sendMessage, receiverAddress, false, false)
+		return err
+	}
+	_, _, _, err := p.send(ctx, knownPeers, sendMessage, receiverAddress, false, false)
+	return err
+}
+
+// Função para encerrar todas as sessões abertas
+func (p *Pool) Close() {
+	p.mu.Lock()
+	sessions := p.sessions
+	p.sessions = make(map[string]*session)
+	p.mu.Unlock()
+
+	for _, s := range sessions {
+		s.close(ErrSessionClosed)
+	}
+}
+
+// Função para verificar se o peer aceita sessões multiplexadas
+func supportsMux(knownPeers *peers.SafePeers, address string) bool {
+	neighbor, _ := knownPeers.Get(address)
+	return neighbor.Capabilities.HasFeature(message.MUX_FEATURE)
+}
+
+// Função para o formato original: abre uma conexão, envia, opcionalmente lê a resposta e fecha
+func (p *Pool) legacyExchange(ctx context.Context, knownPeers *peers.SafePeers, sendMessage message.BaseMessage, receiverAddress string, waitReply bool, probe bool) (message.BaseMessage, error) {
+	conn, err := p.transport.Dial(ctx, receiverAddress)
+	if !probe {
+		SendMessage(knownPeers, p.clock, conn, sendMessage, receiverAddress)
+	} else if err == nil {
+		err = writeMessage(knownPeers, p.clock, conn, sendMessage, receiverAddress)
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return message.BaseMessage{}, fmt.Errorf("%w: %v", ErrNotDelivered, err)
+	}
+	defer conn.Close()
+	if !waitReply {
+		return message.BaseMessage{}, nil
+	}
+
+	// O prazo e o cancelamento do contexto valem também para a leitura
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	return ReceiveMessage(knownPeers, conn)
+}
+
+// Função para enviar a mensagem por uma sessão, reabrindo a sessão uma vez se a reaproveitada já tiver caído
+func (p *Pool) send(ctx context.Context, knownPeers *peers.SafePeers, sendMessage message.BaseMessage, receiverAddress string, waitReply bool, probe bool) (*session, uint64, chan frameResult, error) {
+	sendMessage = stampMessage(knownPeers, p.clock, sendMessage, receiverAddress)
+
+	for attempt := 0; ; attempt++ {
+		s, fresh, err := p.session(ctx, receiverAddress)
+		if err != nil {
+			if !probe {
+				updateStatus(knownPeers, receiverAddress, err)
+			}
+			return nil, 0, nil, fmt.Errorf("%w: %v", ErrNotDelivered, err)
+		}
+
+		id, ch, err := s.write(sendMessage, waitReply)
+		if err != nil && !fresh && attempt == 0 {
+			continue
+		}
+		if !probe {
+			updateStatus(knownPeers, receiverAddress, err)
+		}
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("%w: %v", ErrNotDelivered, err)
+		}
+		return s, id, ch, nil
+	}
+}
+
+// Função para obter a sessão com o peer, abrindo uma nova se necessário
+// O segundo retorno indica se a sessão acabou de ser aberta
+func (p *Pool) session(ctx context.Context, address string) (*session, bool, error) {
+	for {
+		p.mu.Lock()
+		s, exists := p.sessions[address]
+		if exists && s.usable() {
+			p.mu.Unlock()
+			return s, false, nil
+		} else if exists {
+			// Fecha a sessão que caiu fora do mutex e procura de novo
+			delete(p.sessions, address)
+			p.mu.Unlock()
+			s.close(ErrSessionClosed)
+			continue
+		}
+
+		// Se outra goroutine já está abrindo a sessão com esse peer, espera por ela
+		if wait, dialing := p.dialing[address]; dialing {
+			p.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+		}
+		done := make(chan struct{})
+		p.dialing[address] = done
+		p.mu.Unlock()
+
+		conn, err := p.transport.Dial(ctx, address)
+
+		p.mu.Lock()
+		delete(p.dialing, address)
+		close(done)
+		if err != nil {
+			p.mu.Unlock()
+			return nil, false, err
+		}
+		s = &session{
+			address:  address,
+			conn:     conn,
+			pending:  make(map[uint64]chan frameResult),
+			lastUsed: time.Now(),
+		}
+		p.sessions[address] = s
+		p.mu.Unlock()
+
+		go p.readLoop(s)
+		return s, true, nil
+	}
+}
+
+// Função para tirar a sessão do pool, se ainda for a sessão registrada para o peer
+func (p *Pool) remove(s *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sessions[s.address] == s {
+		delete(p.sessions, s.address)
+	}
+}
+
+// Função que lê as respostas da sessão e entrega cada uma para quem fez a requisição
+func (p *Pool) readLoop(s *session) {
+	reader := bufio.NewReader(s.conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			p.remove(s)
+			s.close(err)
+			return
+		}
+
+		id, rest, err := splitFrame(line)
+		if err != nil {
+			logger.Error("Linha fora de sessão recebida de " + s.address + ": " + err.Error())
+			continue
+		}
+		if strings.TrimSpace(rest) == "" {
+			s.deliver(id, frameResult{err: ErrNoReply})
+			continue
+		}
+		receivedMessage, err := decodeLine(rest)
+		if err == nil {
+			// Sem os bytes crus completos não dá para saber onde começa a próxima linha, então a sessão é descartada
+			if err := readPayload(reader, &receivedMessage); err != nil {
+				p.remove(s)
+				s.close(err)
+				return
+			}
+		}
+		s.deliver(id, frameResult{message: receivedMessage, err: err})
+	}
+}
+
+// Função para separar o identificador da requisição do resto da linha
+func splitFrame(line string) (uint64, string, error) {
+	if !strings.HasPrefix(line, FRAME_PREFIX) {
+		return 0, "", errors.New("linha sem identificador de requisição")
+	}
+	idString, rest, found := strings.Cut(line[len(FRAME_PREFIX):], " ")
+	if !found {
+		return 0, "", errors.New("linha sem mensagem após o identificador")
+	}
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil {
+		return 0, "", errors.New("identificador de requisição inválido")
+	}
+	return id, rest, nil
+}
+
+// Função para montar a linha da sessão com o identificador da requisição
+func frame(id uint64, encoded []byte) []byte {
+	prefix := FRAME_PREFIX + strconv.FormatUint(id, 10) + " "
+	return append([]byte(prefix), encoded...)
+}
+
+// Função para verificar se a sessão pode ser reaproveitada
+func (s *session) usable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.closed && time.Since(s.lastUsed) < SESSION_IDLE_TIMEOUT
+}
+
+// Função para escrever a mensagem na sessão, registrando a espera pela resposta se necessário
+func (s *session) write(sendMessage message.BaseMessage, waitReply bool) (uint64, chan frameResult, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return 0, nil, ErrSessionClosed
+	}
+	s.nextID++
+	id := s.nextID
+	ch := make(chan frameResult, 1)
+	if waitReply {
+		s.pending[id] = ch
+	}
+	s.lastUsed = time.Now()
+	s.mu.Unlock()
+
+	s.writeMu.Lock()
+	_, err := s.conn.Write(frame(id, sendMessage.Encode()))
+	s.writeMu.Unlock()
+	if err != nil {
+		s.close(err)
+		return 0, nil, err
+	}
+	return id, ch, nil
+}
+
+// Função para entregar a resposta para a requisição com o identificador recebido
+func (s *session) deliver(id uint64, result frameResult) {
+	s.mu.Lock()
+	ch, exists := s.pending[id]
+	delete(s.pending, id)
+	s.lastUsed = time.Now()
+	s.mu.Unlock()
+	if exists {
+		ch <- result
+	}
+}
+
+// Função para desistir de uma requisição cujo contexto foi cancelado
+func (s *session) forget(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, id)
+}
+
+// Função para fechar a sessão e avisar todas as requisições pendentes
+func (s *session) close(err error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	pending := s.pending
+	s.pending = make(map[uint64]chan frameResult)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, ch := range pending {
+		ch <- frameResult{err: err}
+	}
+}
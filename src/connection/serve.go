@@ -0,0 +1,125 @@
+package connection
+
+// Pacotes nativos de go e pacotes internos
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"eachare/src/logger"
+	"eachare/src/message"
+	"eachare/src/peers"
+)
+
+// Tempo máximo esperando a primeira mensagem de uma conexão recebida
+const FIRST_MESSAGE_TIMEOUT = 10 * time.Second
+
+// Quantidade máxima de requisições tratadas ao mesmo tempo numa mesma sessão
+const MAX_CONCURRENT_PER_SESSION = 64
+
+// Tipo para a função que trata uma mensagem recebida, escrevendo a resposta (se houver) em conn
+type Handler func(receivedMessage message.BaseMessage, conn net.Conn)
+
+// Estrutura que guarda a resposta de uma requisição da sessão para enviá-la de uma vez só
+type replyConn struct {
+	net.Conn
+	buffer bytes.Buffer
+}
+
+// Função para acumular a resposta em vez de escrever direto na conexão
+func (r *replyConn) Write(b []byte) (int, error) {
+	return r.buffer.Write(b)
+}
+
+// Função para impedir que o handler leia da conexão compartilhada
+func (r *replyConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Função para atender uma conexão recebida
+// Conexões no formato original trazem uma única mensagem, enquanto sessões trazem várias linhas com FRAME_PREFIX
+func Serve(knownPeers *peers.SafePeers, conn net.Conn, handler Handler) {
+	conn.SetReadDeadline(time.Now().Add(FIRST_MESSAGE_TIMEOUT))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	if strings.HasPrefix(line, FRAME_PREFIX) {
+		serveSession(knownPeers, conn, reader, line, handler)
+		return
+	}
+
+	// Formato original: trata a mensagem e a resposta vai direto na conexão
+	receivedMessage, err := decodeLine(line)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	registerSender(knownPeers, receivedMessage)
+	safeHandle(handler, receivedMessage, conn)
+}
+
+// Função para atender as requisições de uma sessão até ela ser fechada ou ficar ociosa
+// Toda requisição com identificador recebe um frame de volta, vazio quando não há resposta, para quem pediu não esperar o prazo
+func serveSession(knownPeers *peers.SafePeers, conn net.Conn, reader *bufio.Reader, line string, handler Handler) {
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, MAX_CONCURRENT_PER_SESSION)
+	writeFrame := func(id uint64, encoded []byte) {
+		if len(encoded) == 0 {
+			encoded = []byte("\n")
+		}
+		writeMu.Lock()
+		conn.Write(frame(id, encoded))
+		writeMu.Unlock()
+	}
+
+	for {
+		id, rest, err := splitFrame(line)
+		if err != nil {
+			logger.Error("Linha fora de sessão recebida: " + err.Error())
+		} else if receivedMessage, err := decodeLine(rest); err != nil {
+			// A requisição que não dá para decodificar é encerrada na hora
+			writeFrame(id, nil)
+		} else {
+			registerSender(knownPeers, receivedMessage)
+
+			// Cada requisição é tratada em paralelo e a resposta volta com o mesmo identificador
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(id uint64, receivedMessage message.BaseMessage) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				reply := &replyConn{Conn: conn}
+				safeHandle(handler, receivedMessage, reply)
+				writeFrame(id, reply.buffer.Bytes())
+			}(id, receivedMessage)
+		}
+
+		// Espera a próxima requisição, fechando a sessão se ficar ociosa por muito tempo
+		conn.SetReadDeadline(time.Now().Add(2 * SESSION_IDLE_TIMEOUT))
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+	}
+	wg.Wait()
+}
+
+// Função para chamar o handler garantindo que uma falha derrube apenas essa mensagem, nunca o peer
+func safeHandle(handler Handler, receivedMessage message.BaseMessage, conn net.Conn) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error(fmt.Sprintf("Falha ao tratar mensagem \"%s\": %v", receivedMessage.String(), r))
+		}
+	}()
+	handler(receivedMessage, conn)
+}
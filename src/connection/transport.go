@@ -0,0 +1,184 @@
+package connection
+
+// Pacotes nativos de go
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Interface para a camada de rede usada pelo peer, para abrir e receber conexões
+// A implementação TCP é a usada pelo programa, a em memória permite subir vários peers num mesmo processo
+type Transport interface {
+	Dial(ctx context.Context, address string) (net.Conn, error)
+	Listen(address string) (net.Listener, error)
+}
+
+// Primeira porta atribuída pela rede em memória para endereços com porta 0
+const MEMORY_FIRST_PORT = 10000
+
+// Erro para uma conexão com um endereço onde ninguém está escutando na rede em memória
+var ErrConnectionRefused = errors.New("conexão recusada")
+
+// Erro para um segundo listener no mesmo endereço da rede em memória
+var ErrAddressInUse = errors.New("endereço já em uso")
+
+// Estrutura para o transporte TCP, com conexões de verdade pelo sistema operacional
+type TCPTransport struct {
+	dialer net.Dialer
+}
+
+// Função para abrir uma conexão TCP com o endereço
+func (t *TCPTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	return t.dialer.DialContext(ctx, "tcp", address)
+}
+
+// Função para escutar conexões TCP no endereço
+func (t *TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+// Estrutura para uma rede em memória, em que cada conexão é um par de net.Pipe
+type MemoryNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memoryListener
+	nextPort  int
+}
+
+// Função para instanciar uma rede em memória vazia
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{listeners: make(map[string]*memoryListener), nextPort: MEMORY_FIRST_PORT}
+}
+
+// Função para conectar com o listener do endereço, falhando como uma porta fechada se não houver um
+func (n *MemoryNetwork) Dial(ctx context.Context, address string) (net.Conn, error) {
+	n.mu.Lock()
+	listener, exists := n.listeners[address]
+	n.mu.Unlock()
+	if !exists {
+		return nil, &net.OpError{Op: "dial", Net: "memory", Addr: memoryAddr(address), Err: ErrConnectionRefused}
+	}
+
+	client, server := net.Pipe()
+	clientConn := &memoryConn{Conn: client, local: memoryAddr("memory:" + strconv.Itoa(n.ephemeralPort())), remote: memoryAddr(address)}
+	serverConn := &memoryConn{Conn: server, local: memoryAddr(address), remote: clientConn.local}
+
+	select {
+	case listener.conns <- serverConn:
+		return clientConn, nil
+	case <-listener.closed:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "memory", Addr: memoryAddr(address), Err: ErrConnectionRefused}
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "memory", Addr: memoryAddr(address), Err: ctx.Err()}
+	}
+}
+
+// Função para escutar no endereço da rede em memória
+// Um endereço com porta 0 recebe a próxima porta livre, como no TCP
+func (n *MemoryNetwork) Listen(address string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "memory", Addr: memoryAddr(address), Err: err}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if port == "0" {
+		for {
+			address = net.JoinHostPort(host, strconv.Itoa(n.nextPort))
+			n.nextPort++
+			if _, exists := n.listeners[address]; !exists {
+				break
+			}
+		}
+	}
+	if _, exists := n.listeners[address]; exists {
+		return nil, &net.OpError{Op: "listen", Net: "memory", Addr: memoryAddr(address), Err: ErrAddressInUse}
+	}
+
+	listener := &memoryListener{network: n, address: address, conns: make(chan net.Conn), closed: make(chan struct{})}
+	n.listeners[address] = listener
+	return listener, nil
+}
+
+// Função para reservar uma porta para o lado de quem conecta, só para identificar a conexão
+func (n *MemoryNetwork) ephemeralPort() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	port := n.nextPort
+	n.nextPort++
+	return port
+}
+
+// Estrutura para um listener da rede em memória
+type memoryListener struct {
+	network *MemoryNetwork
+	address string
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// Função para esperar a próxima conexão, retornando net.ErrClosed depois do Close
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "memory", Addr: memoryAddr(l.address), Err: net.ErrClosed}
+	}
+}
+
+// Função para parar de escutar e liberar o endereço
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.network.mu.Lock()
+		if l.network.listeners[l.address] == l {
+			delete(l.network.listeners, l.address)
+		}
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+// Função para retornar o endereço escutado
+func (l *memoryListener) Addr() net.Addr {
+	return memoryAddr(l.address)
+}
+
+// Estrutura para uma ponta de conexão em memória, com os endereços de cada lado
+type memoryConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+// Função para retornar o endereço local da conexão
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// Função para retornar o endereço do outro lado da conexão
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Tipo para os endereços da rede em memória
+type memoryAddr string
+
+// Função para o nome da rede do endereço
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+// Função para o endereço no formato host:porta
+func (a memoryAddr) String() string {
+	return string(a)
+}
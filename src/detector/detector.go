@@ -0,0 +1,263 @@
+package detector
+
+// Pacotes nativos de go e pacotes internos
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"eachare/src/clock"
+	"eachare/src/connection"
+	"eachare/src/logger"
+	"eachare/src/message"
+	"eachare/src/peers"
+)
+
+// Valor de phi a partir do qual um peer sem resposta é marcado OFFLINE
+// Com phi 8, a chance de o peer estar vivo e só atrasado é de 1 em 10^8
+const PHI_THRESHOLD = 8.0
+
+// Quantidade de intervalos entre contatos guardados por peer para estimar o próximo
+const HEARTBEAT_WINDOW = 100
+
+// Tempo máximo de espera pela resposta de cada HELLO do detector
+const PROBE_TIMEOUT = 2 * time.Second
+
+// Maior espera entre duas sondagens de um peer OFFLINE, que dobra a cada sondagem sem resposta
+const MAX_PROBE_BACKOFF = 5 * time.Minute
+
+// Estrutura para o histórico de contatos com um peer, usado no detector phi-accrual
+// Os intervalos entre contatos seguem uma distribuição normal, e phi mede quão improvável é o silêncio atual
+// suspected indica que a suspeita desde o último contato já foi mostrada
+type History struct {
+	intervals []time.Duration
+	next      int
+	last      time.Time
+	minStdDev time.Duration
+	suspected bool
+}
+
+// Função para começar o histórico de um peer, como se ele tivesse sido visto em first
+// Os intervalos começam em torno do esperado, com desvio de um quarto dele, que também é o desvio mínimo
+func NewHistory(first time.Time, expected time.Duration) *History {
+	deviation := expected / 4
+	return &History{intervals: []time.Duration{expected - deviation, expected + deviation}, last: first, minStdDev: deviation}
+}
+
+// Função para registrar um contato com o peer, ignorando contatos anteriores ao último
+func (h *History) Heartbeat(at time.Time) {
+	if !at.After(h.last) {
+		return
+	}
+	interval := at.Sub(h.last)
+	h.last = at
+	h.suspected = false
+	if len(h.intervals) < HEARTBEAT_WINDOW {
+		h.intervals = append(h.intervals, interval)
+		return
+	}
+	h.intervals[h.next] = interval
+	h.next = (h.next + 1) % HEARTBEAT_WINDOW
+}
+
+// Função para retornar o último contato com o peer
+func (h *History) Last() time.Time {
+	return h.last
+}
+
+// Função para calcular phi, -log10 da chance de o próximo contato ainda chegar depois de tanto silêncio
+// Usa a aproximação logística da distribuição normal, como o detector phi-accrual do Akka
+func (h *History) Phi(at time.Time) float64 {
+	mean, variance := 0.0, 0.0
+	for _, interval := range h.intervals {
+		mean += float64(interval)
+	}
+	mean /= float64(len(h.intervals))
+	for _, interval := range h.intervals {
+		variance += (float64(interval) - mean) * (float64(interval) - mean)
+	}
+	stdDev := math.Max(math.Sqrt(variance/float64(len(h.intervals))), float64(h.minStdDev))
+
+	y := (float64(at.Sub(h.last)) - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if y > 0 {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// Estrutura para a próxima sondagem de um peer OFFLINE, com a espera que dobra a cada falha
+type retry struct {
+	at   time.Time
+	wait time.Duration
+}
+
+// Estrutura para o detector de falhas, que manda HELLO para os peers conhecidos a cada intervalo
+// Qualquer contato direto com o peer (LastSeen) conta como heartbeat, então só os peers em silêncio são sondados
+// Os peers OFFLINE são sondados com espera crescente, ver MAX_PROBE_BACKOFF
+type Detector struct {
+	knownPeers *peers.SafePeers
+	localClock *clock.Clock
+	address    string
+	interval   time.Duration
+	now        func() time.Time
+
+	mu        sync.Mutex
+	histories map[string]*History
+	retries   map[string]retry
+
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// Função para instanciar o detector de falhas do peer de endereço address
+func New(knownPeers *peers.SafePeers, localClock *clock.Clock, address string, interval time.Duration) *Detector {
+	return &Detector{
+		knownPeers: knownPeers,
+		localClock: localClock,
+		address:    address,
+		interval:   interval,
+		now:        time.Now,
+		histories:  make(map[string]*History),
+		retries:    make(map[string]retry),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// Função para rodar uma rodada a cada intervalo até o Stop, usando o pool atual do peer em cada uma
+func (d *Detector) Run(pool func() *connection.Pool) {
+	defer close(d.stopped)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.Round(pool())
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// Função para parar o detector, esperando a rodada em andamento terminar
+func (d *Detector) Stop() {
+	d.stopOnce.Do(func() { close(d.done) })
+	<-d.stopped
+}
+
+// Função para uma rodada do detector, sondando ao mesmo tempo os peers que não foram vistos no último intervalo
+func (d *Detector) Round(pool *connection.Pool) {
+	now := d.now()
+	var wg sync.WaitGroup
+	for _, peer := range d.knownPeers.GetAll() {
+		if peer.Address == d.address {
+			continue
+		}
+		history := d.history(peer, now)
+		if peer.Status == peers.ONLINE && now.Sub(history.Last()) < d.interval || !d.due(peer, now) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.probe(pool, peer, history)
+		}()
+	}
+	wg.Wait()
+}
+
+// Função para obter o histórico do peer, registrando o último contato direto com ele
+// Um peer ainda sem histórico começa a ser contado a partir de agora
+func (d *Detector) history(peer peers.Peer, now time.Time) *History {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	history, exists := d.histories[peer.Address]
+	if !exists {
+		first := peer.LastSeen
+		if first.IsZero() || first.After(now) {
+			first = now
+		}
+		history = NewHistory(first, d.interval)
+		d.histories[peer.Address] = history
+	}
+	history.Heartbeat(peer.LastSeen)
+	return history
+}
+
+// Função para verificar se já é hora de sondar o peer
+// Um peer ONLINE sempre pode ser sondado e esquece as esperas de quando estava OFFLINE
+func (d *Detector) due(peer peers.Peer, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if peer.Status == peers.ONLINE {
+		delete(d.retries, peer.Address)
+		return true
+	}
+	return !now.Before(d.retries[peer.Address].at)
+}
+
+// Função para adiar a próxima sondagem de um peer OFFLINE, dobrando a espera a partir de um intervalo
+func (d *Detector) backOff(address string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	wait := d.interval
+	if previous, exists := d.retries[address]; exists {
+		wait = min(2*previous.wait, MAX_PROBE_BACKOFF)
+	}
+	d.retries[address] = retry{at: now.Add(wait), wait: wait}
+}
+
+// Função para sondar um peer com HELLO e atualizar o seu status pelo resultado
+// A troca de mensagens só aparece no nível DEBUG, e apenas as mudanças de status são mostradas
+func (d *Detector) probe(pool *connection.Pool, peer peers.Peer, history *History) {
+	arguments := append(message.LocalCapabilities().Arguments(), message.HEARTBEAT_ARGUMENT)
+	sendMessage := message.BaseMessage{Origin: d.address, Clock: 0, Type: message.HELLO, Arguments: arguments}
+	ctx, cancel := context.WithTimeout(context.Background(), min(d.interval, PROBE_TIMEOUT))
+	receivedMessage, err := pool.Probe(ctx, d.knownPeers, sendMessage, peer.Address)
+	cancel()
+
+	now := d.now()
+	if err == nil {
+		d.mu.Lock()
+		history.Heartbeat(now)
+		delete(d.retries, peer.Address)
+		d.mu.Unlock()
+		if receivedMessage.Type == message.HELLO {
+			d.localClock.UpdateMaxWith(receivedMessage.Clock, receivedMessage.Vector, logger.Debug)
+			if capabilities, err := message.ParseCapabilities(receivedMessage.Arguments); err == nil {
+				d.knownPeers.SetCapabilities(peer.Address, capabilities)
+			}
+		}
+		if peer.Status == peers.OFFLINE {
+			logger.Info("Atualizando peer " + peer.Address + " status " + peers.ONLINE.String() + " (respondeu ao heartbeat)")
+		}
+		return
+	}
+
+	// Um peer já OFFLINE continua assim, e um ONLINE só cai quando o silêncio fica improvável demais
+	if peer.Status == peers.OFFLINE {
+		d.backOff(peer.Address, now)
+		return
+	}
+	d.mu.Lock()
+	phi, silence := history.Phi(now), now.Sub(history.Last())
+	suspected := history.suspected
+	history.suspected = true
+	d.mu.Unlock()
+	if phi < PHI_THRESHOLD {
+		// Só o começo da suspeita aparece, e as rodadas seguintes sem resposta ficam no nível DEBUG
+		log := logger.Info
+		if suspected {
+			log = logger.Debug
+		}
+		log(fmt.Sprintf("Suspeitando do peer %s: sem resposta há %.1fs (phi %.1f)", peer.Address, silence.Seconds(), phi))
+		return
+	}
+	d.knownPeers.RecordFailure(peer.Address)
+	d.backOff(peer.Address, now)
+	logger.Info(fmt.Sprintf("Atualizando peer %s status %s: sem resposta há %.1fs (phi %.1f)", peer.Address, peers.OFFLINE, silence.Seconds(), phi))
+}
@@ -0,0 +1,181 @@
+package detector
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"eachare/src/clock"
+	"eachare/src/connection"
+	"eachare/src/logger"
+	"eachare/src/message"
+	"eachare/src/peers"
+	"eachare/src/response"
+)
+
+func TestPhi(t *testing.T) {
+	start := time.Now()
+	history := NewHistory(start, time.Second)
+
+	// Phi cresce com o silêncio e só passa do limite bem depois do intervalo esperado
+	previous := -1.0
+	for _, elapsed := range []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second} {
+		phi := history.Phi(start.Add(elapsed))
+		if phi <= previous {
+			t.Errorf("Expected phi to grow with the silence, got %.2f after %.2f", phi, previous)
+		}
+		previous = phi
+	}
+	if phi := history.Phi(start.Add(time.Second)); phi >= 1 {
+		t.Errorf("Expected a low phi at the expected interval, got %.2f", phi)
+	}
+	if phi := history.Phi(start.Add(2 * time.Second)); phi >= PHI_THRESHOLD {
+		t.Errorf("Expected one missed heartbeat to stay below the threshold, got %.2f", phi)
+	}
+	if phi := history.Phi(start.Add(3 * time.Second)); phi < PHI_THRESHOLD {
+		t.Errorf("Expected two missed heartbeats to pass the threshold, got %.2f", phi)
+	}
+
+	// Contatos antigos são ignorados e a janela não passa do limite
+	history.Heartbeat(start.Add(-time.Second))
+	for i := 1; i <= 2*HEARTBEAT_WINDOW; i++ {
+		history.Heartbeat(start.Add(time.Duration(i) * time.Second))
+	}
+	if len(history.intervals) != HEARTBEAT_WINDOW || !history.Last().Equal(start.Add(2*HEARTBEAT_WINDOW*time.Second)) {
+		t.Errorf("Expected %d intervals and the last heartbeat kept, got %d and %v", HEARTBEAT_WINDOW, len(history.intervals), history.Last())
+	}
+}
+
+// Função para subir um peer que responde ao HELLO na rede em memória
+func startHelloPeer(t *testing.T, network *connection.MemoryNetwork, address string) {
+	listener, err := network.Listen(address)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var serverPeers peers.SafePeers
+	serverClock := clock.New()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				connection.Serve(&serverPeers, conn, func(receivedMessage message.BaseMessage, conn net.Conn) {
+					response.HelloResponse(&serverPeers, serverClock, receivedMessage, address, conn)
+				})
+			}()
+		}
+	}()
+}
+
+func TestDetectorRound(t *testing.T) {
+	network := connection.NewMemoryNetwork()
+	startHelloPeer(t, network, "127.0.0.1:9002")
+	startHelloPeer(t, network, "127.0.0.1:9004")
+
+	// 9002 responde, 9003 caiu sem avisar e 9004 voltou depois de ser marcado OFFLINE
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: "127.0.0.1:9002", Status: peers.ONLINE})
+	knownPeers.Add(peers.Peer{Address: "127.0.0.1:9003", Status: peers.ONLINE})
+	knownPeers.Add(peers.Peer{Address: "127.0.0.1:9004", Status: peers.OFFLINE})
+
+	localClock := clock.New()
+	detector := New(&knownPeers, localClock, "127.0.0.1:9001", time.Second)
+	now := time.Now()
+	detector.now = func() time.Time { return now }
+	pool := connection.NewPool(network, localClock)
+	defer pool.Close()
+
+	// Na primeira rodada os peers ONLINE acabaram de começar a ser contados, e só o OFFLINE é sondado
+	detector.Round(pool)
+	if entry, _ := knownPeers.Get("127.0.0.1:9004"); entry.Status != peers.ONLINE || !entry.Capabilities.Known() {
+		t.Errorf("Expected 9004 back ONLINE with its capabilities, got %+v", entry)
+	}
+
+	// Um heartbeat perdido só levanta suspeita, que aparece uma única vez no log
+	var buffer bytes.Buffer
+	logger.Flush()
+	logger.SetOutput(&buffer)
+	now = now.Add(time.Second)
+	detector.Round(pool)
+	now = now.Add(time.Second)
+	detector.Round(pool)
+	logger.Flush()
+	logger.SetOutput(nil)
+	if entry, _ := knownPeers.Get("127.0.0.1:9003"); entry.Status != peers.ONLINE || entry.Failures != 0 {
+		t.Errorf("Expected 9003 to be only suspected, got %+v", entry)
+	}
+	if count := strings.Count(buffer.String(), "Suspeitando do peer 127.0.0.1:9003"); count != 1 {
+		t.Errorf("Expected the suspicion of 9003 to be logged once, got %d times:\n%s", count, buffer.String())
+	}
+
+	// Com o silêncio improvável demais, o peer é marcado OFFLINE, e quem responde continua ONLINE
+	now = now.Add(time.Second)
+	detector.Round(pool)
+	if entry, _ := knownPeers.Get("127.0.0.1:9003"); entry.Status != peers.OFFLINE || entry.Failures != 1 {
+		t.Errorf("Expected 9003 OFFLINE after the silence, got %+v", entry)
+	}
+	if entry, _ := knownPeers.Get("127.0.0.1:9002"); entry.Status != peers.ONLINE || entry.LastSeen.IsZero() {
+		t.Errorf("Expected 9002 to stay ONLINE, got %+v", entry)
+	}
+
+	// Um peer já OFFLINE que continua sem responder não acumula falhas, e a espera até a próxima sondagem dobra
+	now = now.Add(time.Second)
+	detector.Round(pool)
+	if entry, _ := knownPeers.Get("127.0.0.1:9003"); entry.Status != peers.OFFLINE || entry.Failures != 1 {
+		t.Errorf("Expected 9003 to stay OFFLINE with one failure, got %+v", entry)
+	}
+	if next := detector.retries["127.0.0.1:9003"]; next.wait != 2*time.Second || !next.at.Equal(now.Add(2*time.Second)) {
+		t.Errorf("Expected the next probe of 9003 in 2s, got %+v", next)
+	}
+	now = now.Add(time.Second)
+	detector.Round(pool)
+	if next := detector.retries["127.0.0.1:9003"]; next.wait != 2*time.Second {
+		t.Errorf("Expected 9003 not to be probed before the wait, got %+v", next)
+	}
+	now = now.Add(time.Second)
+	detector.Round(pool)
+	if next := detector.retries["127.0.0.1:9003"]; next.wait != 4*time.Second {
+		t.Errorf("Expected the wait for 9003 to double to 4s, got %+v", next)
+	}
+
+	// A espera nunca passa do limite
+	for i := 0; i < 20; i++ {
+		detector.backOff("127.0.0.1:9003", now)
+	}
+	if next := detector.retries["127.0.0.1:9003"]; next.wait != MAX_PROBE_BACKOFF {
+		t.Errorf("Expected the wait to stop at %v, got %v", MAX_PROBE_BACKOFF, next.wait)
+	}
+}
+
+func TestDetectorRun(t *testing.T) {
+	network := connection.NewMemoryNetwork()
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: "127.0.0.1:9003", Status: peers.ONLINE})
+
+	localClock := clock.New()
+	pool := connection.NewPool(network, localClock)
+	defer pool.Close()
+	detector := New(&knownPeers, localClock, "127.0.0.1:9001", 20*time.Millisecond)
+	go detector.Run(func() *connection.Pool { return pool })
+
+	// Sem resposta, o peer acaba OFFLINE depois de algumas rodadas
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if entry, _ := knownPeers.Get("127.0.0.1:9003"); entry.Status == peers.OFFLINE {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the silent peer to be marked OFFLINE")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	detector.Stop()
+	detector.Stop()
+}
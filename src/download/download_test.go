@@ -0,0 +1,352 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"eachare/src/message"
+)
+
+// Transporte falso que entrega pedaços de content, com erros e atrasos escolhidos por origem
+type fakeTransport struct {
+	mu       sync.Mutex
+	content  []byte
+	unit     int
+	calls    map[string]int
+	active   map[string]int
+	delays   map[string]time.Duration
+	failures map[string]func(call int) error
+}
+
+func newFakeTransport(content []byte, unit int) *fakeTransport {
+	return &fakeTransport{
+		content:  content,
+		unit:     unit,
+		calls:    make(map[string]int),
+		active:   make(map[string]int),
+		delays:   make(map[string]time.Duration),
+		failures: make(map[string]func(call int) error),
+	}
+}
+
+func (f *fakeTransport) Fetch(ctx context.Context, origin string, index int, units int) ([]byte, error) {
+	f.mu.Lock()
+	f.calls[origin]++
+	f.active[origin]++
+	call, delay, failure := f.calls[origin], f.delays[origin], f.failures[origin]
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.active[origin]--
+		f.mu.Unlock()
+	}()
+
+	if index%units != 0 {
+		return nil, fmt.Errorf("unaligned block %d with %d units", index, units)
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if failure != nil {
+		if err := failure(call); err != nil {
+			return nil, err
+		}
+	}
+	start := index * f.unit
+	return f.content[start:min(start+units*f.unit, len(f.content))], nil
+}
+
+func (f *fakeTransport) count(origin string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[origin]
+}
+
+// Função para montar o arquivo a partir dos resultados, conferindo que nenhuma unidade chega duas vezes
+func collect(t *testing.T, results <-chan Result, size int, unit int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	seen := make(map[int]bool)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				return data
+			}
+			for i := result.Index; i < result.Index+result.Units; i++ {
+				if seen[i] {
+					t.Errorf("Unit %d delivered twice", i)
+				}
+				seen[i] = true
+			}
+			copy(data[result.Index*unit:], result.Data)
+		case <-timeout:
+			t.Fatalf("Download did not finish")
+		}
+	}
+}
+
+func countStates(states []ChunkState) map[ChunkState]int {
+	counts := make(map[ChunkState]int)
+	for _, state := range states {
+		counts[state]++
+	}
+	return counts
+}
+
+func testContent(units int, unit int) []byte {
+	content := make([]byte, units*unit-unit/2)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func TestEngineDownload(t *testing.T) {
+	content := testContent(100, 4)
+	transport := newFakeTransport(content, 4)
+	done := make([]bool, 100)
+	done[3] = true
+
+	engine := New(Config{Origins: []string{"peer:1", "peer:2", "peer:3"}, UnitSize: 4, Done: done, Transport: transport})
+	data := collect(t, engine.Start(context.Background()), len(content), 4)
+
+	copy(data[12:16], content[12:16])
+	if !bytes.Equal(data, content) {
+		t.Errorf("Downloaded content differs from the original")
+	}
+	if counts := countStates(engine.States()); counts[DONE] != 100 {
+		t.Errorf("Expected all units done, got %v", counts)
+	}
+	total := transport.count("peer:1") + transport.count("peer:2") + transport.count("peer:3")
+	if total < 99 {
+		t.Errorf("Expected at least 99 requests, got %d", total)
+	}
+}
+
+func TestEngineSlowOrigin(t *testing.T) {
+	// A origem lenta só responde quando a requisição é cancelada, então tudo depende da rápida e da reta final
+	content := testContent(20, 4)
+	transport := newFakeTransport(content, 4)
+	transport.delays["slow"] = time.Hour
+
+	start := time.Now()
+	engine := New(Config{Origins: []string{"slow", "fast"}, UnitSize: 4, Done: make([]bool, 20), Transport: transport})
+	data := collect(t, engine.Start(context.Background()), len(content), 4)
+
+	if !bytes.Equal(data, content) {
+		t.Errorf("Downloaded content differs from the original")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the fast origin to take over, took %v", elapsed)
+	}
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if transport.active["slow"] != 0 {
+		t.Errorf("Expected requests to the slow origin to be canceled, %d still running", transport.active["slow"])
+	}
+}
+
+func TestEngineOriginErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		discard bool
+	}{
+		{"file not found", message.RemoteError{Code: message.FILE_NOT_FOUND}, true},
+		{"bad index", message.RemoteError{Code: message.BAD_INDEX}, true},
+		{"corrupted", fmt.Errorf("%w: hash", ErrChunkIntegrity), true},
+		{"timeout", errors.New("timeout"), false},
+	}
+
+	for _, test := range tests {
+		content := testContent(3, 4)
+		transport := newFakeTransport(content, 4)
+		transport.failures["bad"] = func(int) error { return test.err }
+
+		// Sozinha, a origem com erro deixa o download incompleto
+		engine := New(Config{Origins: []string{"bad"}, UnitSize: 4, Done: make([]bool, 3), Transport: transport})
+		collect(t, engine.Start(context.Background()), len(content), 4)
+		if counts := countStates(engine.States()); counts[DONE] != 0 {
+			t.Errorf("%s: expected no units done, got %v", test.name, counts)
+		}
+		calls := transport.count("bad")
+		if test.discard && calls > 3 {
+			t.Errorf("%s: expected origin to be discarded on the first error, got %d requests", test.name, calls)
+		} else if !test.discard && calls < MAX_FAILURES_PER_ORIGIN {
+			t.Errorf("%s: expected origin to be retried %d times, got %d requests", test.name, MAX_FAILURES_PER_ORIGIN, calls)
+		}
+
+		// Com outra origem, os blocos que falharam são pedidos a ela
+		transport = newFakeTransport(content, 4)
+		transport.failures["bad"] = func(int) error { return test.err }
+		engine = New(Config{Origins: []string{"bad", "good"}, UnitSize: 4, Done: make([]bool, 3), Transport: transport})
+		data := collect(t, engine.Start(context.Background()), len(content), 4)
+		if !bytes.Equal(data, content) {
+			t.Errorf("%s: expected the good origin to deliver every block", test.name)
+		}
+	}
+}
+
+func TestEngineBusy(t *testing.T) {
+	content := testContent(1, 4)
+	transport := newFakeTransport(content, 4)
+	transport.failures["peer:1"] = func(call int) error {
+		if call <= 2 {
+			return message.RemoteError{Code: message.BUSY}
+		}
+		return nil
+	}
+
+	// BUSY não conta como falha do bloco nem da origem, então o bloco chega depois de esperar
+	engine := New(Config{Origins: []string{"peer:1"}, UnitSize: 4, Done: make([]bool, 1), Transport: transport})
+	start := time.Now()
+	data := collect(t, engine.Start(context.Background()), len(content), 4)
+	if !bytes.Equal(data, content) || engine.States()[0] != DONE {
+		t.Errorf("Expected block to arrive after the origin stops being busy, states %v", engine.States())
+	}
+	if elapsed := time.Since(start); elapsed < 2*BUSY_BACKOFF {
+		t.Errorf("Expected to wait BUSY_BACKOFF between attempts, took %v", elapsed)
+	}
+	if engine.retries[0] != 0 || engine.failures["peer:1"] != 0 {
+		t.Errorf("Expected BUSY not to count as a failure, got %d retries and %d failures", engine.retries[0], engine.failures["peer:1"])
+	}
+}
+
+func TestEngineGivesUp(t *testing.T) {
+	content := testContent(2, 4)
+	transport := newFakeTransport(content, 4)
+	origins := []string{"peer:1", "peer:2", "peer:3"}
+	for _, origin := range origins {
+		transport.failures[origin] = func(int) error { return errors.New("connection reset") }
+	}
+
+	engine := New(Config{Origins: origins, UnitSize: 4, Done: make([]bool, 2), Transport: transport})
+	collect(t, engine.Start(context.Background()), len(content), 4)
+	if counts := countStates(engine.States()); counts[FAILED] != 2 {
+		t.Errorf("Expected blocks to be given up, got %v", counts)
+	}
+}
+
+func TestEngineCancel(t *testing.T) {
+	content := testContent(10, 4)
+	transport := newFakeTransport(content, 4)
+	transport.delays["peer:1"] = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	engine := New(Config{Origins: []string{"peer:1"}, UnitSize: 4, Done: make([]bool, 10), Transport: transport})
+	results := engine.Start(ctx)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	collect(t, results, len(content), 4)
+
+	if counts := countStates(engine.States()); counts[PENDING] != 10 {
+		t.Errorf("Expected canceled blocks back to pending, got %v", counts)
+	}
+}
+
+func TestEnginePause(t *testing.T) {
+	content := testContent(4, 4)
+	transport := newFakeTransport(content, 4)
+	resume := make(chan struct{})
+	wait := func() bool {
+		<-resume
+		return true
+	}
+
+	engine := New(Config{Origins: []string{"peer:1"}, UnitSize: 4, Done: make([]bool, 4), Transport: transport, Wait: wait})
+	results := engine.Start(context.Background())
+	time.Sleep(20 * time.Millisecond)
+	if transport.count("peer:1") != 0 {
+		t.Errorf("Expected no requests while paused")
+	}
+	close(resume)
+	if data := collect(t, results, len(content), 4); !bytes.Equal(data, content) {
+		t.Errorf("Downloaded content differs from the original")
+	}
+}
+
+func TestEngineAdaptive(t *testing.T) {
+	content := testContent(64, 16)
+	transport := newFakeTransport(content, 16)
+
+	engine := New(Config{Origins: []string{"peer:1"}, UnitSize: 16, Done: make([]bool, 64), Adaptive: true, Limits: map[string]int{"peer:1": 64}, Transport: transport})
+	data := collect(t, engine.Start(context.Background()), len(content), 16)
+	if !bytes.Equal(data, content) {
+		t.Errorf("Downloaded content differs from the original")
+	}
+	if size := engine.AverageChunkSize(); size < 16 || size > 64 {
+		t.Errorf("Expected average chunk between 16 and 64 bytes, got %d", size)
+	}
+
+	// Os blocos ficam alinhados e só com unidades pendentes
+	engine = New(Config{Origins: []string{"peer:1"}, UnitSize: 16, Done: make([]bool, 8), Adaptive: true, Limits: map[string]int{"peer:1": 64}, Transport: transport})
+	engine.sizer.origins["peer:1"].level = 2
+	engine.states[5] = DONE
+	expected := [][2]int{{0, 4}, {4, 1}, {6, 2}}
+	for _, block := range expected {
+		index, units, found := engine.assign("peer:1")
+		if !found || index != block[0] || units != block[1] {
+			t.Errorf("Expected block %v, got %d with %d units", block, index, units)
+		}
+	}
+}
+
+func TestChunkSizer(t *testing.T) {
+	sizer := newChunkSizer(16, true, map[string]int{"peer:1": 64, "peer:2": 16})
+
+	// Respostas rápidas dobram o chunk até o limite da origem
+	for i := 0; i < 2*ADAPTIVE_GROW_AFTER; i++ {
+		units := sizer.units("peer:1")
+		sizer.observe("peer:1", units, 16*units, time.Millisecond, nil)
+	}
+	if sizes := sizer.sizes(); sizes["peer:1"] != 64 || sizes["peer:2"] != 16 {
+		t.Errorf("Expected peer:1 to grow to 64 and peer:2 to stay at 16, got %v", sizes)
+	}
+	sizer.observe("peer:1", 4, 64, time.Millisecond, nil)
+	sizer.observe("peer:1", 4, 64, time.Millisecond, nil)
+	if units := sizer.units("peer:1"); units != 4 {
+		t.Errorf("Expected peer:1 to stay at its limit of 4 units, got %d", units)
+	}
+
+	// Respostas lentas ou com erro diminuem o chunk
+	sizer.observe("peer:1", 4, 64, 3*ADAPTIVE_TARGET_LATENCY, nil)
+	sizer.observe("peer:1", 2, 0, time.Millisecond, errors.New("timeout"))
+	if size := sizer.sizes()["peer:1"]; size != 16 {
+		t.Errorf("Expected peer:1 to shrink to 16, got %d", size)
+	}
+
+	// Um chunk maior que não aumenta a vazão é abandonado
+	sizer = newChunkSizer(16, true, map[string]int{"peer:1": 64})
+	sizer.observe("peer:1", 1, 16, time.Millisecond, nil)
+	sizer.observe("peer:1", 1, 16, time.Millisecond, nil)
+	sizer.observe("peer:1", 2, 32, 100*time.Millisecond, nil)
+	sizer.observe("peer:1", 2, 32, 100*time.Millisecond, nil)
+	if sizer.sizes()["peer:1"] != 16 || sizer.origins["peer:1"].maxLevel != 0 {
+		t.Errorf("Expected peer:1 to go back to 16 bytes, got %v", sizer.sizes())
+	}
+	if sizer.averageChunkSize() != 24 {
+		t.Errorf("Expected average chunk of 24 bytes, got %d", sizer.averageChunkSize())
+	}
+	if sizer.rate("peer:1") <= 0 || sizer.rate("peer:2") != 0 {
+		t.Errorf("Expected a rate only for the origin that answered")
+	}
+
+	// Fora do modo adaptativo o chunk não muda
+	sizer = newChunkSizer(16, false, map[string]int{"peer:1": 64})
+	sizer.observe("peer:1", 1, 16, time.Millisecond, nil)
+	sizer.observe("peer:1", 1, 16, time.Millisecond, nil)
+	if sizer.units("peer:1") != 1 {
+		t.Errorf("Expected fixed chunk size without adaptive mode")
+	}
+}
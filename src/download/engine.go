@@ -0,0 +1,448 @@
+package download
+
+// Pacotes nativos de go e pacotes internos
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"eachare/src/logger"
+	"eachare/src/message"
+)
+
+// Quantidade máxima de requisições em andamento para cada origem
+const MAX_CONCURRENT_PER_MANAGER = 50
+
+// Quantidade de falhas até uma origem deixar de ser usada no download
+const MAX_FAILURES_PER_ORIGIN = 15
+
+// Quantidade de falhas até um bloco ser abandonado, deixando o download incompleto
+const MAX_RETRIES_PER_CHUNK = 15
+
+// Tempo que as requisições para uma origem ficam paradas depois de ela responder BUSY
+const BUSY_BACKOFF = 500 * time.Millisecond
+
+// Quantas origens podem estar baixando o mesmo bloco ao mesmo tempo na reta final do download
+const ENDGAME_COPIES = 2
+
+// Erro para um chunk cujo conteúdo não confere com o hash ou o tamanho esperados
+var ErrChunkIntegrity = errors.New("chunk corrompido")
+
+// Estados de uma unidade do download
+type ChunkState int
+
+const (
+	PENDING ChunkState = iota
+	IN_FLIGHT
+	DONE
+	FAILED
+)
+
+// Função para retornar a string do estado da unidade
+func (state ChunkState) String() string {
+	switch state {
+	case PENDING:
+		return "PENDENTE"
+	case IN_FLIGHT:
+		return "EM TRÂNSITO"
+	case DONE:
+		return "RECEBIDO"
+	case FAILED:
+		return "FALHOU"
+	default:
+		return "DESCONHECIDO"
+	}
+}
+
+// Interface para buscar um bloco numa origem
+// O bloco tem units unidades e começa na unidade index, que é sempre múltiplo de units.
+// O conteúdo retornado já deve estar conferido; conteúdo inválido é informado com ErrChunkIntegrity.
+type Transport interface {
+	Fetch(ctx context.Context, origin string, index int, units int) ([]byte, error)
+}
+
+// Estrutura com a configuração de um download
+// Done marca as unidades que já estão no disco. Limits é o maior chunk aceito por cada origem,
+// usado só no modo adaptativo. Wait, se existir, é chamada antes de cada pedido e bloqueia enquanto
+// o download estiver pausado, retornando falso se ele não deve continuar.
+type Config struct {
+	Origins   []string
+	UnitSize  int
+	Done      []bool
+	Adaptive  bool
+	Limits    map[string]int
+	Transport Transport
+	Wait      func() bool
+}
+
+// Estrutura para um bloco recebido, que cobre as unidades de Index até Index+Units-1
+type Result struct {
+	Index  int
+	Units  int
+	Data   []byte
+	Origin string
+}
+
+// Estrutura para um bloco em trânsito, com o cancelamento da requisição de cada origem que o está baixando
+type flight struct {
+	units   int
+	holders map[string]context.CancelFunc
+}
+
+// Estrutura para um manager pedindo o próximo bloco
+type askEvent struct {
+	origin string
+	reply  chan assignment
+}
+
+// Estrutura com a resposta do dono do estado para um manager
+type assignment struct {
+	index int
+	units int
+	ctx   context.Context
+	ok    bool
+}
+
+// Estrutura com o resultado da requisição de um bloco
+type fetchEvent struct {
+	origin  string
+	index   int
+	units   int
+	ctx     context.Context
+	data    []byte
+	elapsed time.Duration
+	err     error
+}
+
+// Estrutura do motor de download
+// Todo o estado (unidades, blocos em trânsito, falhas das origens) pertence a uma única goroutine,
+// que só muda a partir de eventos: um manager pedindo trabalho, uma requisição terminando ou um
+// manager saindo. Os managers de cada origem só fazem as requisições, sem tocar no estado.
+// Cada origem pega o próximo bloco livre quando tem uma vaga, então as mais rápidas pegam mais blocos.
+// Quando não há mais blocos livres, as origens ociosas repetem os blocos em trânsito de origens mais
+// lentas (a reta final), e a primeira resposta cancela as outras.
+type Engine struct {
+	cfg      Config
+	sizer    *chunkSizer
+	states   []ChunkState
+	cursor   int
+	inFlight map[int]*flight
+	retries  map[int]int
+	failures map[string]int
+	healthy  map[string]bool
+	contexts map[string]context.Context
+	cancels  map[string]context.CancelFunc
+	waiting  []askEvent
+	stopping bool
+	askCh    chan askEvent
+	fetchCh  chan fetchEvent
+	exitCh   chan string
+	results  chan Result
+}
+
+// Função para criar o motor de um download
+func New(cfg Config) *Engine {
+	limits := make(map[string]int, len(cfg.Origins))
+	for _, origin := range cfg.Origins {
+		limits[origin] = cfg.UnitSize
+		if limit, exists := cfg.Limits[origin]; exists {
+			limits[origin] = limit
+		}
+	}
+	e := &Engine{
+		cfg:      cfg,
+		sizer:    newChunkSizer(cfg.UnitSize, cfg.Adaptive, limits),
+		states:   make([]ChunkState, len(cfg.Done)),
+		inFlight: make(map[int]*flight),
+		retries:  make(map[int]int),
+		failures: make(map[string]int),
+		healthy:  make(map[string]bool, len(cfg.Origins)),
+		contexts: make(map[string]context.Context, len(cfg.Origins)),
+		cancels:  make(map[string]context.CancelFunc, len(cfg.Origins)),
+		askCh:    make(chan askEvent),
+		fetchCh:  make(chan fetchEvent),
+		exitCh:   make(chan string),
+		results:  make(chan Result, len(cfg.Done)),
+	}
+	for i, done := range cfg.Done {
+		if done {
+			e.states[i] = DONE
+		}
+	}
+	return e
+}
+
+// Função para começar o download, com um manager para cada origem
+// O canal retornado recebe cada bloco uma única vez e é fechado quando não há mais o que pedir,
+// quando todas as origens deixaram de ser saudáveis ou quando ctx é cancelado.
+func (e *Engine) Start(ctx context.Context) <-chan Result {
+	for _, origin := range e.cfg.Origins {
+		originCtx, cancel := context.WithCancel(ctx)
+		e.healthy[origin] = true
+		e.contexts[origin] = originCtx
+		e.cancels[origin] = cancel
+		go e.manager(originCtx, origin)
+	}
+	go e.run(ctx)
+	return e.results
+}
+
+// Função do dono do estado, que trata os eventos até todos os managers saírem
+func (e *Engine) run(ctx context.Context) {
+	defer close(e.results)
+	running := len(e.cfg.Origins)
+	stop := ctx.Done()
+	for running > 0 {
+		select {
+		case ask := <-e.askCh:
+			e.waiting = append(e.waiting, ask)
+		case event := <-e.fetchCh:
+			e.handle(event)
+		case origin := <-e.exitCh:
+			e.cancels[origin]()
+			running--
+		case <-stop:
+			e.stopping = true
+			stop = nil
+		}
+		e.serve()
+	}
+}
+
+// Função para responder os managers que estão esperando um bloco
+func (e *Engine) serve() {
+	waiting := e.waiting[:0]
+	for _, ask := range e.waiting {
+		if e.stopping || !e.healthy[ask.origin] || e.finished() {
+			ask.reply <- assignment{}
+		} else if index, units, found := e.assign(ask.origin); found {
+			ask.reply <- assignment{index: index, units: units, ctx: e.hold(index, ask.origin), ok: true}
+		} else {
+			waiting = append(waiting, ask)
+		}
+	}
+	e.waiting = waiting
+}
+
+// Função para avançar o cursor até a primeira unidade pendente
+func (e *Engine) advance() {
+	for e.cursor < len(e.states) && e.states[e.cursor] != PENDING {
+		e.cursor++
+	}
+}
+
+// Função para verificar se não há mais unidades pendentes nem blocos em trânsito
+func (e *Engine) finished() bool {
+	e.advance()
+	return e.cursor == len(e.states) && len(e.inFlight) == 0
+}
+
+// Função para escolher o bloco da origem: o próximo bloco livre ou, na reta final, a cópia de um bloco em trânsito
+// Um bloco de 2^n unidades sempre começa num índice múltiplo de 2^n, para que a origem o encontre pelo
+// índice em chunks do mesmo tamanho, e ele é reduzido até ter só unidades pendentes.
+func (e *Engine) assign(origin string) (int, int, bool) {
+	e.advance()
+	if e.cursor < len(e.states) {
+		index := e.cursor
+		units := e.sizer.units(origin)
+		for units > 1 && (index%units != 0 || index+units > len(e.states) || slices.ContainsFunc(e.states[index:index+units], func(state ChunkState) bool { return state != PENDING })) {
+			units /= 2
+		}
+		for unit := index; unit < index+units; unit++ {
+			e.states[unit] = IN_FLIGHT
+		}
+		e.inFlight[index] = &flight{units: units, holders: make(map[string]context.CancelFunc)}
+		return index, units, true
+	}
+
+	// Só vale a pena repetir um bloco se nenhuma origem com ele já se mostrou tão rápida quanto essa
+	rate := e.sizer.rate(origin)
+	for _, index := range slices.Sorted(maps.Keys(e.inFlight)) {
+		f := e.inFlight[index]
+		if _, exists := f.holders[origin]; exists || len(f.holders) >= ENDGAME_COPIES {
+			continue
+		}
+		slower := true
+		for holder := range f.holders {
+			if holderRate := e.sizer.rate(holder); holderRate > 0 && holderRate >= rate {
+				slower = false
+				break
+			}
+		}
+		if slower {
+			return index, f.units, true
+		}
+	}
+	return 0, 0, false
+}
+
+// Função para registrar a requisição da origem para o bloco
+// O contexto da requisição acaba se outra origem entregar o bloco antes ou se a origem deixar de ser usada
+func (e *Engine) hold(index int, origin string) context.Context {
+	ctx, cancel := context.WithCancel(e.contexts[origin])
+	e.inFlight[index].holders[origin] = cancel
+	return ctx
+}
+
+// Função para tratar o resultado de uma requisição
+func (e *Engine) handle(event fetchEvent) {
+	canceled := event.ctx.Err() != nil
+	f, exists := e.inFlight[event.index]
+	if exists {
+		if release, holding := f.holders[event.origin]; holding {
+			release()
+			delete(f.holders, event.origin)
+		}
+	}
+
+	switch {
+	case event.err == nil:
+		e.sizer.observe(event.origin, event.units, len(event.data), event.elapsed, nil)
+		if !exists {
+			// Outra origem já tinha entregado o bloco.
+			return
+		}
+		for _, release := range f.holders {
+			release()
+		}
+		delete(e.inFlight, event.index)
+		for unit := event.index; unit < event.index+f.units; unit++ {
+			e.states[unit] = DONE
+		}
+		e.results <- Result{Index: event.index, Units: f.units, Data: event.data, Origin: event.origin}
+	case !exists:
+		// O bloco chegou por outra origem, então o erro dessa cópia não importa.
+	case canceled:
+		// A origem deixou de ser usada ou o download foi cancelado, então não é uma falha do bloco.
+		e.release(event.index, f, event.origin, false)
+	default:
+		e.sizer.observe(event.origin, event.units, 0, event.elapsed, event.err)
+		e.release(event.index, f, event.origin, e.judge(event.origin, event.index, event.err))
+	}
+}
+
+// Função para decidir o que o erro diz sobre a origem
+// Retorna se a falha conta para o limite de tentativas do bloco. BUSY é temporário e não conta.
+func (e *Engine) judge(origin string, index int, err error) bool {
+	// Erros informados pela própria origem dizem se vale a pena tentar de novo com ela.
+	var remoteErr message.RemoteError
+	if errors.As(err, &remoteErr) {
+		logger.Debug(fmt.Sprintf("Chunk %d: %s", index, remoteErr.Error()))
+		switch remoteErr.Code {
+		case message.BUSY:
+			return false
+		case message.FILE_NOT_FOUND, message.BAD_INDEX:
+			// A origem não tem o arquivo (ou não tem esse pedaço), então não adianta insistir nela.
+			e.discard(origin)
+		}
+	}
+
+	// Uma origem que mandou conteúdo corrompido não é mais usada nesse download.
+	if errors.Is(err, ErrChunkIntegrity) {
+		logger.Debug(fmt.Sprintf("Chunk %d: %s", index, err.Error()))
+		e.discard(origin)
+	}
+
+	e.failures[origin]++
+	if e.failures[origin] >= MAX_FAILURES_PER_ORIGIN {
+		e.discard(origin)
+	}
+	return true
+}
+
+// Função para deixar de usar a origem, cancelando as requisições dela
+func (e *Engine) discard(origin string) {
+	if e.healthy[origin] {
+		e.healthy[origin] = false
+		e.cancels[origin]()
+	}
+}
+
+// Função para devolver o bloco que a origem não entregou
+// Com count, a falha conta para MAX_RETRIES_PER_CHUNK, mesmo que outra origem ainda esteja com o bloco.
+// Quando nenhuma origem estiver com ele, o bloco volta para a fila ou, passado o limite, fica faltando
+// e o download termina incompleto.
+func (e *Engine) release(index int, f *flight, origin string, count bool) {
+	if count {
+		e.retries[index]++
+	}
+	if len(f.holders) > 0 {
+		return
+	}
+	delete(e.inFlight, index)
+	state := PENDING
+	if e.retries[index] > MAX_RETRIES_PER_CHUNK {
+		logger.Debug(fmt.Sprintf("Chunk %d failed more than %d times. Giving up on it. Last failing origin: %s", index, MAX_RETRIES_PER_CHUNK, origin))
+		state = FAILED
+	}
+	for unit := index; unit < index+f.units; unit++ {
+		e.states[unit] = state
+	}
+	e.cursor = min(e.cursor, index)
+}
+
+// Função do manager de uma origem, que pede blocos com até MAX_CONCURRENT_PER_MANAGER requisições ao mesmo tempo
+func (e *Engine) manager(ctx context.Context, origin string) {
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		e.exitCh <- origin
+	}()
+
+	// Depois de um BUSY, nenhuma requisição para a origem sai antes de busyUntil
+	var busyUntil atomic.Int64
+	sem := make(chan struct{}, MAX_CONCURRENT_PER_MANAGER)
+	reply := make(chan assignment, 1)
+	for {
+		sem <- struct{}{}
+		// Com o download pausado, o manager espera aqui, e com ele cancelado não pede mais nada.
+		if ctx.Err() != nil || (e.cfg.Wait != nil && !e.cfg.Wait()) {
+			return
+		}
+		e.askCh <- askEvent{origin: origin, reply: reply}
+		work := <-reply
+		if !work.ok {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if wait := time.Until(time.Unix(0, busyUntil.Load())); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-work.ctx.Done():
+				}
+			}
+			start := time.Now()
+			data, err := e.cfg.Transport.Fetch(work.ctx, origin, work.index, work.units)
+
+			// A origem está sobrecarregada, então as próximas requisições para ela esperam um pouco.
+			var remoteErr message.RemoteError
+			if errors.As(err, &remoteErr) && remoteErr.Code == message.BUSY {
+				busyUntil.Store(time.Now().Add(BUSY_BACKOFF).UnixNano())
+			}
+			e.fetchCh <- fetchEvent{origin: origin, index: work.index, units: work.units, ctx: work.ctx, data: data, elapsed: time.Since(start), err: err}
+		}()
+	}
+}
+
+// Função para obter o estado de cada unidade, depois que o canal de resultados fechar
+func (e *Engine) States() []ChunkState {
+	return slices.Clone(e.states)
+}
+
+// Função para obter o tamanho médio dos blocos recebidos, em bytes
+func (e *Engine) AverageChunkSize() int {
+	return e.sizer.averageChunkSize()
+}
+
+// Função para descrever o chunk escolhido para cada origem
+func (e *Engine) ChunkSizes() string {
+	return e.sizer.String()
+}
@@ -0,0 +1,160 @@
+package download
+
+// Pacotes nativos de go e pacotes internos
+import (
+	"fmt"
+	"maps"
+	"math/bits"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tamanho do primeiro pedido a cada origem no modo adaptativo, que também é a menor unidade do diário
+const ADAPTIVE_PROBE_SIZE = 16 * 1024
+
+// Tempo de resposta desejado para um chunk: abaixo dele o chunk da origem cresce, acima do dobro ele diminui
+const ADAPTIVE_TARGET_LATENCY = 500 * time.Millisecond
+
+// Quantidade de respostas rápidas seguidas antes de dobrar o chunk de uma origem
+const ADAPTIVE_GROW_AFTER = 2
+
+// Peso da última medida na média de vazão de cada tamanho de chunk
+const ADAPTIVE_RATE_WEIGHT = 0.3
+
+// Estrutura com o tamanho de chunk atual de uma origem, como potência de 2 da unidade do download
+// rates guarda a vazão média (bytes por segundo) observada em cada nível, e rate a de todos eles juntos
+type originSizer struct {
+	level    int
+	maxLevel int
+	fast     int
+	rates    []float64
+	rate     float64
+}
+
+// Estrutura que escolhe quantas unidades pedir a cada origem, sempre uma potência de 2
+type chunkSizer struct {
+	mu       sync.Mutex
+	unit     int
+	origins  map[string]*originSizer
+	requests int
+	bytes    int64
+}
+
+// Função para criar o seletor de tamanho de chunk do download
+// limits é o maior chunk aceito por cada origem; fora do modo adaptativo, todas as origens ficam na unidade
+func newChunkSizer(unit int, adaptive bool, limits map[string]int) *chunkSizer {
+	cs := &chunkSizer{unit: unit, origins: make(map[string]*originSizer, len(limits))}
+	for origin, limit := range limits {
+		maxLevel := 0
+		for adaptive && unit<<(maxLevel+1) <= limit {
+			maxLevel++
+		}
+		cs.origins[origin] = &originSizer{maxLevel: maxLevel, rates: make([]float64, maxLevel+1)}
+	}
+	return cs
+}
+
+// Função para obter o tamanho do bloco que a origem deve receber agora, em unidades
+func (cs *chunkSizer) units(origin string) int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if state, exists := cs.origins[origin]; exists {
+		return 1 << state.level
+	}
+	return 1
+}
+
+// Função para ajustar o chunk da origem a partir de uma resposta de units unidades
+// Respostas rápidas fazem o chunk dobrar, enquanto respostas lentas ou com erro fazem ele cair pela metade.
+// Se dobrar o chunk não aumentou a vazão, a origem volta para o tamanho anterior e não tenta crescer de novo.
+func (cs *chunkSizer) observe(origin string, units int, size int, elapsed time.Duration, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	state, exists := cs.origins[origin]
+	if !exists {
+		return
+	}
+	if err != nil {
+		state.fast = 0
+		state.level = max(state.level-1, 0)
+		return
+	}
+
+	cs.requests++
+	cs.bytes += int64(size)
+	level := min(bits.Len(uint(units))-1, state.maxLevel)
+	if elapsed > 0 {
+		rate := float64(size) / elapsed.Seconds()
+		if state.rates[level] == 0 {
+			state.rates[level] = rate
+		} else {
+			state.rates[level] += ADAPTIVE_RATE_WEIGHT * (rate - state.rates[level])
+		}
+		if state.rate == 0 {
+			state.rate = rate
+		} else {
+			state.rate += ADAPTIVE_RATE_WEIGHT * (rate - state.rate)
+		}
+	}
+
+	switch {
+	case elapsed > 2*ADAPTIVE_TARGET_LATENCY:
+		state.fast = 0
+		state.level = max(state.level-1, 0)
+	case elapsed < ADAPTIVE_TARGET_LATENCY && level == state.level:
+		state.fast++
+		if state.fast < ADAPTIVE_GROW_AFTER || state.level >= state.maxLevel {
+			return
+		}
+		state.fast = 0
+		if state.level > 0 && state.rates[state.level] < state.rates[state.level-1] {
+			state.level--
+			state.maxLevel = state.level
+			return
+		}
+		state.level++
+	}
+}
+
+// Função para obter a vazão média da origem em bytes por segundo, 0 se ela ainda não respondeu
+func (cs *chunkSizer) rate(origin string) float64 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if state, exists := cs.origins[origin]; exists {
+		return state.rate
+	}
+	return 0
+}
+
+// Função para obter o chunk atual de cada origem, em bytes
+func (cs *chunkSizer) sizes() map[string]int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	sizes := make(map[string]int, len(cs.origins))
+	for origin, state := range cs.origins {
+		sizes[origin] = cs.unit << state.level
+	}
+	return sizes
+}
+
+// Função para obter o tamanho médio dos chunks recebidos, em bytes
+func (cs *chunkSizer) averageChunkSize() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.requests == 0 {
+		return cs.unit
+	}
+	return int(cs.bytes / int64(cs.requests))
+}
+
+// Função para descrever o chunk escolhido para cada origem
+func (cs *chunkSizer) String() string {
+	sizes := cs.sizes()
+	parts := make([]string, 0, len(sizes))
+	for _, origin := range slices.Sorted(maps.Keys(sizes)) {
+		parts = append(parts, fmt.Sprintf("%s %d", origin, sizes[origin]))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -15,29 +15,53 @@ import (
 	"eachare/src/clock"
 	"eachare/src/commands"
 	"eachare/src/connection"
+	"eachare/src/detector"
 	"eachare/src/logger"
 	"eachare/src/message"
 	"eachare/src/peers"
 	"eachare/src/response"
 )
 
+// Opções aceitas depois dos argumentos de entrada
+// FAULTS_FLAG é a opção de depuração que injeta falhas nas mensagens, ex.: --faults="kind=drop,p=0.1,type=FILE;seed=7"
+// CLOCK_FLAG escolhe o tipo de relógio do peer: lamport (padrão), vector ou hybrid, ex.: --clock=vector
+// DATA_FLAG é o diretório onde o estado do peer é guardado entre execuções, ex.: --data=../data/peer1
+// HEARTBEAT_FLAG liga o detector de falhas com o intervalo entre as rodadas, ex.: --heartbeat=5s
+const (
+	FAULTS_FLAG    = "--faults="
+	CLOCK_FLAG     = "--clock="
+	DATA_FLAG      = "--data="
+	HEARTBEAT_FLAG = "--heartbeat="
+)
+
 // Estrutura do peer próprio
 type Client struct {
 	address    string
 	neighbors  string
 	shared     string
 	knownPeers *peers.SafePeers
+	clock      *clock.Clock
+	transport  connection.Transport
+	pool       *connection.Pool
+	jobs       *commands.Jobs
 	waitingCli bool
 	chunkSize  int
+	state      *persistence
+	detector   *detector.Detector
 }
 
-// Função para instanciar o cliente
-func NewClient(address string, neighbors string, shared string) Client {
+// Função para instanciar o cliente, que abre e recebe conexões pelo transporte recebido
+func NewClient(address string, neighbors string, shared string, transport connection.Transport) Client {
+	localClock := clock.New()
 	return Client{
 		address:    address,
 		neighbors:  neighbors,
 		shared:     shared,
 		knownPeers: &peers.SafePeers{},
+		clock:      localClock,
+		transport:  transport,
+		pool:       connection.NewPool(transport, localClock),
+		jobs:       commands.NewJobs(commands.MAX_ACTIVE_DOWNLOADS),
 		waitingCli: false,
 		chunkSize:  256,
 	}
@@ -53,10 +77,11 @@ func check(err error) {
 // Função para modo de teste, simulando a execução do programa com argumentos específicos
 func testArgs() *Client {
 	// Vai testando portas diferentes até encontrar uma livre
+	transport := &connection.TCPTransport{}
 	counter := 0
 	for {
 		counter++
-		listener, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(counter+10000))
+		listener, err := transport.Listen("127.0.0.1:" + strconv.Itoa(counter+10000))
 		if err == nil {
 			listener.Close()
 			break
@@ -64,7 +89,7 @@ func testArgs() *Client {
 	}
 
 	// Cria o cliente com os parâmetros de teste
-	client := NewClient("127.0.0.1:"+strconv.Itoa(counter+10000), "Vizinhos teste", "../data/shared"+strconv.Itoa(counter)+"/")
+	client := NewClient("127.0.0.1:"+strconv.Itoa(counter+10000), "Vizinhos teste", "../data/shared"+strconv.Itoa(counter)+"/", transport)
 
 	// Cria o diretório compartilhado se não existir
 	err := os.MkdirAll(client.shared, 0755)
@@ -105,10 +130,58 @@ func getArgs(args []string) *Client {
 	}
 
 	// Define os parâmetros se estiverem corretos
-	client := NewClient(args[1], args[2], args[3])
+	client := NewClient(args[1], args[2], args[3], &connection.TCPTransport{})
 	return &client
 }
 
+// Função para separar as opções (--faults=, --clock=, --data=, --heartbeat=) dos demais argumentos, retornando o valor de cada opção
+func splitOptions(args []string) ([]string, map[string]string) {
+	var rest []string
+	options := make(map[string]string)
+	for _, arg := range args {
+		isOption := false
+		for _, flag := range []string{FAULTS_FLAG, CLOCK_FLAG, DATA_FLAG, HEARTBEAT_FLAG} {
+			if value, found := strings.CutPrefix(arg, flag); found {
+				options[flag] = value
+				isOption = true
+			}
+		}
+		if !isOption {
+			rest = append(rest, arg)
+		}
+	}
+	return rest, options
+}
+
+// Função para trocar o tipo de relógio do peer, o que só pode ser feito antes de trocar mensagens
+func (c *Client) useClock(mode clock.Mode) {
+	c.clock = clock.NewWithMode(mode, c.address)
+	c.pool = connection.NewPool(c.transport, c.clock)
+}
+
+// Função para injetar falhas nas mensagens do peer, usada para depurar retries e trocas de origem
+func (c *Client) injectFaults(spec string) {
+	rules, seed, err := connection.ParseFaultRules(spec)
+	check(err)
+	c.transport = connection.NewFaultInjector(c.transport, seed, rules...)
+	c.pool = connection.NewPool(c.transport, c.clock)
+	logger.Std(fmt.Sprintf("Injetando falhas com %d regras (semente %d)\n", len(rules), seed))
+}
+
+// Função para ligar o detector de falhas, que manda HELLO para os peers em silêncio a cada intervalo
+// Deve ser chamada depois das demais opções, já que usa o relógio do peer
+func (c *Client) startHeartbeat(interval time.Duration) {
+	c.detector = detector.New(c.knownPeers, c.clock, c.address, interval)
+	go c.detector.Run(func() *connection.Pool { return c.pool })
+}
+
+// Função para desligar o detector de falhas, se estiver ligado
+func (c *Client) stopHeartbeat() {
+	if c.detector != nil {
+		c.detector.Stop()
+	}
+}
+
 // Função para adicionar vizinhos conhecidos a partir de um arquivo
 func (c *Client) addNeighbors() {
 	// Abre o arquivo de vizinhos
@@ -141,6 +214,7 @@ func cliInterface(client *Client, statistics *[]commands.Statistic) {
 	for !exit {
 		// Indica que a CLI está esperando por uma entrada
 		client.waitingCli = true
+		logger.SetPrompt(true)
 
 		// Imprime o menu de opções
 		logger.Std("\nEscolha um comando:\n")
@@ -150,28 +224,37 @@ func cliInterface(client *Client, statistics *[]commands.Statistic) {
 		logger.Std("\t[4] Buscar arquivos\n")
 		logger.Std("\t[5] Exibir estatisticas\n")
 		logger.Std("\t[6] Alterar tamanho de chunk\n")
+		logger.Std("\t[7] Retomar downloads\n")
+		logger.Std("\t[8] Downloads em andamento\n")
 		logger.Std("\t[9] Sair\n> ")
 
 		// Lê a entrada do usuário
 		fmt.Scanln(&comm)
+		logger.SetPrompt(false)
 		logger.Std("\n")
 
 		// Executa o comando correspondente
 		switch comm {
 		case "1":
-			commands.ListPeers(client.knownPeers, client.address)
+			commands.ListPeers(client.knownPeers, client.clock, client.pool, client.address)
 		case "2":
-			commands.GetPeersRequest(client.knownPeers, client.address)
+			commands.GetPeersRequest(client.knownPeers, client.clock, client.pool, client.address)
 		case "3":
 			commands.ListLocalFiles(client.shared)
 		case "4":
-			commands.LsRequest(client.knownPeers, client.address, client.shared, client.chunkSize, statistics)
+			commands.LsRequest(client.knownPeers, client.clock, client.pool, client.jobs, client.address, client.shared, client.chunkSize, statistics)
 		case "5":
 			commands.ShowStatistics(statistics)
 		case "6":
 			commands.ChangeChunk(&client.chunkSize)
+		case "7":
+			commands.ResumeMenu(client.knownPeers, client.clock, client.pool, client.jobs, client.address, client.shared, client.chunkSize, statistics)
+		case "8":
+			commands.JobsMenu(client.jobs)
 		case "9":
-			commands.ByeRequest(client.knownPeers, client.address)
+			client.stopHeartbeat()
+			commands.ByeRequest(client.knownPeers, client.pool, client.address)
+			client.clock.Checkpoint()
 			exit = true
 		default:
 			logger.Std("Comando inválido, tente novamente.\n")
@@ -188,16 +271,27 @@ func cliInterface(client *Client, statistics *[]commands.Statistic) {
 
 // Função para iniciar o peer e escutar conexões
 func listener(client *Client) {
-	// Cria um listener TCP no endereço e porta especificado
-	listener, err := net.Listen("tcp", client.address)
+	// Cria um listener no endereço e porta especificado, pelo transporte do cliente
+	listener, err := client.transport.Listen(client.address)
 	check(err)
 	defer listener.Close()
+	accept(client, listener)
+}
 
+// Função para receber as conexões do listener até ele ser fechado
+func accept(client *Client, listener net.Listener) {
 	// Loop para receber mensagens de outros peers
 	for {
 		// Accept trava o programa até receber uma conexão
+		// Um erro em uma conexão não pode derrubar o listener, então apenas é registrado
 		conn, err := listener.Accept()
-		check(err)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			logger.Error("Falha ao aceitar conexão: " + err.Error())
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
 
 		// Cria uma goroutine/thread para lidar com a conexão recebida
 		go receiver(conn, client)
@@ -209,40 +303,53 @@ func receiver(conn net.Conn, client *Client) {
 	// defer (adia) o fechamento da conexão até o final da função
 	defer conn.Close()
 
-	// Recebe a mensagem da conexão recebida
-	receivedMessage := connection.ReceiveMessage(client.knownPeers, conn)
+	// Atende a conexão, que pode trazer uma única mensagem ou uma sessão com várias requisições
+	connection.Serve(client.knownPeers, conn, func(receivedMessage message.BaseMessage, reply net.Conn) {
+		handleMessage(client, receivedMessage, reply)
+	})
+}
+
+// Função para lidar com uma mensagem recebida, escrevendo a resposta em conn
+func handleMessage(client *Client, receivedMessage message.BaseMessage, conn net.Conn) {
+	// Os HELLO do detector de falhas só aparecem no nível DEBUG, para não encher a CLI a cada rodada
+	log := logger.Info
+	if message.IsHeartbeat(receivedMessage) {
+		log = logger.Debug
+	}
 
 	// Se a CLI está esperando por uma entrada formata
-	if client.waitingCli {
+	if client.waitingCli && !message.IsHeartbeat(receivedMessage) {
 		logger.Std("\n\n")
 	}
-	logger.Info("Mensagem recebida: \"" + receivedMessage.String() + "\"")
+	log("Mensagem recebida: \"" + receivedMessage.String() + "\"")
 
 	// Atualiza o relógio local comparando o valor local e recebido
-	clock.UpdateMaxClock(receivedMessage.Clock)
+	client.clock.UpdateMaxWith(receivedMessage.Clock, receivedMessage.Vector, log)
 
 	// Mostra mensagem de adição se não tinha o peer e atualização se tinha não é BYE
 	neighbor, exists := client.knownPeers.Get(receivedMessage.Origin)
 	if !exists {
 		logger.Info("Adicionando novo peer " + receivedMessage.Origin + " status " + peers.ONLINE.String())
 	} else if receivedMessage.Type != message.BYE {
-		logger.Info("Atualizando peer " + receivedMessage.Origin + " status " + peers.ONLINE.String())
+		log("Atualizando peer " + receivedMessage.Origin + " status " + peers.ONLINE.String())
 	}
 
 	// Lida o comando recebido de acordo com o tipo de mensagem
 	switch receivedMessage.Type {
+	case message.HELLO:
+		response.HelloResponse(client.knownPeers, client.clock, receivedMessage, client.address, conn)
 	case message.GET_PEERS:
-		response.GetPeersResponse(client.knownPeers, receivedMessage.Origin, client.address, conn)
+		response.GetPeersResponse(client.knownPeers, client.clock, receivedMessage.Origin, client.address, conn)
 	case message.LS:
-		response.LsResponse(client.knownPeers, receivedMessage.Origin, client.address, client.shared, conn)
+		response.LsResponse(client.knownPeers, client.clock, receivedMessage.Origin, client.address, client.shared, conn)
 	case message.DL:
-		response.DlResponse(client.knownPeers, receivedMessage, client.address, client.shared, conn)
+		response.DlResponse(client.knownPeers, client.clock, receivedMessage, client.address, client.shared, conn)
 	case message.BYE:
 		response.ByeResponse(client.knownPeers, receivedMessage.Origin, neighbor.Clock)
 	}
 
 	// Verifica se a CLI está esperando por uma entrada
-	if client.waitingCli {
+	if client.waitingCli && !message.IsHeartbeat(receivedMessage) {
 		logger.Std("\n> ")
 	}
 }
@@ -252,13 +359,33 @@ func main() {
 	// Cria os valores iniciais do cliente a partir dos argumentos de entrada ou do modo de teste
 	var client *Client
 
-	if len(os.Args) == 2 && os.Args[1] == "--test" {
+	args, options := splitOptions(os.Args)
+	if len(args) == 2 && args[1] == "--test" {
 		client = testArgs()
 	} else {
-		client = getArgs(os.Args)
+		client = getArgs(args)
 		client.addNeighbors()
 		client.verifySharedDirectory()
 	}
+	if value, exists := options[CLOCK_FLAG]; exists {
+		mode, err := clock.GetMode(value)
+		check(err)
+		client.useClock(mode)
+	}
+	if dir := options[DATA_FLAG]; dir != "" {
+		check(client.usePersistence(dir))
+	}
+	if faults := options[FAULTS_FLAG]; faults != "" {
+		client.injectFaults(faults)
+	}
+	if value, exists := options[HEARTBEAT_FLAG]; exists {
+		interval, err := time.ParseDuration(value)
+		if err == nil && interval <= 0 {
+			err = errors.New("intervalo do heartbeat precisa ser positivo: " + value)
+		}
+		check(err)
+		client.startHeartbeat(interval)
+	}
 
 	var statistics []commands.Statistic
 
@@ -1,6 +1,22 @@
 package main
 
-import "testing"
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"eachare/src/clock"
+	"eachare/src/commands"
+	"eachare/src/connection"
+	"eachare/src/files"
+	"eachare/src/message"
+	"eachare/src/peers"
+	"eachare/src/state"
+)
 
 func TestGetArgs(t *testing.T) {
 	client := getArgs([]string{"eachare", "localhost:8080", "../neighbors/n1.txt", "../shared"})
@@ -20,3 +36,525 @@ func TestGetArgs(t *testing.T) {
 		t.Errorf("Expected: %s, got: %s", "../shared", client.shared)
 	}
 }
+
+func TestSimulationSearchDownloadBye(t *testing.T) {
+	simulation := NewSimulation(t.TempDir())
+	defer simulation.Close()
+
+	// A conhece B, B conhece C, e B e C têm o mesmo arquivo
+	content := strings.Repeat("eachare simulation ", 2000)
+	setup := []struct {
+		address   string
+		neighbors []string
+		files     map[string]string
+	}{
+		{"127.0.0.1:9001", []string{"127.0.0.1:9002"}, nil},
+		{"127.0.0.1:9002", []string{"127.0.0.1:9003"}, map[string]string{"dados.txt": content}},
+		{"127.0.0.1:9003", nil, map[string]string{"dados.txt": content, "outro.txt": "outro"}},
+	}
+	for _, peer := range setup {
+		if err := simulation.AddPeer(peer.address, peer.neighbors, peer.files); err != nil {
+			t.Fatalf("Failed to add peer %s: %v", peer.address, err)
+		}
+	}
+
+	// B descobre C, e depois A descobre os dois pela lista de B
+	if err := simulation.GetPeers("127.0.0.1:9002"); err != nil {
+		t.Fatalf("GetPeers failed: %v", err)
+	}
+	// Cada peer tem o próprio relógio, e A ainda não trocou nenhuma mensagem
+	if value, _ := simulation.Clock("127.0.0.1:9001"); value != 0 {
+		t.Errorf("Expected the clock of 9001 to be untouched, got %d", value)
+	}
+	if value, _ := simulation.Clock("127.0.0.1:9002"); value != 8 {
+		t.Errorf("Expected the clock of 9002 to be 8 after HELLO, GET_PEERS and their replies, got %d", value)
+	}
+	if err := simulation.GetPeers("127.0.0.1:9001"); err != nil {
+		t.Fatalf("GetPeers failed: %v", err)
+	}
+	for _, neighbor := range []string{"127.0.0.1:9002", "127.0.0.1:9003"} {
+		if entry, exists := simulation.PeerEntry("127.0.0.1:9001", neighbor); !exists || entry.Status != peers.ONLINE {
+			t.Errorf("Expected %s ONLINE in the table of 9001, got %+v (exists %v)", neighbor, entry, exists)
+		}
+	}
+
+	// A busca encontra o arquivo nas duas origens e o download junta o conteúdo
+	fileList, err := simulation.Search("127.0.0.1:9001")
+	if err != nil || fileList.Len() != 2 {
+		t.Fatalf("Expected two distinct files in the search, got %v (%v)", fileList, err)
+	}
+	if file, _ := fileList.Find("dados.txt"); file.OriginsString() != "127.0.0.1:9002, 127.0.0.1:9003" {
+		t.Errorf("Expected both origins for dados.txt, got %q", file.OriginsString())
+	}
+	if err := simulation.SetChunkSize("127.0.0.1:9001", 1024); err != nil {
+		t.Fatalf("SetChunkSize failed: %v", err)
+	}
+	if err := simulation.Download("127.0.0.1:9001", "dados.txt"); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if downloaded, err := simulation.ReadFile("127.0.0.1:9001", "dados.txt"); err != nil || string(downloaded) != content {
+		t.Errorf("Downloaded file differs from the original (%d bytes, %v)", len(downloaded), err)
+	}
+
+	// O BYE de C chega aos dois vizinhos, que passam a vê-lo OFFLINE
+	if err := simulation.Bye("127.0.0.1:9003"); err != nil {
+		t.Fatalf("Bye failed: %v", err)
+	}
+	offline := simulation.Await(2*time.Second, func() bool {
+		for _, address := range []string{"127.0.0.1:9001", "127.0.0.1:9002"} {
+			if entry, _ := simulation.PeerEntry(address, "127.0.0.1:9003"); entry.Status != peers.OFFLINE {
+				return false
+			}
+		}
+		return true
+	})
+	if !offline {
+		t.Errorf("Expected 9003 OFFLINE on every neighbor after BYE")
+	}
+
+	logs := simulation.Logs()
+	for _, expected := range []string{"Download do arquivo dados.txt finalizado.", "Saindo...", "BYE\""} {
+		if !strings.Contains(logs, expected) {
+			t.Errorf("Expected logs to contain %q", expected)
+		}
+	}
+}
+
+func TestSimulationUnknownPeer(t *testing.T) {
+	simulation := NewSimulation(t.TempDir())
+	defer simulation.Close()
+
+	if err := simulation.GetPeers("127.0.0.1:9999"); !errors.Is(err, ErrUnknownSimulatedPeer) {
+		t.Errorf("Expected ErrUnknownSimulatedPeer, got %v", err)
+	}
+}
+
+// Função para subir A, que conhece B e C, com o mesmo arquivo em B e C
+func startTwoOrigins(t *testing.T, content string) *Simulation {
+	simulation := NewSimulation(t.TempDir())
+	t.Cleanup(simulation.Close)
+
+	files := map[string]string{"dados.txt": content}
+	simulation.AddPeer("127.0.0.1:9001", []string{"127.0.0.1:9002", "127.0.0.1:9003"}, nil)
+	simulation.AddPeer("127.0.0.1:9002", nil, files)
+	simulation.AddPeer("127.0.0.1:9003", nil, files)
+	simulation.GetPeers("127.0.0.1:9001")
+	simulation.SetChunkSize("127.0.0.1:9001", 512)
+	return simulation
+}
+
+func TestSimulationFaultyOrigin(t *testing.T) {
+	content := strings.Repeat("resilience ", 1000)
+	simulation := startTwoOrigins(t, content)
+
+	// B derruba a conexão em todo FILE, então C acaba baixando o arquivo inteiro
+	injector, err := simulation.InjectFaults("127.0.0.1:9002", 1, connection.FaultRule{Kind: connection.RESET, Type: message.FILE, Probability: 1})
+	if err != nil {
+		t.Fatalf("InjectFaults failed: %v", err)
+	}
+	if err := simulation.Download("127.0.0.1:9001", "dados.txt"); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if downloaded, _ := simulation.ReadFile("127.0.0.1:9001", "dados.txt"); string(downloaded) != content {
+		t.Errorf("Downloaded file differs from the original (%d bytes)", len(downloaded))
+	}
+	if injector.Injected(connection.RESET) == 0 {
+		t.Errorf("Expected some FILE messages to be reset")
+	}
+}
+
+func TestSimulationCorruptChunks(t *testing.T) {
+	content := strings.Repeat("integrity ", 1000)
+	simulation := startTwoOrigins(t, content)
+
+	// A busca negocia as capacidades, então os chunks vêm com SHA-256 e os corrompidos são pedidos de novo
+	injector, _ := simulation.InjectFaults("127.0.0.1:9002", 3, connection.FaultRule{Kind: connection.CORRUPT, Type: message.FILE, Probability: 0.5})
+	if err := simulation.Download("127.0.0.1:9001", "dados.txt"); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if downloaded, _ := simulation.ReadFile("127.0.0.1:9001", "dados.txt"); string(downloaded) != content {
+		t.Errorf("Downloaded file differs from the original (%d bytes)", len(downloaded))
+	}
+	if injector.Injected(connection.CORRUPT) == 0 {
+		t.Errorf("Expected some FILE messages to be corrupted")
+	}
+}
+
+func TestSimulationSearchNegotiatesHashes(t *testing.T) {
+	content := strings.Repeat("negotiated ", 1000)
+	simulation := startTwoOrigins(t, content)
+
+	// Sem nenhum HELLO manual, a busca faz o HELLO antes do LS e recebe o hash de cada arquivo
+	fileList, err := simulation.Search("127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	file, found := fileList.Find("dados.txt")
+	if !found || file.Hash() != files.HashBytes([]byte(content)) {
+		t.Fatalf("Expected dados.txt with its SHA-256 in the search, got %+v (found %v)", file, found)
+	}
+	for _, origin := range []string{"127.0.0.1:9002", "127.0.0.1:9003"} {
+		if entry, _ := simulation.PeerEntry("127.0.0.1:9001", origin); !entry.Capabilities.HasFeature(message.HASH_FEATURE) {
+			t.Errorf("Expected the capabilities of %s to be negotiated, got %+v", origin, entry.Capabilities)
+		}
+	}
+
+	// O download confere o arquivo montado com o hash da busca
+	if err := simulation.Download("127.0.0.1:9001", "dados.txt"); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if downloaded, _ := simulation.ReadFile("127.0.0.1:9001", "dados.txt"); string(downloaded) != content {
+		t.Errorf("Downloaded file differs from the original (%d bytes)", len(downloaded))
+	}
+}
+
+func TestSimulationSearchGroupsByContent(t *testing.T) {
+	simulation := NewSimulation(t.TempDir())
+	defer simulation.Close()
+
+	// B e C guardam o mesmo conteúdo com nomes diferentes, e A não faz nenhum HELLO manual
+	content := strings.Repeat("same content ", 500)
+	simulation.AddPeer("127.0.0.1:9001", []string{"127.0.0.1:9002", "127.0.0.1:9003"}, nil)
+	simulation.AddPeer("127.0.0.1:9002", nil, map[string]string{"dados.txt": content})
+	simulation.AddPeer("127.0.0.1:9003", nil, map[string]string{"copia.txt": content})
+	simulation.GetPeers("127.0.0.1:9001")
+
+	fileList, err := simulation.Search("127.0.0.1:9001")
+	if err != nil || fileList.Len() != 1 {
+		t.Fatalf("Expected a single entry for the shared content, got %v (%v)", fileList, err)
+	}
+	file, _ := fileList.Find("copia.txt")
+	if file.DisplayName() != "dados.txt (copia.txt)" || file.OriginsString() != "127.0.0.1:9002, 127.0.0.1:9003" {
+		t.Errorf("Expected dados.txt aliased as copia.txt on both origins, got %q from %q", file.DisplayName(), file.OriginsString())
+	}
+	if file.NameAt("127.0.0.1:9003") != "copia.txt" {
+		t.Errorf("Expected 9003 to be asked for copia.txt, got %q", file.NameAt("127.0.0.1:9003"))
+	}
+}
+
+func TestSimulationRefusedSearch(t *testing.T) {
+	simulation := NewSimulation(t.TempDir())
+	defer simulation.Close()
+	simulation.AddPeer("127.0.0.1:9001", []string{"127.0.0.1:9002"}, nil)
+	simulation.AddPeer("127.0.0.1:9002", nil, map[string]string{"dados.txt": "dados"})
+	simulation.GetPeers("127.0.0.1:9001")
+
+	// Sem o diretório compartilhado, B recusa o LS com um erro que não adianta repetir, e A recebe o ERROR
+	os.RemoveAll(filepath.Join(simulation.peerDir("127.0.0.1:9002"), "shared"))
+	fileList, err := simulation.Search("127.0.0.1:9001")
+	if err != nil || !fileList.Empty() {
+		t.Fatalf("Expected an empty search, got %v (%v)", fileList, err)
+	}
+	if logs := simulation.Logs(); !strings.Contains(logs, "Busca recusada: 127.0.0.1:9002 respondeu FILE_NOT_FOUND") {
+		t.Errorf("Expected the refused search to be logged, logs:\n%s", logs)
+	}
+	if entry, _ := simulation.PeerEntry("127.0.0.1:9001", "127.0.0.1:9002"); entry.Status != peers.ONLINE {
+		t.Errorf("Expected 9002 to stay ONLINE after refusing the search, got %s", entry.Status)
+	}
+}
+
+func TestSimulationAllOriginsFail(t *testing.T) {
+	simulation := startTwoOrigins(t, strings.Repeat("lost ", 1000))
+
+	// Sem nenhuma origem entregando chunks, o download termina incompleto em vez de travar
+	for _, origin := range []string{"127.0.0.1:9002", "127.0.0.1:9003"} {
+		simulation.InjectFaults(origin, 1, connection.FaultRule{Kind: connection.TRUNCATE, Type: message.FILE, Probability: 1})
+	}
+	err := simulation.Download("127.0.0.1:9001", "dados.txt")
+	if !errors.Is(err, commands.ErrIncomplete) {
+		t.Errorf("Expected ErrIncomplete, got %v", err)
+	}
+	if _, err := simulation.ReadFile("127.0.0.1:9001", "dados.txt"); err == nil {
+		t.Errorf("Expected no final file for an incomplete download")
+	}
+}
+
+func TestSimulationVectorClockStaleBye(t *testing.T) {
+	simulation := NewSimulation(t.TempDir())
+	defer simulation.Close()
+
+	// A conhece B e C, B conhece C, e C conhece os dois
+	setup := map[string][]string{
+		"127.0.0.1:9001": {"127.0.0.1:9002", "127.0.0.1:9003"},
+		"127.0.0.1:9002": {"127.0.0.1:9003"},
+		"127.0.0.1:9003": {"127.0.0.1:9001", "127.0.0.1:9002"},
+	}
+	for address, neighbors := range setup {
+		if err := simulation.AddPeer(address, neighbors, nil); err != nil {
+			t.Fatalf("Failed to add peer %s: %v", address, err)
+		}
+		if err := simulation.UseClock(address, clock.VECTOR); err != nil {
+			t.Fatalf("UseClock failed: %v", err)
+		}
+	}
+
+	// Sem nenhum HELLO manual, o GET_PEERS negocia o relógio vetorial, e B fica sabendo de C
+	for _, address := range []string{"127.0.0.1:9003", "127.0.0.1:9002"} {
+		if err := simulation.GetPeers(address); err != nil {
+			t.Fatalf("GetPeers failed: %v", err)
+		}
+	}
+
+	// O BYE de C para B se perde, então só A fica sabendo que C saiu
+	simulation.InjectFaults("127.0.0.1:9003", 1, connection.FaultRule{Kind: connection.DROP, Peer: "127.0.0.1:9002", Type: message.BYE, Probability: 1})
+	if err := simulation.Bye("127.0.0.1:9003"); err != nil {
+		t.Fatalf("Bye failed: %v", err)
+	}
+	offline := simulation.Await(2*time.Second, func() bool {
+		entry, _ := simulation.PeerEntry("127.0.0.1:9001", "127.0.0.1:9003")
+		return entry.Status == peers.OFFLINE
+	})
+	if !offline {
+		t.Fatalf("Expected 9001 to see 9003 OFFLINE after BYE")
+	}
+	if entry, _ := simulation.PeerEntry("127.0.0.1:9002", "127.0.0.1:9003"); entry.Status != peers.ONLINE {
+		t.Fatalf("Expected 9002 to still see 9003 ONLINE, got %s", entry.Status)
+	}
+
+	// A lista de B diz que C está ONLINE, mas o vetor mostra que é anterior ao BYE
+	if err := simulation.GetPeers("127.0.0.1:9001"); err != nil {
+		t.Fatalf("GetPeers failed: %v", err)
+	}
+	logs := simulation.Logs()
+	if !strings.Contains(logs, "Continuando peer 127.0.0.1:9003 status OFFLINE (informação desatualizada recebida)") {
+		t.Errorf("Expected the stale ONLINE status of 9003 to be ignored, logs:\n%s", logs)
+	}
+	if !strings.Contains(logs, "|127.0.0.1:9001=") {
+		t.Errorf("Expected vector clocks in the logged messages")
+	}
+	if !strings.Contains(logs, "PEERS_LIST 1 127.0.0.1:9003:ONLINE:") || !strings.Contains(logs, "127.0.0.1%3A9003=") {
+		t.Errorf("Expected the PEERS_LIST of 9002 to carry the vector of 9003")
+	}
+}
+
+func TestSimulationHybridClock(t *testing.T) {
+	simulation := NewSimulation(t.TempDir())
+	defer simulation.Close()
+
+	// A usa o relógio híbrido e B continua com o de Lamport
+	if err := simulation.AddPeer("127.0.0.1:9001", []string{"127.0.0.1:9002"}, nil); err != nil {
+		t.Fatalf("Failed to add peer: %v", err)
+	}
+	if err := simulation.AddPeer("127.0.0.1:9002", nil, nil); err != nil {
+		t.Fatalf("Failed to add peer: %v", err)
+	}
+	if err := simulation.UseClock("127.0.0.1:9001", clock.HYBRID); err != nil {
+		t.Fatalf("UseClock failed: %v", err)
+	}
+	before := time.Now()
+	if err := simulation.GetPeers("127.0.0.1:9001"); err != nil {
+		t.Fatalf("GetPeers failed: %v", err)
+	}
+
+	// O relógio de A segue o horário, e o de B passa à frente dele para manter a ordem
+	hybrid, _ := simulation.Clock("127.0.0.1:9001")
+	if physical, _ := clock.SplitHybrid(hybrid); physical.Before(before.Truncate(time.Millisecond)) || physical.After(time.Now()) {
+		t.Errorf("Expected the hybrid clock to carry the current time, got %v", physical)
+	}
+	if lamport, _ := simulation.Clock("127.0.0.1:9002"); lamport <= int(before.UnixMilli())<<clock.HYBRID_LOGICAL_BITS {
+		t.Errorf("Expected 9002 to move past the GET_PEERS clock, got %d", lamport)
+	}
+	if !strings.Contains(simulation.Logs(), "=> Atualizando relogio para "+strconv.Itoa(hybrid)+" ("+clock.FormatHybrid(hybrid)+")") {
+		t.Errorf("Expected the hybrid clock to be logged with its time")
+	}
+}
+
+func TestSimulationRestartKeepsClock(t *testing.T) {
+	simulation := NewSimulation(t.TempDir())
+	defer simulation.Close()
+	for _, address := range []string{"127.0.0.1:9001", "127.0.0.1:9002"} {
+		if err := simulation.AddPeer(address, []string{"127.0.0.1:9001", "127.0.0.1:9002"}, nil); err != nil {
+			t.Fatalf("Failed to add peer %s: %v", address, err)
+		}
+	}
+
+	// B guarda o relógio das mensagens de A
+	for i := 0; i < 3; i++ {
+		if err := simulation.GetPeers("127.0.0.1:9001"); err != nil {
+			t.Fatalf("GetPeers failed: %v", err)
+		}
+	}
+	before, _ := simulation.Clock("127.0.0.1:9001")
+	stored, _ := simulation.PeerEntry("127.0.0.1:9002", "127.0.0.1:9001")
+
+	// A cai sem avisar e volta a partir do último checkpoint, que fica à frente do que já foi enviado
+	if err := simulation.Restart("127.0.0.1:9001"); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+	if after, _ := simulation.Clock("127.0.0.1:9001"); after < before {
+		t.Errorf("Expected the clock to continue from %d, got %d", before, after)
+	}
+	if err := simulation.GetPeers("127.0.0.1:9001"); err != nil {
+		t.Fatalf("GetPeers failed: %v", err)
+	}
+	if entry, _ := simulation.PeerEntry("127.0.0.1:9002", "127.0.0.1:9001"); entry.Clock <= stored.Clock {
+		t.Errorf("Expected 9002 to store a newer clock for 9001 than %d, got %d", stored.Clock, entry.Clock)
+	}
+	if strings.Contains(simulation.Logs(), "Continuando peer 127.0.0.1:9001") {
+		t.Errorf("Expected no outdated information about 9001 itself")
+	}
+
+	// Saindo com BYE, os relógios dos peers também são guardados
+	neighbor, _ := simulation.PeerEntry("127.0.0.1:9001", "127.0.0.1:9002")
+	if err := simulation.Bye("127.0.0.1:9001"); err != nil {
+		t.Fatalf("Bye failed: %v", err)
+	}
+	if err := simulation.Restart("127.0.0.1:9001"); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+	if entry, _ := simulation.PeerEntry("127.0.0.1:9001", "127.0.0.1:9002"); entry.Clock != neighbor.Clock || entry.Status != neighbor.Status {
+		t.Errorf("Expected 9002 restored as %+v, got %+v", neighbor, entry)
+	}
+}
+
+func TestSimulationRestartOtherClockMode(t *testing.T) {
+	simulation := NewSimulation(t.TempDir())
+	defer simulation.Close()
+	for _, address := range []string{"127.0.0.1:9001", "127.0.0.1:9002"} {
+		simulation.AddPeer(address, []string{"127.0.0.1:9001", "127.0.0.1:9002"}, nil)
+	}
+	simulation.UseClock("127.0.0.1:9001", clock.HYBRID)
+	simulation.GetPeers("127.0.0.1:9001")
+
+	// O checkpoint do relógio híbrido não vale para o Lamport, que recomeçaria com o horário no valor
+	if err := simulation.RestartWithClock("127.0.0.1:9001", clock.LAMPORT); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+	if value, _ := simulation.Clock("127.0.0.1:9001"); value >= 1<<clock.HYBRID_LOGICAL_BITS {
+		t.Errorf("Expected the hybrid checkpoint to be ignored, got %d", value)
+	}
+	if !strings.Contains(simulation.Logs(), "Relógio guardado no modo hybrid ignorado, já que o relógio atual é lamport") {
+		t.Errorf("Expected the ignored clock to be logged")
+	}
+
+	// Entre o Lamport e o vetorial a escala é a mesma, então o relógio continua
+	simulation.GetPeers("127.0.0.1:9001")
+	before, _ := simulation.Clock("127.0.0.1:9001")
+	simulation.RestartWithClock("127.0.0.1:9001", clock.VECTOR)
+	if after, _ := simulation.Clock("127.0.0.1:9001"); after < before {
+		t.Errorf("Expected the vector clock to continue from %d, got %d", before, after)
+	}
+}
+
+func TestSimulationRestartKeepsPeerTable(t *testing.T) {
+	simulation := NewSimulation(t.TempDir())
+	defer simulation.Close()
+
+	// A só conhece B pelo arquivo de vizinhos, e descobre C e D pela lista de B
+	setup := []struct {
+		address   string
+		neighbors []string
+	}{
+		{"127.0.0.1:9001", []string{"127.0.0.1:9002"}},
+		{"127.0.0.1:9002", []string{"127.0.0.1:9003", "127.0.0.1:9004"}},
+		{"127.0.0.1:9003", nil},
+	}
+	for _, peer := range setup {
+		if err := simulation.AddPeer(peer.address, peer.neighbors, nil); err != nil {
+			t.Fatalf("Failed to add peer %s: %v", peer.address, err)
+		}
+	}
+	if err := simulation.GetPeers("127.0.0.1:9002"); err != nil {
+		t.Fatalf("GetPeers failed: %v", err)
+	}
+	if err := simulation.GetPeers("127.0.0.1:9001"); err != nil {
+		t.Fatalf("GetPeers failed: %v", err)
+	}
+	if err := simulation.GetPeers("127.0.0.1:9001"); err != nil {
+		t.Fatalf("GetPeers failed: %v", err)
+	}
+	expected := map[string]peers.Peer{}
+	for _, address := range []string{"127.0.0.1:9002", "127.0.0.1:9003", "127.0.0.1:9004"} {
+		expected[address], _ = simulation.PeerEntry("127.0.0.1:9001", address)
+	}
+	if expected["127.0.0.1:9004"].Failures == 0 || expected["127.0.0.1:9002"].LastSeen.IsZero() {
+		t.Fatalf("Expected failures for 9004 and a contact with 9002, got %+v", expected)
+	}
+
+	// A tabela é gravada logo depois das alterações, então sobrevive a uma queda
+	store, _ := state.NewStore(filepath.Join(simulation.peerDir("127.0.0.1:9001"), "data"))
+	saved := simulation.Await(3*STATE_SAVE_DELAY, func() bool {
+		loaded, err := store.Load()
+		if err != nil {
+			return false
+		}
+		matches := 0
+		for _, savedPeer := range loaded.Peers {
+			if peer, exists := expected[savedPeer.Address]; exists && savedPeer.Clock == peer.Clock && savedPeer.Failures == peer.Failures {
+				matches++
+			}
+		}
+		return matches == len(expected)
+	})
+	if !saved {
+		t.Fatalf("Expected the peer table to be saved after the changes")
+	}
+	if err := simulation.Restart("127.0.0.1:9001"); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+	for address, peer := range expected {
+		entry, exists := simulation.PeerEntry("127.0.0.1:9001", address)
+		if !exists || entry.Status != peer.Status || entry.Clock != peer.Clock || entry.Failures != peer.Failures || !entry.LastSeen.Equal(peer.LastSeen) {
+			t.Errorf("Expected %s restored as %+v, got %+v (exists %v)", address, peer, entry, exists)
+		}
+	}
+}
+
+func TestSimulationHeartbeat(t *testing.T) {
+	simulation := NewSimulation(t.TempDir())
+	defer simulation.Close()
+	for _, address := range []string{"127.0.0.1:9001", "127.0.0.1:9002", "127.0.0.1:9003"} {
+		if err := simulation.AddPeer(address, []string{"127.0.0.1:9002", "127.0.0.1:9003"}, nil); err != nil {
+			t.Fatalf("Failed to add peer %s: %v", address, err)
+		}
+	}
+	if err := simulation.StartHeartbeat("127.0.0.1:9001", 50*time.Millisecond); err != nil {
+		t.Fatalf("StartHeartbeat failed: %v", err)
+	}
+	status := func(neighbor string) peers.PeerStatus {
+		entry, _ := simulation.PeerEntry("127.0.0.1:9001", neighbor)
+		return entry.Status
+	}
+
+	// Os vizinhos do arquivo começam OFFLINE e passam a ONLINE ao responder o heartbeat
+	online := simulation.Await(2*time.Second, func() bool {
+		return status("127.0.0.1:9002") == peers.ONLINE && status("127.0.0.1:9003") == peers.ONLINE
+	})
+	if !online {
+		t.Fatalf("Expected both neighbors ONLINE after the first heartbeats")
+	}
+
+	// A troca de HELLO do detector só aparece no nível DEBUG, e a mudança de status continua visível
+	logs := simulation.Logs()
+	if strings.Contains(logs, message.HEARTBEAT_ARGUMENT) {
+		t.Errorf("Expected the heartbeat messages to stay out of the INFO logs, logs:\n%s", logs)
+	}
+	if !strings.Contains(logs, "Atualizando peer 127.0.0.1:9002 status ONLINE (respondeu ao heartbeat)") {
+		t.Errorf("Expected the transition of 9002 to be logged")
+	}
+
+	// C cai sem avisar e, depois de suspeito, é marcado OFFLINE sem ninguém ter mandado mensagem para ele
+	if err := simulation.Crash("127.0.0.1:9003"); err != nil {
+		t.Fatalf("Crash failed: %v", err)
+	}
+	if !simulation.Await(2*time.Second, func() bool { return status("127.0.0.1:9003") == peers.OFFLINE }) {
+		t.Fatalf("Expected 9003 OFFLINE after missing heartbeats")
+	}
+	if status("127.0.0.1:9002") != peers.ONLINE {
+		t.Errorf("Expected 9002 to stay ONLINE")
+	}
+	logs = simulation.Logs()
+	suspected := strings.Index(logs, "Suspeitando do peer 127.0.0.1:9003")
+	offline := strings.Index(logs, "Atualizando peer 127.0.0.1:9003 status OFFLINE: sem resposta")
+	if suspected < 0 || offline < suspected {
+		t.Errorf("Expected 9003 to be suspected before going OFFLINE, logs:\n%s", logs)
+	}
+
+	// Quando C volta, o heartbeat o encontra de novo
+	if err := simulation.Restart("127.0.0.1:9003"); err != nil {
+		t.Fatalf("Restart failed: %v", err)
+	}
+	if !simulation.Await(2*time.Second, func() bool { return status("127.0.0.1:9003") == peers.ONLINE }) {
+		t.Errorf("Expected 9003 back ONLINE after restarting")
+	}
+}
@@ -0,0 +1,71 @@
+package files
+
+// Pacotes nativos de go
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Estrutura para um hash já calculado, válido enquanto o arquivo não mudar
+type hashEntry struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// Cache dos hashes calculados, para não reler os arquivos a cada LS
+var (
+	cacheMu sync.Mutex
+	cache   = make(map[string]hashEntry)
+)
+
+// Função para calcular o SHA-256 de um conteúdo, em hexadecimal
+func HashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Função para obter o SHA-256 de um arquivo, em hexadecimal
+// O hash só é recalculado se o tamanho ou a data de modificação do arquivo mudarem
+func Hash(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	cacheMu.Lock()
+	entry, exists := cache[path]
+	cacheMu.Unlock()
+	if exists && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.hash, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	cacheMu.Lock()
+	cache[path] = hashEntry{size: info.Size(), modTime: info.ModTime(), hash: hash}
+	cacheMu.Unlock()
+	return hash, nil
+}
+
+// Função para verificar se a string tem o formato de um SHA-256 em hexadecimal
+func IsHash(hash string) bool {
+	if len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
@@ -0,0 +1,127 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	os.WriteFile(path, []byte("hello"), 0644)
+
+	hash, err := Hash(path)
+	if err != nil || hash != HashBytes([]byte("hello")) {
+		t.Fatalf("Hash = %q, %v; expected %q", hash, err, HashBytes([]byte("hello")))
+	}
+	if !IsHash(hash) {
+		t.Errorf("IsHash(%q) = false", hash)
+	}
+
+	// Um arquivo alterado precisa ter o hash recalculado
+	os.WriteFile(path, []byte("world!"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	hash, err = Hash(path)
+	if err != nil || hash != HashBytes([]byte("world!")) {
+		t.Errorf("Hash after change = %q, %v; expected %q", hash, err, HashBytes([]byte("world!")))
+	}
+
+	if _, err := Hash(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("Hash of missing file expected an error")
+	}
+}
+
+func TestIsHash(t *testing.T) {
+	for _, hash := range []string{"", "abc", HashBytes(nil)[:63] + "g", HashBytes(nil) + "0"} {
+		if IsHash(hash) {
+			t.Errorf("IsHash(%q) = true; expected false", hash)
+		}
+	}
+}
+
+func TestPartial(t *testing.T) {
+	finalPath := filepath.Join(t.TempDir(), "b.txt")
+	partial, err := CreatePartial(finalPath, 10)
+	if err != nil {
+		t.Fatalf("CreatePartial returned error: %v", err)
+	}
+
+	// Os pedaços podem chegar fora de ordem
+	partial.WriteAt([]byte("56789"), 5)
+	partial.WriteAt([]byte("01234"), 0)
+	if _, err := os.Stat(finalPath); err == nil {
+		t.Errorf("Final file exists before Commit")
+	}
+	if hash, err := partial.Hash(); err != nil || hash != HashBytes([]byte("0123456789")) {
+		t.Errorf("Partial.Hash = %q, %v", hash, err)
+	}
+	if err := partial.Commit(); err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+	if data, _ := os.ReadFile(finalPath); string(data) != "0123456789" {
+		t.Errorf("Expected committed content, got %q", data)
+	}
+	if _, err := os.Stat(finalPath + PARTIAL_SUFFIX); err == nil {
+		t.Errorf("Partial file left behind after Commit")
+	}
+
+	discarded, _ := CreatePartial(finalPath+"2", 4)
+	discarded.Discard()
+	if _, err := os.Stat(finalPath + "2" + PARTIAL_SUFFIX); err == nil {
+		t.Errorf("Partial file left behind after Discard")
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	finalPath := filepath.Join(dir, "c.txt")
+	journal := NewJournal("c.txt", 10, "", 4, map[string]string{"peer:1": "other.txt"})
+	if journal.Chunks() != 3 || journal.Completed() != 0 {
+		t.Fatalf("Expected 3 pending chunks, got %d of %d", journal.Completed(), journal.Chunks())
+	}
+	journal.MarkDone(2)
+	journal.MarkDone(7)
+	if err := journal.Save(finalPath); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+
+	loaded, err := LoadJournal(finalPath)
+	if err != nil || !loaded.IsDone(2) || loaded.IsDone(0) || loaded.Completed() != 1 || loaded.Origins["peer:1"] != "other.txt" {
+		t.Fatalf("LoadJournal = %+v, %v", loaded, err)
+	}
+	if journals, err := ListJournals(dir); err != nil || len(journals) != 1 || journals[0].Name != "c.txt" {
+		t.Errorf("ListJournals = %+v, %v", journals, err)
+	}
+	if !IsPartial("c.txt" + JOURNAL_SUFFIX) {
+		t.Errorf("Journal should not be listed as a shared file")
+	}
+	if IsPartial("backup.part") {
+		t.Errorf("A shared file ending in .part should not be hidden")
+	}
+
+	RemoveJournal(finalPath)
+	if _, err := LoadJournal(finalPath); err == nil {
+		t.Errorf("LoadJournal after RemoveJournal expected an error")
+	}
+}
+
+func TestResumePartial(t *testing.T) {
+	finalPath := filepath.Join(t.TempDir(), "d.txt")
+	partial, _ := CreatePartial(finalPath, 4)
+	partial.WriteAt([]byte("ab"), 0)
+	partial.Close()
+
+	if _, err := ResumePartial(finalPath, 5); err == nil {
+		t.Errorf("ResumePartial with a different size expected an error")
+	}
+	resumed, err := ResumePartial(finalPath, 4)
+	if err != nil {
+		t.Fatalf("ResumePartial returned error: %v", err)
+	}
+	resumed.WriteAt([]byte("cd"), 2)
+	resumed.Commit()
+	if data, _ := os.ReadFile(finalPath); string(data) != "abcd" {
+		t.Errorf("Expected resumed content, got %q", data)
+	}
+}
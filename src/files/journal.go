@@ -0,0 +1,122 @@
+package files
+
+// Pacotes nativos de go
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sufixo do diário de um download em andamento, guardado ao lado do arquivo temporário
+const JOURNAL_SUFFIX = PARTIAL_SUFFIX + ".journal"
+
+// Sufixo usado ao regravar o diário, que só substitui o anterior depois de escrito por inteiro
+const journalTempSuffix = JOURNAL_SUFFIX + ".tmp"
+
+// Estrutura para o diário de um download, com o que é preciso para continuá-lo depois
+// Done é um mapa de bits com os chunks que já estão gravados no arquivo temporário
+type Journal struct {
+	Name      string            `json:"name"`
+	Size      int               `json:"size"`
+	Hash      string            `json:"hash,omitempty"`
+	ChunkSize int               `json:"chunk_size"`
+	Origins   map[string]string `json:"origins"`
+	Done      []byte            `json:"done"`
+}
+
+// Função para criar o diário de um download que está começando
+// origins guarda o nome do arquivo em cada origem
+func NewJournal(name string, size int, hash string, chunkSize int, origins map[string]string) *Journal {
+	journal := &Journal{Name: name, Size: size, Hash: hash, ChunkSize: chunkSize, Origins: origins}
+	journal.Done = make([]byte, (journal.Chunks()+7)/8)
+	return journal
+}
+
+// Função para obter a quantidade de chunks do arquivo
+func (j *Journal) Chunks() int {
+	if j.ChunkSize <= 0 {
+		return 0
+	}
+	return (j.Size + j.ChunkSize - 1) / j.ChunkSize
+}
+
+// Função para verificar se o chunk já foi gravado
+func (j *Journal) IsDone(index int) bool {
+	return index >= 0 && index/8 < len(j.Done) && j.Done[index/8]&(1<<(index%8)) != 0
+}
+
+// Função para marcar o chunk como gravado
+func (j *Journal) MarkDone(index int) {
+	if index >= 0 && index/8 < len(j.Done) {
+		j.Done[index/8] |= 1 << (index % 8)
+	}
+}
+
+// Função para contar quantos chunks já foram gravados
+func (j *Journal) Completed() int {
+	count := 0
+	for i := 0; i < j.Chunks(); i++ {
+		if j.IsDone(i) {
+			count++
+		}
+	}
+	return count
+}
+
+// Função para gravar o diário ao lado do arquivo temporário de finalPath
+func (j *Journal) Save(finalPath string) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tempPath := finalPath + journalTempSuffix
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, finalPath+JOURNAL_SUFFIX)
+}
+
+// Função para ler o diário do download de finalPath
+func LoadJournal(finalPath string) (*Journal, error) {
+	data, err := os.ReadFile(finalPath + JOURNAL_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	var journal Journal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return nil, err
+	}
+	if journal.Size < 0 || journal.ChunkSize <= 0 || len(journal.Done) != (journal.Chunks()+7)/8 {
+		return nil, errors.New("diário de download inválido: " + finalPath + JOURNAL_SUFFIX)
+	}
+	return &journal, nil
+}
+
+// Função para apagar o diário do download de finalPath
+func RemoveJournal(finalPath string) {
+	os.Remove(finalPath + JOURNAL_SUFFIX)
+	os.Remove(finalPath + journalTempSuffix)
+}
+
+// Função para listar os downloads interrompidos no diretório, ignorando diários ilegíveis
+func ListJournals(dir string) ([]*Journal, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var journals []*Journal
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), JOURNAL_SUFFIX)
+		if !found || entry.IsDir() {
+			continue
+		}
+		journal, err := LoadJournal(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		journals = append(journals, journal)
+	}
+	return journals, nil
+}
@@ -0,0 +1,111 @@
+package files
+
+// Pacotes nativos de go
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Sufixo do arquivo temporário de um download em andamento, que não é anunciado no LS_LIST nem servido no DL
+// Leva o nome do programa para não esconder arquivos compartilhados que terminam em .part
+const PARTIAL_SUFFIX = ".eachare-part"
+
+// Estrutura para um arquivo sendo baixado, escrito por partes fora de ordem
+// Só aparece com o nome final depois de Commit, então um download interrompido nunca deixa um arquivo pela metade
+type Partial struct {
+	file      *os.File
+	finalPath string
+}
+
+// Função para verificar se o nome é de um download em andamento (arquivo temporário ou diário)
+func IsPartial(name string) bool {
+	for _, suffix := range []string{PARTIAL_SUFFIX, JOURNAL_SUFFIX, journalTempSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Função para criar o arquivo temporário do download, já com o tamanho final
+func CreatePartial(finalPath string, size int64) (*Partial, error) {
+	file, err := os.Create(finalPath + PARTIAL_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &Partial{file: file, finalPath: finalPath}, nil
+}
+
+// Função para reabrir o arquivo temporário de um download interrompido, mantendo o que já foi escrito
+func ResumePartial(finalPath string, size int64) (*Partial, error) {
+	file, err := os.OpenFile(finalPath+PARTIAL_SUFFIX, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err == nil && info.Size() != size {
+		err = errors.New("arquivo temporário com tamanho diferente do esperado: " + file.Name())
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Partial{file: file, finalPath: finalPath}, nil
+}
+
+// Função para escrever um pedaço do arquivo na sua posição
+func (p *Partial) WriteAt(data []byte, offset int64) error {
+	_, err := p.file.WriteAt(data, offset)
+	return err
+}
+
+// Função para calcular o SHA-256 do que já foi escrito, lendo o arquivo em vez de guardá-lo na memória
+func (p *Partial) Hash() (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(p.file, 0, 1<<62)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Função para garantir que o que foi escrito até agora está no disco, antes de registrá-lo no diário
+func (p *Partial) Sync() error {
+	return p.file.Sync()
+}
+
+// Função para fechar o arquivo temporário mantendo-o para continuar o download depois
+func (p *Partial) Close() error {
+	if err := p.file.Sync(); err != nil {
+		p.file.Close()
+		return err
+	}
+	return p.file.Close()
+}
+
+// Função para gravar o arquivo em disco e movê-lo para o nome final
+func (p *Partial) Commit() error {
+	if err := p.file.Sync(); err != nil {
+		p.Discard()
+		return err
+	}
+	if err := p.file.Close(); err != nil {
+		os.Remove(p.file.Name())
+		return err
+	}
+	return os.Rename(p.file.Name(), p.finalPath)
+}
+
+// Função para desistir do download, apagando o arquivo temporário
+func (p *Partial) Discard() {
+	p.file.Close()
+	os.Remove(p.file.Name())
+}
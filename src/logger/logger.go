@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 // Define uma int para o nível do log
@@ -21,9 +22,11 @@ const (
 )
 
 // Estrutura para armazenar a mensagem de log e seu nível
+// Uma mensagem com done só marca a posição na fila, usada pelo Flush
 type LogMessage struct {
 	level   LogLevel
 	message string
+	done    chan struct{}
 }
 
 type Logger struct {
@@ -53,6 +56,7 @@ func (l *Logger) Write(message string) LogMessage {
 var logQueue = make(chan LogMessage, 100)
 var logLevel = INFO
 var outputBuf io.Writer
+var outputMu sync.Mutex
 
 // Variáveis para o buffer da mensagem e logger para escrita
 var stdLogger Logger
@@ -60,11 +64,19 @@ var infoLogger Logger
 var debugLogger Logger
 var errorLogger Logger
 
+// Indica se a CLI está mostrando o prompt e esperando uma entrada
+var promptActive atomic.Bool
+
 // Setter para o logLevel
 func SetLogLevel(level LogLevel) {
 	logLevel = level
 }
 
+// Setter para indicar se o prompt da CLI está ativo
+func SetPrompt(active bool) {
+	promptActive.Store(active)
+}
+
 // Retorna o logLevel atual como string
 func (l LogLevel) String() string {
 	switch l {
@@ -83,6 +95,8 @@ func (l LogLevel) String() string {
 
 // Define a saída padrão para o logger
 func SetOutput(w io.Writer) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
 	if w == nil {
 		outputBuf = os.Stdout
 	} else {
@@ -94,10 +108,23 @@ func SetOutput(w io.Writer) {
 func ConsumeLogQueue(ch chan LogMessage) {
 	for {
 		logMessage := <-ch
+		if logMessage.done != nil {
+			close(logMessage.done)
+			continue
+		}
+		outputMu.Lock()
 		outputBuf.Write([]byte(logMessage.message))
+		outputMu.Unlock()
 	}
 }
 
+// Função para esperar que todas as mensagens já logadas sejam escritas na saída
+func Flush() {
+	done := make(chan struct{})
+	logQueue <- LogMessage{done: done}
+	<-done
+}
+
 // init() é chamado na execução automaticamente, e aqui define o padrão pro log
 func init() {
 	SetOutput(os.Stdout)
@@ -154,3 +181,15 @@ func Error(str string) {
 		logQueue <- errorLogger.Write(str)
 	}
 }
+
+// Função para avisos que podem chegar a qualquer momento, como o fim de um download em segundo plano
+// O aviso vai numa linha própria e, se a CLI estava esperando uma entrada, o prompt é mostrado de novo
+func Notify(str string) {
+	message := "\n" + str + "\n"
+	if promptActive.Load() {
+		message += "> "
+	}
+	if logLevel >= ZERO {
+		logQueue <- stdLogger.Write(message)
+	}
+}
@@ -0,0 +1,208 @@
+package message
+
+// Pacotes nativos de go
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Versão do protocolo falada por este peer
+// 0 indica um peer que ainda não fez o HELLO, 1 o formato texto original sem argumentos no HELLO
+const (
+	UNKNOWN_VERSION  = 0
+	LEGACY_VERSION   = 1
+	PROTOCOL_VERSION = 2
+)
+
+// Tamanho máximo de chunk que este peer aceita responder
+const MAX_CHUNK_SIZE = 1 << 20
+
+// Codificações possíveis para o conteúdo das mensagens FILE
+// BINARY_ENCODING manda os bytes crus logo após a linha da mensagem, sem o aumento de tamanho do base64
+const (
+	BASE64_ENCODING = "base64"
+	BINARY_ENCODING = "binary"
+)
+
+// Funcionalidades opcionais que um peer pode anunciar
+// MUX_FEATURE indica que o peer aceita várias requisições numa mesma conexão, identificadas por linha
+// HASH_FEATURE indica que o peer entende o SHA-256 dos arquivos no LS_LIST e dos chunks no FILE
+// VECTOR_FEATURE indica que o peer entende o relógio vetorial no campo do relógio e no PEERS_LIST
+const (
+	MUX_FEATURE    = "mux"
+	HASH_FEATURE   = "sha256"
+	VECTOR_FEATURE = "vclock"
+)
+
+// Separador dos valores em listas dentro das capacidades
+const LIST_SEPARATOR = ","
+
+// Argumento extra do HELLO enviado pelo detector de falhas, devolvido na resposta
+// Ele só faz os dois lados mostrarem a troca no nível DEBUG, e peers que não o conhecem o ignoram
+const HEARTBEAT_ARGUMENT = "heartbeat=1"
+
+// Estrutura para as capacidades anunciadas por um peer no HELLO
+type Capabilities struct {
+	Version   int
+	Types     []MessageType
+	MaxChunk  int
+	Encodings []string
+	Features  []string
+}
+
+// Tipos de mensagem falados por qualquer peer, inclusive os que não anunciam capacidades
+var legacyTypes = []MessageType{HELLO, GET_PEERS, PEERS_LIST, LS, LS_LIST, DL, FILE, BYE}
+
+// Função para obter as capacidades deste peer
+func LocalCapabilities() Capabilities {
+	return Capabilities{
+		Version:   PROTOCOL_VERSION,
+		Types:     append(append([]MessageType{}, legacyTypes...), ERROR),
+		MaxChunk:  MAX_CHUNK_SIZE,
+		Encodings: []string{BASE64_ENCODING, BINARY_ENCODING},
+		Features:  []string{MUX_FEATURE, HASH_FEATURE, VECTOR_FEATURE},
+	}
+}
+
+// Função para montar os argumentos do HELLO a partir das capacidades, no formato chave=valor
+func (c Capabilities) Arguments() []string {
+	types := make([]string, len(c.Types))
+	for i, messageType := range c.Types {
+		types[i] = messageType.String()
+	}
+	encodings := make([]string, len(c.Encodings))
+	for i, encoding := range c.Encodings {
+		encodings[i] = Escape(encoding)
+	}
+	features := make([]string, len(c.Features))
+	for i, feature := range c.Features {
+		features[i] = Escape(feature)
+	}
+
+	return []string{
+		"version=" + strconv.Itoa(c.Version),
+		"types=" + strings.Join(types, LIST_SEPARATOR),
+		"chunk=" + strconv.Itoa(c.MaxChunk),
+		"encodings=" + strings.Join(encodings, LIST_SEPARATOR),
+		"features=" + strings.Join(features, LIST_SEPARATOR),
+	}
+}
+
+// Função para verificar se a mensagem é um HELLO do detector de falhas
+func IsHeartbeat(message BaseMessage) bool {
+	return message.Type == HELLO && slices.Contains(message.Arguments, HEARTBEAT_ARGUMENT)
+}
+
+// Função para ler as capacidades dos argumentos de um HELLO
+// Um HELLO sem argumentos vem de um peer que fala apenas o formato original
+// Chaves desconhecidas são ignoradas para que versões futuras possam acrescentar novas capacidades
+func ParseCapabilities(arguments []string) (Capabilities, error) {
+	if len(arguments) == 0 {
+		return Capabilities{Version: LEGACY_VERSION}, nil
+	}
+
+	var capabilities Capabilities
+	for _, argument := range arguments {
+		key, value, found := strings.Cut(argument, "=")
+		if !found {
+			return Capabilities{}, errors.New("capacidade sem valor: \"" + argument + "\"")
+		}
+
+		switch key {
+		case "version":
+			version, err := strconv.Atoi(value)
+			if err != nil || version <= UNKNOWN_VERSION {
+				return Capabilities{}, errors.New("versão inválida: \"" + value + "\"")
+			}
+			capabilities.Version = version
+		case "types":
+			for _, name := range strings.Split(value, LIST_SEPARATOR) {
+				if messageType := GetMessageType(name); messageType != UNKNOWN {
+					capabilities.Types = append(capabilities.Types, messageType)
+				}
+			}
+		case "chunk":
+			maxChunk, err := strconv.Atoi(value)
+			if err != nil || maxChunk <= 0 {
+				return Capabilities{}, errors.New("tamanho de chunk inválido: \"" + value + "\"")
+			}
+			capabilities.MaxChunk = maxChunk
+		case "encodings":
+			for _, encoding := range strings.Split(value, LIST_SEPARATOR) {
+				decoded, err := Unescape(encoding)
+				if err != nil {
+					return Capabilities{}, err
+				}
+				capabilities.Encodings = append(capabilities.Encodings, decoded)
+			}
+		case "features":
+			for _, feature := range strings.Split(value, LIST_SEPARATOR) {
+				decoded, err := Unescape(feature)
+				if err != nil {
+					return Capabilities{}, err
+				}
+				if decoded != "" {
+					capabilities.Features = append(capabilities.Features, decoded)
+				}
+			}
+		}
+	}
+
+	if capabilities.Version == UNKNOWN_VERSION {
+		return Capabilities{}, errors.New("capacidades sem versão")
+	}
+	return capabilities, nil
+}
+
+// Função para verificar se as capacidades já foram negociadas com o peer
+func (c Capabilities) Known() bool {
+	return c.Version != UNKNOWN_VERSION
+}
+
+// Função para verificar se o peer entende determinado tipo de mensagem
+// Peers sem capacidades anunciadas entendem apenas os tipos originais
+func (c Capabilities) Supports(messageType MessageType) bool {
+	types := c.Types
+	if c.Version <= LEGACY_VERSION {
+		types = legacyTypes
+	}
+	for _, t := range types {
+		if t == messageType {
+			return true
+		}
+	}
+	return false
+}
+
+// Função para verificar se o peer aceita determinada codificação de FILE
+func (c Capabilities) SupportsEncoding(encoding string) bool {
+	if c.Version <= LEGACY_VERSION {
+		return encoding == BASE64_ENCODING
+	}
+	for _, e := range c.Encodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// Função para obter o maior chunk aceito pelo peer, 0 se não houver limite conhecido
+func (c Capabilities) ChunkLimit() int {
+	if c.Version <= LEGACY_VERSION {
+		return 0
+	}
+	return c.MaxChunk
+}
+
+// Função para verificar se o peer anunciou determinada funcionalidade opcional
+func (c Capabilities) HasFeature(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package message
+
+// Pacotes nativos de go
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"eachare/src/clock"
+	"eachare/src/files"
+)
+
+// Separador entre os campos de um mesmo argumento (ex.: "nome:tamanho")
+const FIELD_SEPARATOR = ":"
+
+// Caracteres hexadecimais usados no escape
+const hexDigits = "0123456789ABCDEF"
+
+// Função para verificar se um byte precisa ser escapado para trafegar na linha da mensagem
+func isReserved(b byte) bool {
+	return b < 0x20 || b == 0x7f || b == ' ' || b == ':' || b == '%'
+}
+
+// Função para codificar um campo, trocando os caracteres reservados por %XX
+func Escape(field string) string {
+	// Evita alocação quando o campo não tem nenhum caractere reservado
+	needsEscape := false
+	for i := 0; i < len(field); i++ {
+		if isReserved(field[i]) {
+			needsEscape = true
+			break
+		}
+	}
+	if !needsEscape {
+		return field
+	}
+
+	// Percorre byte a byte para manter qualquer sequência UTF-8 intacta
+	var sb strings.Builder
+	sb.Grow(len(field) + 8)
+	for i := 0; i < len(field); i++ {
+		b := field[i]
+		if isReserved(b) {
+			sb.WriteByte('%')
+			sb.WriteByte(hexDigits[b>>4])
+			sb.WriteByte(hexDigits[b&0x0f])
+		} else {
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+// Função para converter um dígito hexadecimal no seu valor
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// Função para decodificar um campo codificado com Escape
+func Unescape(field string) (string, error) {
+	if !strings.Contains(field, "%") {
+		return field, nil
+	}
+
+	var sb strings.Builder
+	sb.Grow(len(field))
+	for i := 0; i < len(field); i++ {
+		if field[i] != '%' {
+			sb.WriteByte(field[i])
+			continue
+		}
+		if i+2 >= len(field) {
+			return "", errors.New("escape incompleto no campo \"" + field + "\"")
+		}
+		high, ok1 := unhex(field[i+1])
+		low, ok2 := unhex(field[i+2])
+		if !ok1 || !ok2 {
+			return "", errors.New("escape inválido no campo \"" + field + "\"")
+		}
+		sb.WriteByte(high<<4 | low)
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// Função para juntar vários campos em um único argumento, escapando cada um
+func JoinFields(fields ...string) string {
+	escaped := make([]string, len(fields))
+	for i, field := range fields {
+		escaped[i] = Escape(field)
+	}
+	return strings.Join(escaped, FIELD_SEPARATOR)
+}
+
+// Função para separar um argumento nos seus campos, desfazendo o escape de cada um
+func SplitFields(argument string) ([]string, error) {
+	parts := strings.Split(argument, FIELD_SEPARATOR)
+	for i, part := range parts {
+		field, err := Unescape(part)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = field
+	}
+	return parts, nil
+}
+
+// Função para gerar a linha da mensagem pronta para ser enviada, incluindo o \n e o conteúdo cru, se houver
+func (message BaseMessage) Encode() []byte {
+	return append([]byte(message.String()+"\n"), message.Payload...)
+}
+
+// Erros possíveis ao interpretar uma linha recebida, usados com errors.Is
+var (
+	ErrInvalidLine   = errors.New("linha inválida")
+	ErrShortMessage  = errors.New("mensagem incompleta")
+	ErrBadClock      = errors.New("relógio inválido")
+	ErrUnknownType   = errors.New("tipo de mensagem desconhecido")
+	ErrArgumentCount = errors.New("quantidade de argumentos inválida")
+)
+
+// Estrutura para o erro de uma mensagem malformada, guardando a linha recebida
+type MalformedError struct {
+	Kind   error
+	Line   string
+	Detail string
+}
+
+// Função para implementar a interface error
+func (e *MalformedError) Error() string {
+	if e.Detail == "" {
+		return e.Kind.Error() + ": \"" + e.Line + "\""
+	}
+	return e.Kind.Error() + " (" + e.Detail + "): \"" + e.Line + "\""
+}
+
+// Função para permitir errors.Is com os erros acima
+func (e *MalformedError) Unwrap() error {
+	return e.Kind
+}
+
+// Função para criar o erro de mensagem malformada
+func malformed(kind error, line string, detail string) error {
+	return &MalformedError{Kind: kind, Line: line, Detail: detail}
+}
+
+// Quantidade mínima e máxima de argumentos para cada tipo de mensagem, -1 quando não há máximo
+var argumentLimits = map[MessageType][2]int{
+	HELLO:      {0, -1},
+	GET_PEERS:  {0, 0},
+	PEERS_LIST: {1, -1},
+	LS:         {0, 0},
+	LS_LIST:    {1, -1},
+	DL:         {3, 4},
+	FILE:       {4, 5},
+	BYE:        {0, 0},
+	ERROR:      {1, 2},
+}
+
+// Função para validar os argumentos de acordo com o tipo da mensagem
+func validateArguments(messageType MessageType, arguments []string, line string) error {
+	limits := argumentLimits[messageType]
+	if len(arguments) < limits[0] || (limits[1] >= 0 && len(arguments) > limits[1]) {
+		return malformed(ErrArgumentCount, line, messageType.String()+" com "+strconv.Itoa(len(arguments))+" argumentos")
+	}
+
+	switch messageType {
+	case HELLO:
+		// As capacidades vêm sempre no formato chave=valor
+		for _, argument := range arguments {
+			if !strings.Contains(argument, "=") {
+				return malformed(ErrArgumentCount, line, "capacidade sem valor")
+			}
+		}
+	case FILE:
+		// Com conteúdo cru, o tamanho informado diz quantos bytes vêm depois da linha
+		// Nenhum peer responde chunks maiores que MAX_CHUNK_SIZE, então um tamanho maior é recusado antes de alocar o conteúdo
+		if arguments[3] == BINARY_DATA {
+			size, err := strconv.Atoi(arguments[1])
+			if err != nil || size < 0 || size > MAX_CHUNK_SIZE {
+				return malformed(ErrArgumentCount, line, "tamanho do conteúdo inválido")
+			}
+		}
+		// O quinto argumento (opcional) é o SHA-256 do chunk
+		if len(arguments) > 4 && !files.IsHash(arguments[4]) {
+			return malformed(ErrArgumentCount, line, "hash do chunk inválido")
+		}
+	case PEERS_LIST, LS_LIST:
+		// O primeiro argumento indica quantos itens vêm em seguida
+		count, err := strconv.Atoi(arguments[0])
+		if err != nil || count != len(arguments)-1 {
+			return malformed(ErrArgumentCount, line, "quantidade de itens não confere")
+		}
+	}
+	return nil
+}
+
+// Função para interpretar uma linha recebida e montar a mensagem
+// Os erros retornados são sempre *MalformedError, para que uma linha qualquer nunca derrube quem está lendo
+func Decode(line string) (BaseMessage, error) {
+	// Remove o final de linha e separa as partes da mensagem
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	if strings.ContainsAny(line, "\r\n") {
+		return BaseMessage{}, malformed(ErrInvalidLine, line, "quebra de linha no meio da mensagem")
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) < 3 {
+		return BaseMessage{}, malformed(ErrShortMessage, line, "")
+	}
+	if parts[0] == "" {
+		return BaseMessage{}, malformed(ErrInvalidLine, line, "origem vazia")
+	}
+
+	// Converte o relógio, que pode trazer o relógio vetorial, e o tipo da mensagem
+	clockString, vectorString, hasVector := strings.Cut(parts[1], VECTOR_CLOCK_SEPARATOR)
+	receivedClock, err := strconv.Atoi(clockString)
+	if err != nil || receivedClock < 0 {
+		return BaseMessage{}, malformed(ErrBadClock, line, "")
+	}
+	var receivedVector clock.Vector
+	if hasVector {
+		receivedVector, err = clock.ParseVector(vectorString)
+		if err != nil {
+			return BaseMessage{}, malformed(ErrBadClock, line, err.Error())
+		}
+	}
+	messageType := GetMessageType(parts[2])
+	if messageType == UNKNOWN {
+		return BaseMessage{}, malformed(ErrUnknownType, line, "")
+	}
+	var arguments []string
+	if len(parts) > 3 {
+		arguments = parts[3:]
+	}
+	if err := validateArguments(messageType, arguments, line); err != nil {
+		return BaseMessage{}, err
+	}
+
+	return BaseMessage{
+		Origin:    parts[0],
+		Clock:     receivedClock,
+		Vector:    receivedVector,
+		Type:      messageType,
+		Arguments: arguments,
+	}, nil
+}
@@ -0,0 +1,85 @@
+package message
+
+// Pacotes nativos de go
+import (
+	"strings"
+)
+
+// Tipo int para o código de erro da mensagem ERROR
+type ErrorCode uint8
+
+// Constantes para os códigos de erro, funcionando como um enum
+const (
+	UNKNOWN_ERROR ErrorCode = iota
+	FILE_NOT_FOUND
+	BAD_INDEX
+	BAD_ARGS
+	BUSY
+)
+
+// Função para retornar a string do código de erro
+func (code ErrorCode) String() string {
+	switch code {
+	case FILE_NOT_FOUND:
+		return "FILE_NOT_FOUND"
+	case BAD_INDEX:
+		return "BAD_INDEX"
+	case BAD_ARGS:
+		return "BAD_ARGS"
+	case BUSY:
+		return "BUSY"
+	default:
+		return "UNKNOWN_ERROR"
+	}
+}
+
+// Função para obter o código de erro a partir de uma string
+func GetErrorCode(s string) ErrorCode {
+	switch strings.TrimSpace(s) {
+	case "FILE_NOT_FOUND":
+		return FILE_NOT_FOUND
+	case "BAD_INDEX":
+		return BAD_INDEX
+	case "BAD_ARGS":
+		return BAD_ARGS
+	case "BUSY":
+		return BUSY
+	default:
+		return UNKNOWN_ERROR
+	}
+}
+
+// Estrutura para o erro informado por um peer através da mensagem ERROR
+type RemoteError struct {
+	Origin string
+	Code   ErrorCode
+	Detail string
+}
+
+// Função para implementar a interface error
+func (e RemoteError) Error() string {
+	if e.Detail == "" {
+		return e.Origin + " respondeu " + e.Code.String()
+	}
+	return e.Origin + " respondeu " + e.Code.String() + ": " + e.Detail
+}
+
+// Função para montar os argumentos da mensagem ERROR
+func ErrorArguments(code ErrorCode, detail string) []string {
+	return []string{code.String(), Escape(detail)}
+}
+
+// Função para ler o erro a partir de uma mensagem ERROR recebida
+func ParseError(message BaseMessage) RemoteError {
+	remoteError := RemoteError{Origin: message.Origin, Code: UNKNOWN_ERROR}
+	if len(message.Arguments) > 0 {
+		remoteError.Code = GetErrorCode(message.Arguments[0])
+	}
+	if len(message.Arguments) > 1 {
+		detail, err := Unescape(message.Arguments[1])
+		if err == nil {
+			remoteError.Detail = detail
+		}
+	}
+	return remoteError
+}
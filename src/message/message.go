@@ -4,6 +4,8 @@ package message
 import (
 	"strconv"
 	"strings"
+
+	"eachare/src/clock"
 )
 
 // Tipo int para o comando
@@ -20,16 +22,28 @@ const (
 	DL
 	FILE
 	BYE
+	ERROR
 )
 
+// Marcador usado no lugar do conteúdo do FILE quando os bytes vêm crus depois da linha
+const BINARY_DATA = "-"
+
 // Estrutura para armazenar as informações da mensagem
+// Os argumentos já estão no formato da linha, isto é, com os campos escapados (ver Escape e JoinFields)
+// Payload guarda os bytes crus enviados após a linha, usados no FILE com BINARY_ENCODING
+// Vector guarda o relógio vetorial, enviado só para peers com VECTOR_FEATURE (ver clockField)
 type BaseMessage struct {
 	Origin    string
 	Clock     int
+	Vector    clock.Vector
 	Type      MessageType
 	Arguments []string
+	Payload   []byte
 }
 
+// Separador entre o relógio escalar e o vetorial no campo do relógio, ex.: "5|127.0.0.1:9001=3"
+const VECTOR_CLOCK_SEPARATOR = "|"
+
 // Função para retornar a string do tipo de comando
 func (messageType MessageType) String() string {
 	switch messageType {
@@ -49,6 +63,8 @@ func (messageType MessageType) String() string {
 		return "FILE"
 	case BYE:
 		return "BYE"
+	case ERROR:
+		return "ERROR"
 	default:
 		return "UNKNOWN"
 	}
@@ -77,6 +93,8 @@ func GetMessageType(s string) MessageType {
 		return FILE
 	case "BYE":
 		return BYE
+	case "ERROR":
+		return ERROR
 	default:
 		return UNKNOWN
 	}
@@ -86,11 +104,24 @@ func GetMessageType(s string) MessageType {
 func (message BaseMessage) String() string {
 	// Cria a string apenas do argumento da mensagem
 	arguments := ""
-	if message.Arguments != nil {
+	if len(message.Arguments) > 0 {
 		arguments = " " + strings.Join(message.Arguments, " ")
 	}
 
 	// Cria a string da mensagem inteira e retorna
-	messageStr := message.Origin + " " + strconv.Itoa(message.Clock) + " " + message.Type.String() + arguments
+	messageStr := message.Origin + " " + message.clockField() + " " + message.Type.String() + arguments
 	return messageStr
 }
+
+// Função para o campo do relógio, com o relógio vetorial depois do escalar quando houver
+func (message BaseMessage) clockField() string {
+	if len(message.Vector) == 0 {
+		return strconv.Itoa(message.Clock)
+	}
+	return strconv.Itoa(message.Clock) + VECTOR_CLOCK_SEPARATOR + message.Vector.String()
+}
+
+// Função para verificar se a mensagem é seguida por bytes crus
+func (message BaseMessage) HasBinaryPayload() bool {
+	return message.Type == FILE && len(message.Arguments) >= 4 && message.Arguments[3] == BINARY_DATA
+}
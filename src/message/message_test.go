@@ -1,6 +1,12 @@
 package message
 
-import "testing"
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
 
 func TestGetCommandType(t *testing.T) {
 	tests := []struct {
@@ -37,3 +43,232 @@ func TestCommandTypeString(t *testing.T) {
 		}
 	}
 }
+
+func TestEscapeRoundTrip(t *testing.T) {
+	tests := []string{
+		"hello.txt",
+		"my report.pdf",
+		"a:b:c",
+		"linha\nnova",
+		"100%",
+		"ação ünïcødé 日本.txt",
+		"",
+	}
+
+	for _, test := range tests {
+		escaped := Escape(test)
+		if strings.ContainsAny(escaped, " :\n\r") {
+			t.Errorf("Escape(%q) = %q; still contains reserved characters", test, escaped)
+		}
+		result, err := Unescape(escaped)
+		if err != nil || result != test {
+			t.Errorf("Unescape(Escape(%q)) = %q, %v; expected %q", test, result, err, test)
+		}
+	}
+}
+
+func TestUnescapeInvalid(t *testing.T) {
+	for _, input := range []string{"%", "%2", "%zz", "abc%G0"} {
+		if _, err := Unescape(input); err == nil {
+			t.Errorf("Unescape(%q) expected an error", input)
+		}
+	}
+}
+
+func TestFieldsRoundTrip(t *testing.T) {
+	fields := []string{"my report:final.pdf", "1024"}
+	argument := JoinFields(fields...)
+	if argument != "my%20report%3Afinal.pdf:1024" {
+		t.Errorf("JoinFields(%q) = %q", fields, argument)
+	}
+	result, err := SplitFields(argument)
+	if err != nil || !reflect.DeepEqual(result, fields) {
+		t.Errorf("SplitFields(%q) = %q, %v; expected %q", argument, result, err, fields)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	msg, err := Decode("127.0.0.1:9001 3 DL my%20file.txt 256 0\n")
+	if err != nil {
+		t.Fatalf("Decode returned error: %v", err)
+	}
+	expected := BaseMessage{Origin: "127.0.0.1:9001", Clock: 3, Type: DL, Arguments: []string{"my%20file.txt", "256", "0"}}
+	if !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Decode = %+v; expected %+v", msg, expected)
+	}
+
+	for _, line := range []string{"", "127.0.0.1:9001", "127.0.0.1:9001 abc HELLO"} {
+		if _, err := Decode(line); err == nil {
+			t.Errorf("Decode(%q) expected an error", line)
+		}
+	}
+}
+
+func TestDecodeVectorClock(t *testing.T) {
+	line := "127.0.0.1:9001 5|127.0.0.1:9001=3,127.0.0.1:9002=1 GET_PEERS"
+	msg, err := Decode(line + "\n")
+	if err != nil {
+		t.Fatalf("Decode returned error: %v", err)
+	}
+	if msg.Clock != 5 || msg.Vector["127.0.0.1:9001"] != 3 || msg.Vector["127.0.0.1:9002"] != 1 {
+		t.Errorf("Decode = %+v; expected clock 5 and the vector", msg)
+	}
+	if msg.String() != line {
+		t.Errorf("String() = %q; expected %q", msg.String(), line)
+	}
+
+	for _, invalid := range []string{"a:1 5| LS", "a:1 5|b LS", "a:1 x|b=1 LS", "a:1 5|b=1|c=2 LS"} {
+		if _, err := Decode(invalid); !errors.Is(err, ErrBadClock) {
+			t.Errorf("Decode(%q) expected ErrBadClock, got %v", invalid, err)
+		}
+	}
+}
+
+func TestDecodeBinaryFile(t *testing.T) {
+	msg := BaseMessage{Origin: "127.0.0.1:9001", Clock: 4, Type: FILE, Arguments: []string{"a.bin", "3", "0", BINARY_DATA}, Payload: []byte{0, '\n', 0xff}}
+	encoded := msg.Encode()
+	line, payload, _ := strings.Cut(string(encoded), "\n")
+	if payload != string(msg.Payload) {
+		t.Errorf("Encode payload = %q; expected %q", payload, msg.Payload)
+	}
+	decoded, err := Decode(line)
+	if err != nil || !decoded.HasBinaryPayload() {
+		t.Errorf("Decode(%q) = %+v, %v; expected binary FILE", line, decoded, err)
+	}
+	limit := "127.0.0.1:9001 4 FILE a.bin " + strconv.Itoa(MAX_CHUNK_SIZE) + " 0 -"
+	if _, err := Decode(limit); err != nil {
+		t.Errorf("Decode(%q) expected a payload of MAX_CHUNK_SIZE to be accepted, got %v", limit, err)
+	}
+	digest := line + " " + strings.Repeat("ab", 32)
+	if decoded, err := Decode(digest); err != nil || !decoded.HasBinaryPayload() {
+		t.Errorf("Decode(%q) = %+v, %v; expected binary FILE with digest", digest, decoded, err)
+	}
+
+	for _, line := range []string{
+		"127.0.0.1:9001 4 FILE a.bin abc 0 -",
+		"127.0.0.1:9001 4 FILE a.bin -1 0 -",
+		"127.0.0.1:9001 4 FILE a.bin 999999999999 0 -",
+		"127.0.0.1:9001 4 FILE a.bin " + strconv.Itoa(MAX_CHUNK_SIZE+1) + " 0 -",
+		"127.0.0.1:9001 4 FILE a.bin 3 0 - abc",
+	} {
+		if _, err := Decode(line); err == nil {
+			t.Errorf("Decode(%q) expected an error", line)
+		}
+	}
+}
+
+func FuzzEscape(f *testing.F) {
+	for _, seed := range []string{"hello.txt", "my report.pdf", "a:b", "x\ny", "%41", "日本"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, field string) {
+		escaped := Escape(field)
+		if strings.ContainsAny(escaped, " :\n\r") {
+			t.Fatalf("Escape(%q) = %q; still contains reserved characters", field, escaped)
+		}
+		result, err := Unescape(escaped)
+		if err != nil || result != field {
+			t.Fatalf("Unescape(Escape(%q)) = %q, %v", field, result, err)
+		}
+	})
+}
+
+func FuzzFields(f *testing.F) {
+	f.Add("my report.pdf", "1024")
+	f.Add("127.0.0.1", "9001")
+	f.Add("a:b", "")
+	f.Fuzz(func(t *testing.T, first string, second string) {
+		argument := JoinFields(first, second)
+		if strings.ContainsAny(argument, " \n") {
+			t.Fatalf("JoinFields produced a multi-token argument: %q", argument)
+		}
+		result, err := SplitFields(argument)
+		if err != nil || len(result) != 2 || result[0] != first || result[1] != second {
+			t.Fatalf("SplitFields(JoinFields(%q, %q)) = %q, %v", first, second, result, err)
+		}
+	})
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add("127.0.0.1:9001 1 HELLO\n")
+	f.Add("127.0.0.1:9001 2 LS_LIST 2 my%20file.txt:10 b.txt:20\n")
+	f.Add("127.0.0.1:9001 x DL\n")
+	f.Add("127.0.0.1:9001 4|127.0.0.1:9001=2,127.0.0.1:9002=1 BYE\n")
+	f.Add("  \n")
+	f.Fuzz(func(t *testing.T, line string) {
+		msg, err := Decode(line)
+		if err != nil {
+			return
+		}
+		// Uma mensagem decodificada precisa sobreviver a uma nova codificação
+		again, err := Decode(string(msg.Encode()))
+		if err != nil {
+			t.Fatalf("Decode(Encode(%+v)) returned error: %v", msg, err)
+		}
+		if again.String() != msg.String() {
+			t.Fatalf("Decode(Encode(m)) = %q; expected %q", again.String(), msg.String())
+		}
+	})
+}
+
+func TestCapabilitiesRoundTrip(t *testing.T) {
+	local := LocalCapabilities()
+	parsed, err := ParseCapabilities(local.Arguments())
+	if err != nil {
+		t.Fatalf("ParseCapabilities returned error: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, local) {
+		t.Errorf("ParseCapabilities(Arguments()) = %+v; expected %+v", parsed, local)
+	}
+}
+
+func TestCapabilitiesLegacy(t *testing.T) {
+	parsed, err := ParseCapabilities(nil)
+	if err != nil {
+		t.Fatalf("ParseCapabilities returned error: %v", err)
+	}
+	if parsed.Version != LEGACY_VERSION || !parsed.Supports(DL) || parsed.ChunkLimit() != 0 {
+		t.Errorf("Unexpected legacy capabilities: %+v", parsed)
+	}
+
+	var unknown Capabilities
+	if unknown.Known() || !unknown.SupportsEncoding(BASE64_ENCODING) {
+		t.Errorf("Zero capabilities should behave as legacy: %+v", unknown)
+	}
+}
+
+func TestCapabilitiesInvalid(t *testing.T) {
+	tests := [][]string{
+		{"version"},
+		{"version=abc"},
+		{"types=HELLO"},
+		{"version=2", "chunk=-1"},
+	}
+	for _, test := range tests {
+		if _, err := ParseCapabilities(test); err == nil {
+			t.Errorf("ParseCapabilities(%q) expected an error", test)
+		}
+	}
+
+	// Chaves desconhecidas não podem quebrar a negociação
+	parsed, err := ParseCapabilities([]string{"version=3", "future=x"})
+	if err != nil || parsed.Version != 3 {
+		t.Errorf("ParseCapabilities with unknown key = %+v, %v", parsed, err)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	msg := BaseMessage{Origin: "127.0.0.1:9002", Clock: 4, Type: ERROR, Arguments: ErrorArguments(FILE_NOT_FOUND, "my report.pdf")}
+	decoded, err := Decode(string(msg.Encode()))
+	if err != nil {
+		t.Fatalf("Decode returned error: %v", err)
+	}
+
+	remoteErr := ParseError(decoded)
+	if remoteErr.Code != FILE_NOT_FOUND || remoteErr.Detail != "my report.pdf" || remoteErr.Origin != "127.0.0.1:9002" {
+		t.Errorf("ParseError = %+v", remoteErr)
+	}
+	if GetErrorCode("NOT_A_CODE") != UNKNOWN_ERROR {
+		t.Errorf("GetErrorCode should return UNKNOWN_ERROR for unknown codes")
+	}
+}
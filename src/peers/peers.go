@@ -1,9 +1,13 @@
 package peers
 
-// Pacotes nativos de go
+// Pacotes nativos de go e pacote interno
 import (
 	"sort"
 	"sync"
+	"time"
+
+	"eachare/src/clock"
+	"eachare/src/message"
 )
 
 // Booleano para o status do peer
@@ -16,16 +20,35 @@ const (
 )
 
 // Estrutura para armazenar informações do peer conhecido
+// Vector é o relógio vetorial do momento em que o status foi observado, vazio no modo de Lamport
+// LastSeen é o último contato direto com o peer, e Failures conta os envios que falharam desde então
 type Peer struct {
-	Address string
-	Status  PeerStatus
-	Clock   int
+	Address      string
+	Status       PeerStatus
+	Clock        int
+	Vector       clock.Vector
+	LastSeen     time.Time
+	Failures     int
+	Capabilities message.Capabilities
 }
 
+// Define uma int para o resultado de juntar uma informação recebida à tabela de peers
+type MergeResult uint8
+
+// Define uma enum para os resultados do Merge
+const (
+	ADDED      MergeResult = iota // O peer não era conhecido e foi adicionado
+	NEWER                         // A informação recebida é mais recente e substituiu a conhecida
+	OUTDATED                      // A informação recebida é antiga ou igual e foi ignorada
+	CONCURRENT                    // As duas informações são concorrentes e a regra de conflito decidiu
+)
+
 // Estrutura para armazenar a lista de peers de forma segura
+// onChange, se definido, é chamado a cada alteração da tabela, ver SetOnChange
 type SafePeers struct {
-	mutex sync.RWMutex
-	peers []Peer
+	mutex    sync.RWMutex
+	peers    []Peer
+	onChange func()
 }
 
 // Função para obter o estado do peer a partir do PeerStatus
@@ -48,7 +71,64 @@ func GetStatus(status string) PeerStatus {
 func (s *SafePeers) Add(peer Peer) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	s.add(peer)
+	s.changed()
+}
+
+// Função para colocar na tabela um peer guardado de uma execução anterior, substituindo o que se sabia dele
+// As capacidades não são guardadas, então as já conhecidas são mantidas
+func (s *SafePeers) Restore(peer Peer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := sort.Search(len(s.peers), func(i int) bool {
+		return s.peers[i].Address >= peer.Address
+	})
+	if i < len(s.peers) && s.peers[i].Address == peer.Address {
+		peer.Capabilities = s.peers[i].Capabilities
+		s.peers[i] = peer
+	} else {
+		s.add(peer)
+	}
+	s.changed()
+}
+
+// Função para registrar quem é avisado das alterações da tabela, como o salvamento em disco
+// O aviso é feito com o mutex bloqueado, então não pode consultar a tabela nem travar
+func (s *SafePeers) SetOnChange(onChange func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onChange = onChange
+}
+
+// Função para avisar uma alteração da tabela, com o mutex já bloqueado
+func (s *SafePeers) changed() {
+	if s.onChange != nil {
+		s.onChange()
+	}
+}
+
+// Função para registrar um envio que falhou, marcando o peer OFFLINE e retornando quantas falhas seguidas ele tem
+func (s *SafePeers) RecordFailure(address string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := sort.Search(len(s.peers), func(i int) bool {
+		return s.peers[i].Address >= address
+	})
+	if i == len(s.peers) || s.peers[i].Address != address {
+		s.add(Peer{Address: address, Status: OFFLINE, Failures: 1})
+		s.changed()
+		return 1
+	}
+	s.peers[i].Status = OFFLINE
+	s.peers[i].Failures++
+	s.changed()
+	return s.peers[i].Failures
+}
 
+// Função para adicionar ou atualizar o peer, com o mutex já bloqueado
+func (s *SafePeers) add(peer Peer) {
 	// Se a lista estiver vazia, adiciona o peer diretamente
 	if len(s.peers) == 0 {
 		s.peers = append(s.peers, peer)
@@ -61,9 +141,17 @@ func (s *SafePeers) Add(peer Peer) {
 	})
 
 	if i < len(s.peers) && s.peers[i].Address == peer.Address {
-		// Se o peer já existe, atualiza o status e o clock
+		// Se o peer já existe, atualiza o status e o clock, e o vetor se ele veio junto
+		// Um LastSeen preenchido indica um contato direto com o peer, que zera as falhas
 		s.peers[i].Status = peer.Status
 		s.peers[i].Clock = peer.Clock
+		if peer.Vector != nil {
+			s.peers[i].Vector = peer.Vector
+		}
+		if !peer.LastSeen.IsZero() {
+			s.peers[i].LastSeen = peer.LastSeen
+			s.peers[i].Failures = 0
+		}
 	} else {
 		// Se não, extende o slice, desloca os peers e adiciona na posição correta
 		s.peers = append(s.peers, Peer{})
@@ -72,6 +160,77 @@ func (s *SafePeers) Add(peer Peer) {
 	}
 }
 
+// Função para juntar à tabela uma informação sobre um peer recebida de outro peer (ex.: no PEERS_LIST)
+// Com os dois relógios vetoriais, a informação só substitui a conhecida se aconteceu depois dela
+// Em informações concorrentes vale a regra de conflito de resolveConflict
+// Sem algum dos vetores, vale o relógio escalar como no formato original: maior ou igual substitui
+func (s *SafePeers) Merge(update Peer) (Peer, MergeResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	i := sort.Search(len(s.peers), func(i int) bool {
+		return s.peers[i].Address >= update.Address
+	})
+	if i == len(s.peers) || s.peers[i].Address != update.Address {
+		s.add(update)
+		s.changed()
+		return update, ADDED
+	}
+	current := s.peers[i]
+
+	result := NEWER
+	merged := current
+	if len(update.Vector) == 0 || len(current.Vector) == 0 {
+		if update.Clock < current.Clock {
+			return current, OUTDATED
+		}
+		merged.Status, merged.Clock = update.Status, update.Clock
+	} else {
+		switch update.Vector.Compare(current.Vector) {
+		case clock.BEFORE, clock.EQUAL:
+			return current, OUTDATED
+		case clock.AFTER:
+			merged.Status, merged.Clock = update.Status, update.Clock
+		case clock.CONCURRENT:
+			merged.Status = resolveConflict(current, update)
+			merged.Clock = max(current.Clock, update.Clock)
+			result = CONCURRENT
+		}
+	}
+	merged.Vector = current.Vector.Merge(update.Vector)
+	s.peers[i] = merged
+	s.changed()
+	return merged, result
+}
+
+// Regra de conflito para duas informações concorrentes sobre o mesmo peer
+// Vence a que viu mais eventos do próprio peer (a entrada dele no vetor), já que reflete o estado mais recente dele
+// Empatando, vence OFFLINE: mandar mensagem para um peer que voltou só custa uma tentativa, o contrário trava requisições
+func resolveConflict(current Peer, update Peer) PeerStatus {
+	currentSeen, updateSeen := current.Vector[current.Address], update.Vector[update.Address]
+	switch {
+	case updateSeen > currentSeen:
+		return update.Status
+	case currentSeen > updateSeen:
+		return current.Status
+	default:
+		return current.Status && update.Status
+	}
+}
+
+// Função para guardar as capacidades anunciadas por um peer já conhecido
+func (s *SafePeers) SetCapabilities(address string, capabilities message.Capabilities) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.peers {
+		if s.peers[i].Address == address {
+			s.peers[i].Capabilities = capabilities
+			return
+		}
+	}
+}
+
 // Função para obter um peer do SafePeers pelo endereço
 func (s *SafePeers) Get(address string) (Peer, bool) {
 	s.mutex.RLock()
@@ -0,0 +1,159 @@
+package main
+
+// Pacotes nativos de go e pacotes internos
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"eachare/src/clock"
+	"eachare/src/logger"
+	"eachare/src/peers"
+	"eachare/src/state"
+)
+
+// Intervalo mínimo entre duas gravações da tabela de peers, para juntar várias alterações seguidas numa gravação só
+const STATE_SAVE_DELAY = time.Second
+
+// Estrutura para o estado do peer guardado no diretório de dados
+// value e vector são o último checkpoint do relógio, gravado junto com a tabela de peers em toda gravação
+type persistence struct {
+	store *state.Store
+
+	mu     sync.Mutex
+	value  int
+	vector clock.Vector
+	closed bool
+
+	pending chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// Função para guardar o estado do peer no diretório de dados, restaurando o que foi guardado na execução anterior
+// Deve ser chamada depois de useClock e de carregar os vizinhos, com os quais a tabela guardada é juntada
+func (c *Client) usePersistence(dir string) error {
+	store, err := state.NewStore(dir)
+	if err != nil {
+		return err
+	}
+	saved, err := store.Load()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w", store.Path(), err)
+	}
+	if err == nil {
+		c.restoreState(saved)
+	}
+
+	c.state = &persistence{store: store, pending: make(chan struct{}, 1), done: make(chan struct{}), stopped: make(chan struct{})}
+	c.clock.SetCheckpoint(c.checkpoint)
+	c.knownPeers.SetOnChange(c.state.notify)
+	go c.savePendingState(c.state)
+	return nil
+}
+
+// Função para restaurar o relógio e a tabela de peers a partir do estado guardado
+// O relógio guardado em um modo de outra escala é ignorado, já que um valor do híbrido no Lamport iria para todos os vizinhos
+// Um peer que também está no arquivo de vizinhos fica com o maior relógio entre os dois
+func (c *Client) restoreState(saved state.State) {
+	if mode, err := clock.GetMode(saved.Mode); err == nil && mode.SameScale(c.clock.Mode()) {
+		c.clock.Restore(saved.Clock, saved.Vector)
+		logger.Std("Relógio restaurado para " + strconv.Itoa(c.clock.Get()) + "\n")
+	} else {
+		logger.Std("Relógio guardado no modo " + saved.Mode + " ignorado, já que o relógio atual é " + c.clock.Mode().String() + "\n")
+	}
+	for _, savedPeer := range saved.Peers {
+		neighbor, _ := c.knownPeers.Get(savedPeer.Address)
+		c.knownPeers.Restore(peers.Peer{
+			Address:  savedPeer.Address,
+			Status:   peers.GetStatus(savedPeer.Status),
+			Clock:    max(neighbor.Clock, savedPeer.Clock),
+			Vector:   neighbor.Vector.Merge(savedPeer.Vector),
+			LastSeen: savedPeer.LastSeen,
+			Failures: savedPeer.Failures,
+		})
+		logger.Std("Restaurando peer " + savedPeer.Address + " status " + savedPeer.Status + "\n")
+	}
+}
+
+// Função para gravar um checkpoint do relógio, chamada pelo próprio relógio
+func (c *Client) checkpoint(value int, vector clock.Vector) {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	c.state.value, c.state.vector = value, vector
+	c.writeState()
+}
+
+// Função para gravar o estado com o último checkpoint do relógio, como ao sair com BYE
+func (c *Client) saveState() {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	c.writeState()
+}
+
+// Função para gravar o relógio e a tabela de peers, com o mutex do estado já bloqueado
+// O mutex garante que uma gravação da tabela nunca volte para um checkpoint anterior do relógio
+func (c *Client) writeState() {
+	if c.state.closed {
+		return
+	}
+	saved := state.State{Mode: c.clock.Mode().String(), Clock: c.state.value, Vector: c.state.vector}
+	for _, peer := range c.knownPeers.GetAll() {
+		saved.Peers = append(saved.Peers, state.PeerState{
+			Address:  peer.Address,
+			Status:   peer.Status.String(),
+			Clock:    peer.Clock,
+			Vector:   peer.Vector,
+			LastSeen: peer.LastSeen,
+			Failures: peer.Failures,
+		})
+	}
+	if err := c.state.store.Save(saved); err != nil {
+		logger.Error("Falha ao gravar o estado em " + c.state.store.Path() + ": " + err.Error())
+	}
+}
+
+// Função para avisar que a tabela de peers mudou, sem travar quem a alterou
+func (p *persistence) notify() {
+	select {
+	case p.pending <- struct{}{}:
+	default:
+	}
+}
+
+// Função para gravar a tabela de peers quando ela muda, no máximo uma vez a cada STATE_SAVE_DELAY
+func (c *Client) savePendingState(p *persistence) {
+	defer close(p.stopped)
+	for {
+		select {
+		case <-p.pending:
+			c.saveState()
+		case <-p.done:
+			return
+		}
+		select {
+		case <-time.After(STATE_SAVE_DELAY):
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Função para parar de gravar o estado, como se o processo tivesse terminado
+func (c *Client) stopPersistence() {
+	if c.state == nil {
+		return
+	}
+	c.state.mu.Lock()
+	closed := c.state.closed
+	c.state.closed = true
+	c.state.mu.Unlock()
+	if closed {
+		return
+	}
+	close(c.state.done)
+	<-c.state.stopped
+}
@@ -3,86 +3,222 @@ package response
 // Pacotes nativos de go e pacotes internos
 import (
 	"encoding/base64"
+	"errors"
+	"io/fs"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 
+	"eachare/src/clock"
 	"eachare/src/connection"
+	"eachare/src/files"
 	"eachare/src/logger"
 	"eachare/src/message"
 	"eachare/src/peers"
 )
 
-// Função para verificar e imprimir mensagem de erro
-func check(err error) {
+// Quantidade máxima de DL atendidos ao mesmo tempo antes de responder BUSY
+const MAX_CONCURRENT_RESPONSES = 128
+
+// Semáforo para os DL sendo atendidos
+var inFlight = make(chan struct{}, MAX_CONCURRENT_RESPONSES)
+
+// Função para responder uma requisição com a mensagem ERROR
+// Peers que não anunciaram suporte ao ERROR apenas têm a conexão fechada, como no formato original
+func ErrorResponse(knownPeers *peers.SafePeers, localClock *clock.Clock, receiverAddress string, senderAddress string, code message.ErrorCode, detail string, conn net.Conn) {
+	logger.Info("Recusando requisição de " + receiverAddress + ": " + code.String() + " " + detail)
+	neighbor, _ := knownPeers.Get(receiverAddress)
+	if !neighbor.Capabilities.Supports(message.ERROR) {
+		return
+	}
+
+	sendMessage := message.BaseMessage{Origin: senderAddress, Clock: 0, Type: message.ERROR, Arguments: message.ErrorArguments(code, detail)}
+	connection.SendMessage(knownPeers, localClock, conn, sendMessage, receiverAddress)
+}
+
+// Função para lidar com o HELLO recebido, guardando as capacidades do peer
+func HelloResponse(knownPeers *peers.SafePeers, localClock *clock.Clock, receivedMessage message.BaseMessage, senderAddress string, conn net.Conn) {
+	capabilities, err := message.ParseCapabilities(receivedMessage.Arguments)
 	if err != nil {
-		panic(err)
+		logger.Error("Capacidades inválidas recebidas de " + receivedMessage.Origin + ": " + err.Error())
+		return
+	}
+	knownPeers.SetCapabilities(receivedMessage.Origin, capabilities)
+
+	// Peers no formato original não esperam resposta do HELLO
+	if capabilities.Version <= message.LEGACY_VERSION {
+		return
+	}
+
+	// Responde com as próprias capacidades para completar a negociação, marcando a resposta de um heartbeat
+	arguments := message.LocalCapabilities().Arguments()
+	if message.IsHeartbeat(receivedMessage) {
+		arguments = append(arguments, message.HEARTBEAT_ARGUMENT)
 	}
+	sendMessage := message.BaseMessage{Origin: senderAddress, Clock: 0, Type: message.HELLO, Arguments: arguments}
+	connection.SendMessage(knownPeers, localClock, conn, sendMessage, receivedMessage.Origin)
 }
 
 // Função para lidar com o GET_PEERS recebido
-func GetPeersResponse(knownPeers *peers.SafePeers, receiverAddress string, senderAddress string, conn net.Conn) {
+func GetPeersResponse(knownPeers *peers.SafePeers, localClock *clock.Clock, receiverAddress string, senderAddress string, conn net.Conn) {
 	// Cria uma lista de strings para os peers conhecidos
 	myPeers := make([]string, 0)
 
 	// Adiciona cada peer conhecido na lista, exceto quem pediu a lista
+	// Para quem entende o relógio vetorial, cada peer leva como quinto campo o vetor de quando seu status foi visto
+	receiver, _ := knownPeers.Get(receiverAddress)
+	sendVectors := receiver.Capabilities.HasFeature(message.VECTOR_FEATURE)
 	for _, peer := range knownPeers.GetAll() {
 		if peer.Address == receiverAddress {
 			continue
 		}
-		myPeers = append(myPeers, peer.Address+":"+peer.Status.String()+":"+strconv.Itoa(peer.Clock))
+		host, port, err := net.SplitHostPort(peer.Address)
+		if err != nil {
+			host, port = peer.Address, ""
+		}
+		fields := []string{host, port, peer.Status.String(), strconv.Itoa(peer.Clock)}
+		if sendVectors && len(peer.Vector) > 0 {
+			fields = append(fields, peer.Vector.String())
+		}
+		myPeers = append(myPeers, message.JoinFields(fields...))
 	}
 
 	// Cria uma única string da lista inteira e envia a mensagem
 	arguments := append([]string{strconv.Itoa(len(myPeers))}, myPeers...)
 	sendMessage := message.BaseMessage{Origin: senderAddress, Clock: 0, Type: message.PEERS_LIST, Arguments: arguments}
-	connection.SendMessage(knownPeers, conn, sendMessage, receiverAddress)
+	connection.SendMessage(knownPeers, localClock, conn, sendMessage, receiverAddress)
 }
 
 // Função para lidar com o LS recebido
-func LsResponse(knownPeers *peers.SafePeers, receiverAddress string, senderAddress string, sharedPath string, conn net.Conn) {
+func LsResponse(knownPeers *peers.SafePeers, localClock *clock.Clock, receiverAddress string, senderAddress string, sharedPath string, conn net.Conn) {
 	// Cria uma lista de strings para os peers conhecidos
 	myFiles := make([]string, 0)
 
 	// Lê o diretório e imprime os arquivos
 	entries, err := os.ReadDir(sharedPath)
-	check(err)
+	if err != nil {
+		ErrorResponse(knownPeers, localClock, receiverAddress, senderAddress, message.FILE_NOT_FOUND, "diretório compartilhado indisponível", conn)
+		return
+	}
+	// Peers que entendem hashes recebem também o SHA-256 de cada arquivo, no formato nome:tamanho:hash
+	neighbor, _ := knownPeers.Get(receiverAddress)
+	withHash := neighbor.Capabilities.HasFeature(message.HASH_FEATURE)
 	for _, entry := range entries {
-		stat, _ := entry.Info()
-		myFiles = append(myFiles, entry.Name()+":"+strconv.Itoa(int(stat.Size())))
+		stat, err := entry.Info()
+		if err != nil || files.IsPartial(entry.Name()) {
+			continue
+		}
+		fields := []string{entry.Name(), strconv.Itoa(int(stat.Size()))}
+		if withHash {
+			if hash, err := files.Hash(sharedPath + entry.Name()); err == nil {
+				fields = append(fields, hash)
+			}
+		}
+		myFiles = append(myFiles, message.JoinFields(fields...))
 	}
 
 	// Cria uma única string da lista inteira e envia a mensagem
 	arguments := append([]string{strconv.Itoa(len(myFiles))}, myFiles...)
 	sendMessage := message.BaseMessage{Origin: senderAddress, Clock: 0, Type: message.LS_LIST, Arguments: arguments}
-	connection.SendMessage(knownPeers, conn, sendMessage, receiverAddress)
+	connection.SendMessage(knownPeers, localClock, conn, sendMessage, receiverAddress)
 }
 
-// Função para lidar com o LS recebido
-func DlResponse(knownPeers *peers.SafePeers, receivedMessage message.BaseMessage, senderAddress string, sharedPath string, conn net.Conn) {
-	// Lê o arquivo escolhido e codifica em base64
-	chosenFile := receivedMessage.Arguments[0]
-	receivedChunkSizeString := receivedMessage.Arguments[1]
-	receivedChunkSize, _ := strconv.Atoi(receivedChunkSizeString)
+// Função para lidar com o DL recebido
+func DlResponse(knownPeers *peers.SafePeers, localClock *clock.Clock, receivedMessage message.BaseMessage, senderAddress string, sharedPath string, conn net.Conn) {
+	origin := receivedMessage.Origin
+
+	// Limita a quantidade de DL atendidos ao mesmo tempo
+	select {
+	case inFlight <- struct{}{}:
+		defer func() { <-inFlight }()
+	default:
+		ErrorResponse(knownPeers, localClock, origin, senderAddress, message.BUSY, "muitas requisições simultâneas", conn)
+		return
+	}
+
+	// Valida os argumentos recebidos
+	if len(receivedMessage.Arguments) < 3 {
+		ErrorResponse(knownPeers, localClock, origin, senderAddress, message.BAD_ARGS, "esperado <arquivo> <chunk> <índice>", conn)
+		return
+	}
+	chosenFile, err := message.Unescape(receivedMessage.Arguments[0])
+	if err != nil {
+		ErrorResponse(knownPeers, localClock, origin, senderAddress, message.BAD_ARGS, err.Error(), conn)
+		return
+	}
+	receivedChunkSize, err := strconv.Atoi(receivedMessage.Arguments[1])
+	if err != nil || receivedChunkSize <= 0 || receivedChunkSize > message.MAX_CHUNK_SIZE {
+		ErrorResponse(knownPeers, localClock, origin, senderAddress, message.BAD_ARGS, "tamanho de chunk inválido", conn)
+		return
+	}
 	indexString := receivedMessage.Arguments[2]
-	index, _ := strconv.Atoi(indexString)
+	index, err := strconv.Atoi(indexString)
+	if err != nil || index < 0 {
+		ErrorResponse(knownPeers, localClock, origin, senderAddress, message.BAD_INDEX, "índice inválido", conn)
+		return
+	}
+
+	// O quarto argumento (opcional) escolhe como o conteúdo volta, base64 por padrão
+	encoding := message.BASE64_ENCODING
+	if len(receivedMessage.Arguments) > 3 {
+		encoding = receivedMessage.Arguments[3]
+		if !message.LocalCapabilities().SupportsEncoding(encoding) {
+			ErrorResponse(knownPeers, localClock, origin, senderAddress, message.BAD_ARGS, "codificação "+encoding+" não suportada", conn)
+			return
+		}
+	}
 
+	// Só atende arquivos que estão diretamente no diretório compartilhado, e não os downloads em andamento
+	if chosenFile == "" || filepath.Base(chosenFile) != chosenFile || files.IsPartial(chosenFile) {
+		ErrorResponse(knownPeers, localClock, origin, senderAddress, message.FILE_NOT_FOUND, chosenFile, conn)
+		return
+	}
+
+	// Lê o arquivo escolhido
 	data, err := os.ReadFile(sharedPath + chosenFile)
-	check(err)
+	if errors.Is(err, fs.ErrNotExist) {
+		ErrorResponse(knownPeers, localClock, origin, senderAddress, message.FILE_NOT_FOUND, chosenFile, conn)
+		return
+	} else if err != nil {
+		// BUSY é só para recusas temporárias, então um arquivo ilegível é tratado como inexistente
+		ErrorResponse(knownPeers, localClock, origin, senderAddress, message.FILE_NOT_FOUND, "não foi possível ler o arquivo", conn)
+		return
+	}
 
 	// Pega o pedaço do arquivo de acordo com o chunk escolhido
+	lastIndex := 0
+	if len(data) > 0 {
+		lastIndex = (len(data) - 1) / receivedChunkSize
+	}
+	if index > lastIndex {
+		ErrorResponse(knownPeers, localClock, origin, senderAddress, message.BAD_INDEX, "chunk "+indexString+" fora do arquivo", conn)
+		return
+	}
 	start := index * receivedChunkSize
 	end := start + receivedChunkSize
 	if end > len(data) {
 		end = len(data)
 	}
 	selected := data[start:end]
-	encoded := base64.StdEncoding.EncodeToString(selected)
 
-	// Cria o argumento sobre o arquivo e envia a mensagem
-	arguments := []string{receivedMessage.Arguments[0], strconv.Itoa(len(selected)), indexString, encoded}
-	sendMessage := message.BaseMessage{Origin: senderAddress, Clock: 0, Type: message.FILE, Arguments: arguments}
-	connection.SendMessage(knownPeers, conn, sendMessage, receivedMessage.Origin)
+	// No modo binário os bytes vão crus depois da linha, senão são codificados em base64 no último argumento
+	arguments := []string{receivedMessage.Arguments[0], strconv.Itoa(len(selected)), indexString, message.BINARY_DATA}
+	var payload []byte
+	if encoding == message.BINARY_ENCODING {
+		payload = selected
+	} else {
+		arguments[3] = base64.StdEncoding.EncodeToString(selected)
+	}
+
+	// Peers que entendem hashes recebem o SHA-256 do chunk para conferir o que chegou
+	if neighbor, _ := knownPeers.Get(origin); neighbor.Capabilities.HasFeature(message.HASH_FEATURE) {
+		arguments = append(arguments, files.HashBytes(selected))
+	}
+
+	// Cria a mensagem sobre o arquivo e a envia
+	sendMessage := message.BaseMessage{Origin: senderAddress, Clock: 0, Type: message.FILE, Arguments: arguments, Payload: payload}
+	connection.SendMessage(knownPeers, localClock, conn, sendMessage, receivedMessage.Origin)
 }
 
 // Função para lidar com o BYE recebido
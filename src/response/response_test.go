@@ -1,10 +1,19 @@
 package response
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
+	"net"
+	"os"
+	"strings"
 	"testing"
 
+	"eachare/src/clock"
+	"eachare/src/connection"
+	"eachare/src/files"
 	"eachare/src/logger"
+	"eachare/src/message"
 	"eachare/src/peers"
 )
 
@@ -17,7 +26,7 @@ func TestGetPeersResponse(t *testing.T) {
 	var buffer bytes.Buffer
 	logger.SetOutput(&buffer)
 
-	GetPeersResponse(&initialPeers, "127.0.0.1:9001", "127.0.0.1:9002", nil)
+	GetPeersResponse(&initialPeers, clock.New(), "127.0.0.1:9001", "127.0.0.1:9002", nil)
 
 	out := buffer.String()
 	expected := `Saindo...
@@ -29,3 +38,143 @@ func TestGetPeersResponse(t *testing.T) {
 		t.Errorf("\nExpected %d:\n%s\nGot %d:\n%s", len(expected), expected, len(out), out)
 	}
 }
+
+func TestDlResponseErrors(t *testing.T) {
+	sharedPath := t.TempDir() + "/"
+	os.WriteFile(sharedPath+"hello.txt", []byte("hello world"), 0644)
+	os.WriteFile(sharedPath+"hello.txt"+files.PARTIAL_SUFFIX, []byte("hello"), 0644)
+	os.WriteFile(sharedPath+"hello.txt"+files.JOURNAL_SUFFIX, []byte("{}"), 0644)
+	os.Mkdir(sharedPath+"folder", 0755)
+
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: "127.0.0.1:9001", Status: peers.ONLINE, Clock: 0})
+	knownPeers.SetCapabilities("127.0.0.1:9001", message.LocalCapabilities())
+
+	tests := []struct {
+		arguments []string
+		expected  message.ErrorCode
+	}{
+		{[]string{"missing.txt", "4", "0"}, message.FILE_NOT_FOUND},
+		{[]string{"..%2Fhello.txt", "4", "0"}, message.FILE_NOT_FOUND},
+		{[]string{"hello.txt" + files.PARTIAL_SUFFIX, "4", "0"}, message.FILE_NOT_FOUND},
+		{[]string{"hello.txt" + files.JOURNAL_SUFFIX, "4", "0"}, message.FILE_NOT_FOUND},
+		{[]string{"folder", "4", "0"}, message.FILE_NOT_FOUND},
+		{[]string{"hello.txt", "4", "3"}, message.BAD_INDEX},
+		{[]string{"hello.txt", "4", "-1"}, message.BAD_INDEX},
+		{[]string{"hello.txt", "0", "0"}, message.BAD_ARGS},
+		{[]string{"hello.txt"}, message.BAD_ARGS},
+		{[]string{"hello.txt", "4", "0", "gzip"}, message.BAD_ARGS},
+	}
+
+	for _, test := range tests {
+		server, client := net.Pipe()
+		received := message.BaseMessage{Origin: "127.0.0.1:9001", Clock: 1, Type: message.DL, Arguments: test.arguments}
+		go func() {
+			DlResponse(&knownPeers, clock.New(), received, "127.0.0.1:9002", sharedPath, server)
+			server.Close()
+		}()
+
+		line, _ := bufio.NewReader(client).ReadString('\n')
+		client.Close()
+		reply, err := message.Decode(line)
+		if err != nil || reply.Type != message.ERROR {
+			t.Errorf("DL %q: expected ERROR reply, got %q", test.arguments, line)
+			continue
+		}
+		if code := message.ParseError(reply).Code; code != test.expected {
+			t.Errorf("DL %q: expected %s, got %s", test.arguments, test.expected, code)
+		}
+	}
+}
+
+func TestDlResponseLegacyPeer(t *testing.T) {
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: "127.0.0.1:9001", Status: peers.ONLINE, Clock: 0})
+
+	// Peers sem o ERROR anunciado só têm a conexão fechada
+	server, client := net.Pipe()
+	received := message.BaseMessage{Origin: "127.0.0.1:9001", Clock: 1, Type: message.DL, Arguments: []string{"missing.txt", "4", "0"}}
+	go func() {
+		DlResponse(&knownPeers, clock.New(), received, "127.0.0.1:9002", t.TempDir()+"/", server)
+		server.Close()
+	}()
+
+	line, _ := bufio.NewReader(client).ReadString('\n')
+	if line != "" {
+		t.Errorf("Expected no reply for legacy peer, got %q", line)
+	}
+}
+
+func TestDlResponseBinary(t *testing.T) {
+	sharedPath := t.TempDir() + "/"
+	content := []byte("hello\n\x00world")
+	os.WriteFile(sharedPath+"hello.bin", content, 0644)
+
+	var knownPeers peers.SafePeers
+	knownPeers.Add(peers.Peer{Address: "127.0.0.1:9001", Status: peers.ONLINE, Clock: 0})
+	knownPeers.SetCapabilities("127.0.0.1:9001", message.LocalCapabilities())
+
+	for _, encoding := range []string{message.BINARY_ENCODING, message.BASE64_ENCODING} {
+		server, client := net.Pipe()
+		received := message.BaseMessage{Origin: "127.0.0.1:9001", Clock: 1, Type: message.DL, Arguments: []string{"hello.bin", "8", "1", encoding}}
+		go func() {
+			DlResponse(&knownPeers, clock.New(), received, "127.0.0.1:9002", sharedPath, server)
+			server.Close()
+		}()
+
+		var clientPeers peers.SafePeers
+		reply, err := connection.ReceiveMessage(&clientPeers, client)
+		client.Close()
+		if err != nil || reply.Type != message.FILE {
+			t.Errorf("%s: expected FILE reply, got %v (%v)", encoding, reply, err)
+			continue
+		}
+
+		data := reply.Payload
+		if encoding == message.BASE64_ENCODING {
+			if reply.HasBinaryPayload() {
+				t.Errorf("base64: unexpected binary payload")
+			}
+			data, _ = base64.StdEncoding.DecodeString(reply.Arguments[3])
+		}
+		if string(data) != string(content[8:]) {
+			t.Errorf("%s: expected %q, got %q", encoding, content[8:], data)
+		}
+		if len(reply.Arguments) != 5 || reply.Arguments[4] != files.HashBytes(content[8:]) {
+			t.Errorf("%s: expected chunk digest, got %q", encoding, reply.Arguments)
+		}
+	}
+}
+
+func TestLsResponseHash(t *testing.T) {
+	sharedPath := t.TempDir() + "/"
+	os.WriteFile(sharedPath+"a b.txt", []byte("hello"), 0644)
+	os.WriteFile(sharedPath+"c.txt"+files.PARTIAL_SUFFIX, []byte("downloading"), 0644)
+
+	for _, capabilities := range []message.Capabilities{message.LocalCapabilities(), {Version: message.LEGACY_VERSION}} {
+		var knownPeers peers.SafePeers
+		knownPeers.Add(peers.Peer{Address: "127.0.0.1:9001", Status: peers.ONLINE, Clock: 0})
+		knownPeers.SetCapabilities("127.0.0.1:9001", capabilities)
+
+		server, client := net.Pipe()
+		go func() {
+			LsResponse(&knownPeers, clock.New(), "127.0.0.1:9001", "127.0.0.1:9002", sharedPath, server)
+			server.Close()
+		}()
+
+		var clientPeers peers.SafePeers
+		reply, err := connection.ReceiveMessage(&clientPeers, client)
+		client.Close()
+		if err != nil || reply.Type != message.LS_LIST || len(reply.Arguments) != 2 {
+			t.Fatalf("Expected LS_LIST with one file, got %v (%v)", reply, err)
+		}
+		fields, _ := message.SplitFields(reply.Arguments[1])
+		expected := []string{"a b.txt", "5"}
+		if capabilities.HasFeature(message.HASH_FEATURE) {
+			expected = append(expected, files.HashBytes([]byte("hello")))
+		}
+		if strings.Join(fields, "|") != strings.Join(expected, "|") {
+			t.Errorf("Expected fields %q, got %q", expected, fields)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+// Pacotes nativos de go e pacotes internos
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"eachare/src/clock"
+	"eachare/src/commands"
+	"eachare/src/connection"
+	"eachare/src/logger"
+	"eachare/src/peers"
+)
+
+// Intervalo entre as verificações de uma condição esperada pela simulação
+const SIMULATION_POLL_INTERVAL = 10 * time.Millisecond
+
+// Erro para uma ação com um peer que não foi adicionado à simulação
+var ErrUnknownSimulatedPeer = errors.New("peer desconhecido na simulação")
+
+// Estrutura para um peer da simulação, com diretório, tabela de peers e listener próprios
+type simulatedPeer struct {
+	client     *Client
+	listener   *peerListener
+	statistics []commands.Statistic
+}
+
+// Estrutura para uma rede de peers rodando no mesmo processo, conectados por uma rede em memória
+// Usada nos testes de integração para roteirizar ações e verificar tabelas de peers, arquivos e logs
+type Simulation struct {
+	root    string
+	network *connection.MemoryNetwork
+	logs    logBuffer
+
+	mu    sync.Mutex
+	peers map[string]*simulatedPeer
+}
+
+// Estrutura para guardar os logs de todos os peers da simulação
+type logBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+// Função para escrever no buffer de logs
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+// Função para ler o buffer de logs
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+// Estrutura para o listener de um peer da simulação, que guarda as conexões aceitas
+// Fechar o listener também fecha essas conexões, como quando o processo do peer termina
+type peerListener struct {
+	net.Listener
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// Função para aceitar a próxima conexão, guardando-a para o Close
+func (l *peerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.conns = append(l.conns, conn)
+	l.mu.Unlock()
+	return conn, nil
+}
+
+// Função para parar de escutar e derrubar as conexões aceitas, inclusive as sessões em aberto
+func (l *peerListener) Close() error {
+	err := l.Listener.Close()
+	l.mu.Lock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+	l.mu.Unlock()
+	return err
+}
+
+// Função para instanciar uma simulação, com os arquivos dos peers dentro do diretório root
+// A saída do logger passa a ser guardada pela simulação até o Close
+func NewSimulation(root string) *Simulation {
+	s := &Simulation{root: root, network: connection.NewMemoryNetwork(), peers: make(map[string]*simulatedPeer)}
+	logger.SetOutput(&s.logs)
+	return s
+}
+
+// Função para adicionar e iniciar um peer, com seus vizinhos e os arquivos do diretório compartilhado
+func (s *Simulation) AddPeer(address string, neighbors []string, sharedFiles map[string]string) error {
+	// Cada peer tem um diretório próprio, com o arquivo de vizinhos, o diretório compartilhado e o de dados
+	dir := s.peerDir(address)
+	sharedPath := filepath.Join(dir, "shared") + "/"
+	if err := os.MkdirAll(sharedPath, 0755); err != nil {
+		return err
+	}
+	for name, content := range sharedFiles {
+		if err := os.WriteFile(filepath.Join(sharedPath, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	neighborsPath := filepath.Join(dir, "neighbors.txt")
+	if err := os.WriteFile(neighborsPath, []byte(strings.Join(neighbors, "\n")), 0644); err != nil {
+		return err
+	}
+	return s.start(address, clock.LAMPORT)
+}
+
+// Função para o diretório dos arquivos do peer
+func (s *Simulation) peerDir(address string) string {
+	return filepath.Join(s.root, strings.ReplaceAll(address, ":", "_"))
+}
+
+// Função para iniciar o peer a partir do seu diretório, restaurando o estado guardado, se houver
+func (s *Simulation) start(address string, mode clock.Mode) error {
+	// Inicia o peer do mesmo jeito que o main, mas escutando na rede em memória
+	dir := s.peerDir(address)
+	client := NewClient(address, filepath.Join(dir, "neighbors.txt"), filepath.Join(dir, "shared")+"/", s.network)
+	client.addNeighbors()
+	client.verifySharedDirectory()
+	client.useClock(mode)
+	if err := client.usePersistence(filepath.Join(dir, "data")); err != nil {
+		return err
+	}
+	listener, err := s.network.Listen(address)
+	if err != nil {
+		return err
+	}
+	tracked := &peerListener{Listener: listener}
+	go accept(&client, tracked)
+
+	s.mu.Lock()
+	s.peers[address] = &simulatedPeer{client: &client, listener: tracked}
+	s.mu.Unlock()
+	return nil
+}
+
+// Função para obter um peer da simulação
+func (s *Simulation) peer(address string) (*simulatedPeer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, exists := s.peers[address]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSimulatedPeer, address)
+	}
+	return peer, nil
+}
+
+// Função para o peer trocar HELLO com um vizinho, passando a usar as extensões que ele anunciar
+func (s *Simulation) Hello(address string, neighbor string) error {
+	peer, err := s.peer(address)
+	if err != nil {
+		return err
+	}
+	commands.HelloRequest(peer.client.knownPeers, peer.client.clock, peer.client.pool, peer.client.address, neighbor)
+	return nil
+}
+
+// Função para trocar o relógio do peer, como a opção --clock, antes de ele trocar mensagens
+func (s *Simulation) UseClock(address string, mode clock.Mode) error {
+	peer, err := s.peer(address)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer.client.pool.Close()
+	peer.client.useClock(mode)
+	peer.client.clock.SetCheckpoint(peer.client.checkpoint)
+	return nil
+}
+
+// Função para injetar falhas nas mensagens enviadas pelo peer, tanto nas requisições quanto nas respostas
+// O listener é reaberto pelo injetor, e as conexões já aceitas são derrubadas para também passarem por ele
+func (s *Simulation) InjectFaults(address string, seed int64, rules ...connection.FaultRule) (*connection.FaultInjector, error) {
+	peer, err := s.peer(address)
+	if err != nil {
+		return nil, err
+	}
+	injector := connection.NewFaultInjector(s.network, seed, rules...)
+	peer.listener.Close()
+	listener, err := injector.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	tracked := &peerListener{Listener: listener}
+	go accept(peer.client, tracked)
+
+	s.mu.Lock()
+	peer.client.pool.Close()
+	peer.client.transport = injector
+	peer.client.pool = connection.NewPool(injector, peer.client.clock)
+	peer.listener = tracked
+	s.mu.Unlock()
+	return injector, nil
+}
+
+// Função para ligar o detector de falhas do peer, como a opção --heartbeat
+func (s *Simulation) StartHeartbeat(address string, interval time.Duration) error {
+	peer, err := s.peer(address)
+	if err != nil {
+		return err
+	}
+	peer.client.startHeartbeat(interval)
+	return nil
+}
+
+// Função para o peer pedir a lista de peers aos seus vizinhos, como o comando [2]
+func (s *Simulation) GetPeers(address string) error {
+	peer, err := s.peer(address)
+	if err != nil {
+		return err
+	}
+	commands.GetPeersRequest(peer.client.knownPeers, peer.client.clock, peer.client.pool, peer.client.address)
+	return nil
+}
+
+// Função para o peer buscar os arquivos dos vizinhos online, como o comando [4] sem o menu
+func (s *Simulation) Search(address string) (*commands.FileList, error) {
+	peer, err := s.peer(address)
+	if err != nil {
+		return nil, err
+	}
+	fileList, _ := commands.SearchFiles(peer.client.knownPeers, peer.client.clock, peer.client.pool, peer.client.address)
+	return fileList, nil
+}
+
+// Função para o peer buscar um arquivo pelo nome e baixá-lo, esperando o download terminar
+func (s *Simulation) Download(address string, filename string) error {
+	peer, err := s.peer(address)
+	if err != nil {
+		return err
+	}
+	fileList, _ := commands.SearchFiles(peer.client.knownPeers, peer.client.clock, peer.client.pool, peer.client.address)
+	file, found := fileList.Find(filename)
+	if !found {
+		return errors.New("arquivo não encontrado na busca: " + filename)
+	}
+	return commands.DlRequest(peer.client.knownPeers, peer.client.clock, peer.client.pool, file, peer.client.address, peer.client.shared, peer.client.chunkSize, &peer.statistics)
+}
+
+// Função para alterar o tamanho de chunk usado pelos downloads do peer, como o comando [6]
+func (s *Simulation) SetChunkSize(address string, chunkSize int) error {
+	peer, err := s.peer(address)
+	if err != nil {
+		return err
+	}
+	peer.client.chunkSize = chunkSize
+	return nil
+}
+
+// Função para o peer sair da rede avisando os vizinhos, como o comando [9]
+func (s *Simulation) Bye(address string) error {
+	peer, err := s.peer(address)
+	if err != nil {
+		return err
+	}
+	peer.client.stopHeartbeat()
+	commands.ByeRequest(peer.client.knownPeers, peer.client.pool, peer.client.address)
+	peer.client.clock.Checkpoint()
+	peer.listener.Close()
+	return nil
+}
+
+// Função para derrubar o peer sem avisar ninguém, como se o processo tivesse morrido
+func (s *Simulation) Crash(address string) error {
+	peer, err := s.peer(address)
+	if err != nil {
+		return err
+	}
+	peer.listener.Close()
+	peer.client.pool.Close()
+	peer.client.stopHeartbeat()
+	peer.client.stopPersistence()
+	return nil
+}
+
+// Função para reiniciar o peer depois de uma queda, com o mesmo tipo de relógio
+// O novo processo só conhece o que estava nos arquivos do peer, como o estado guardado no diretório de dados
+func (s *Simulation) Restart(address string) error {
+	peer, err := s.peer(address)
+	if err != nil {
+		return err
+	}
+	return s.RestartWithClock(address, peer.client.clock.Mode())
+}
+
+// Função para reiniciar o peer com outro modo de relógio, como ao trocar a opção --clock entre execuções
+func (s *Simulation) RestartWithClock(address string, mode clock.Mode) error {
+	peer, err := s.peer(address)
+	if err != nil {
+		return err
+	}
+	peer.listener.Close()
+	peer.client.pool.Close()
+	peer.client.stopHeartbeat()
+	peer.client.stopPersistence()
+	return s.start(address, mode)
+}
+
+// Função para consultar como o peer enxerga um vizinho na sua tabela de peers
+func (s *Simulation) PeerEntry(address string, neighbor string) (peers.Peer, bool) {
+	peer, err := s.peer(address)
+	if err != nil {
+		return peers.Peer{}, false
+	}
+	return peer.client.knownPeers.Get(neighbor)
+}
+
+// Função para consultar o relógio do peer
+func (s *Simulation) Clock(address string) (int, error) {
+	peer, err := s.peer(address)
+	if err != nil {
+		return 0, err
+	}
+	return peer.client.clock.Get(), nil
+}
+
+// Função para ler um arquivo do diretório compartilhado do peer
+func (s *Simulation) ReadFile(address string, filename string) ([]byte, error) {
+	peer, err := s.peer(address)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(peer.client.shared, filename))
+}
+
+// Função para obter os logs de todos os peers até aqui
+func (s *Simulation) Logs() string {
+	logger.Flush()
+	return s.logs.String()
+}
+
+// Função para esperar uma condição que depende de mensagens ainda em trânsito, como o BYE
+func (s *Simulation) Await(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(SIMULATION_POLL_INTERVAL)
+	}
+	return true
+}
+
+// Função para encerrar todos os peers e devolver a saída do logger para o terminal
+func (s *Simulation) Close() {
+	s.mu.Lock()
+	for _, peer := range s.peers {
+		peer.listener.Close()
+		peer.client.pool.Close()
+		peer.client.stopHeartbeat()
+		peer.client.stopPersistence()
+	}
+	s.mu.Unlock()
+	logger.Flush()
+	logger.SetOutput(nil)
+}
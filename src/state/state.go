@@ -0,0 +1,119 @@
+package state
+
+// Pacotes nativos de go e pacote interno
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"eachare/src/clock"
+)
+
+// Nome do arquivo de estado dentro do diretório de dados do peer
+const STATE_FILE = "state.json"
+
+// Erro para um arquivo de estado que não pôde ser interpretado
+var ErrBadState = errors.New("arquivo de estado inválido")
+
+// Estrutura para um peer guardado da tabela, com o status no formato da linha (ONLINE ou OFFLINE)
+type PeerState struct {
+	Address  string       `json:"address"`
+	Status   string       `json:"status"`
+	Clock    int          `json:"clock"`
+	Vector   clock.Vector `json:"vector,omitempty"`
+	LastSeen time.Time    `json:"last_seen"`
+	Failures int          `json:"failures"`
+}
+
+// Estrutura para o estado do peer que precisa sobreviver a um reinício
+// Clock é um valor que o relógio ainda não alcançou, ver clock.Clock.SetCheckpoint
+type State struct {
+	Mode   string       `json:"mode"`
+	Clock  int          `json:"clock"`
+	Vector clock.Vector `json:"vector,omitempty"`
+	Peers  []PeerState  `json:"peers"`
+}
+
+// Estrutura para o arquivo de estado de um diretório de dados
+// O mutex garante que dois Save não escrevam o arquivo temporário ao mesmo tempo
+type Store struct {
+	mu   sync.Mutex
+	path string
+}
+
+// Função para abrir o arquivo de estado do diretório, criando o diretório se não existir
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{path: filepath.Join(dir, STATE_FILE)}, nil
+}
+
+// Função para retornar o caminho do arquivo de estado
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Função para gravar o estado, substituindo o anterior só depois de escrito por inteiro
+func (s *Store) Save(state State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return WriteFileAtomic(s.path, data)
+}
+
+// Função para ler o estado gravado, retornando um erro com os.ErrNotExist se ainda não houver um
+func (s *Store) Load() (State, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return State{}, err
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return State{}, errors.Join(ErrBadState, err)
+	}
+	if state.Clock < 0 {
+		return State{}, ErrBadState
+	}
+	return state, nil
+}
+
+// Função para gravar um arquivo sem deixar uma versão pela metade se o programa cair no meio
+// O conteúdo vai para um arquivo temporário no mesmo diretório, que é sincronizado com o disco e renomeado por cima do original
+// O diretório também é sincronizado, para que a troca de nome sobreviva a uma queda de energia
+func WriteFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	temp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return err
+	}
+
+	// Nem todo sistema permite sincronizar um diretório, então a falha aqui não desfaz a gravação
+	if directory, err := os.Open(dir); err == nil {
+		directory.Sync()
+		directory.Close()
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"eachare/src/clock"
+)
+
+func TestSaveLoad(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	if _, err := store.Load(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected os.ErrNotExist before the first save, got %v", err)
+	}
+
+	saved := State{Mode: "vector", Clock: 120, Vector: clock.Vector{"a": 3}, Peers: []PeerState{{Address: "127.0.0.1:9002", Clock: 7}}}
+	if err := store.Save(saved); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded.Mode != "vector" || loaded.Clock != 120 || loaded.Vector["a"] != 3 || len(loaded.Peers) != 1 || loaded.Peers[0].Clock != 7 {
+		t.Errorf("Loaded state differs from the saved one: %+v", loaded)
+	}
+
+	// Só o arquivo de estado fica no diretório, sem temporários
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != STATE_FILE {
+		t.Errorf("Expected only %s in the data directory, got %v", STATE_FILE, entries)
+	}
+}
+
+func TestLoadBadState(t *testing.T) {
+	store, _ := NewStore(t.TempDir())
+	for _, content := range []string{"{\"clock\": 1", "{\"clock\": -1}"} {
+		os.WriteFile(store.Path(), []byte(content), 0644)
+		if _, err := store.Load(); !errors.Is(err, ErrBadState) {
+			t.Errorf("Expected ErrBadState for %q, got %v", content, err)
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(path, []byte("old"), 0644)
+	if err := WriteFileAtomic(path, []byte("new")); err != nil {
+		t.Fatalf("WriteFileAtomic failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Errorf("Expected the new content, got %q", data)
+	}
+
+	// Sem conseguir criar o temporário, o arquivo original continua intacto
+	if err := WriteFileAtomic(filepath.Join(path, "missing", "file"), []byte("x")); err == nil {
+		t.Errorf("Expected an error for a missing directory")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Errorf("Expected the file to be untouched, got %q", data)
+	}
+}